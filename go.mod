@@ -5,7 +5,6 @@ go 1.19
 require (
 	github.com/SnellerInc/sneller v0.0.0-20230505151417-5806cd3a42c7
 	github.com/grafana/grafana-plugin-sdk-go v0.159.0
-	github.com/patrickmn/go-cache v2.1.0+incompatible
 	go.opentelemetry.io/otel v1.14.0
 	go.opentelemetry.io/otel/trace v1.14.0
 	golang.org/x/exp v0.0.0-20230425010034-47ecfdc1ba53
@@ -20,6 +19,7 @@ require (
 	github.com/cheekybits/genny v1.0.0 // indirect
 	github.com/chromedp/cdproto v0.0.0-20220208224320-6efb837e6bc2 // indirect
 	github.com/cpuguy83/go-md2man/v2 v2.0.2 // indirect
+	github.com/dchest/siphash v1.2.3 // indirect
 	github.com/elazarl/goproxy v0.0.0-20220115173737-adb46da277ac // indirect
 	github.com/fatih/color v1.7.0 // indirect
 	github.com/getkin/kin-openapi v0.112.0 // indirect
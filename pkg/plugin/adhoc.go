@@ -0,0 +1,154 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// applyAdhocFilters restricts the result of the given query to the rows matching all of the given
+// ad hoc filters. The query is not interpolated yet, so macros in filter values are escaped.
+func applyAdhocFilters(sql string, filters []snellerAdhocFilter) (string, error) {
+	if len(filters) == 0 {
+		return sql, nil
+	}
+
+	conditions := make([]string, len(filters))
+	for i, filter := range filters {
+		condition, err := adhocFilterCondition(filter)
+		if err != nil {
+			return "", err
+		}
+		conditions[i] = condition
+	}
+
+	return fmt.Sprintf("SELECT * FROM (%s) WHERE %s", trimStatement(sql), strings.Join(conditions, " AND ")), nil
+}
+
+// adhocFilterCondition returns the SQL condition of the given ad hoc filter. Values that look like
+// numbers match both numeric and string values, as Grafana passes all values as strings.
+func adhocFilterCondition(filter snellerAdhocFilter) (string, error) {
+	if filter.Key == "" {
+		return "", fmt.Errorf("ad hoc filter: missing key")
+	}
+
+	key := quoteIdentifierPath(filter.Key)
+	value := quoteAdhocValue(filter.Value)
+
+	equals := fmt.Sprintf("%s = %s", key, value)
+	if number, ok := adhocNumber(filter.Value); ok {
+		equals = fmt.Sprintf("(%s = %s OR %s)", key, number, equals)
+	}
+
+	switch filter.Operator {
+	case "=":
+		return equals, nil
+	case "!=":
+		return fmt.Sprintf("NOT %s", equals), nil
+	case "=~":
+		return fmt.Sprintf("%s SIMILAR TO %s", key, quoteAdhocValue(similarPattern(filter.Value))), nil
+	case "!~":
+		return fmt.Sprintf("%s NOT SIMILAR TO %s", key, quoteAdhocValue(similarPattern(filter.Value))), nil
+	default:
+		return "", fmt.Errorf("ad hoc filter: unsupported operator '%s'", filter.Operator)
+	}
+}
+
+// regexDecimalLiteral matches plain decimal numbers, e.g. '-1', '2.5' or '1e6'.
+var regexDecimalLiteral = regexp.MustCompile(`^[-+]?([0-9]+(\.[0-9]*)?|\.[0-9]+)([eE][-+]?[0-9]+)?$`)
+
+// adhocNumber returns the given filter value as a numeric SQL literal, if it is a plain decimal
+// number. The literal is formatted from the parsed value, so other syntax accepted by
+// strconv.ParseFloat (e.g. 'Inf', 'NaN' or '0x1p4') never reaches the query.
+func adhocNumber(value string) (string, bool) {
+	if !regexDecimalLiteral.MatchString(value) {
+		return "", false
+	}
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return strconv.FormatInt(i, 10), true
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsInf(f, 0) {
+		return "", false
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64), true
+}
+
+// quoteAdhocValue returns the given value as a string literal. Macros are escaped, as the filters
+// are applied before the query is interpolated.
+func quoteAdhocValue(value string) string {
+	return quoteStringLiteral(strings.ReplaceAll(value, "$__", macroEscape))
+}
+
+// stringLiteralEscaper escapes the characters that end a string literal. Sneller only supports
+// backslash escapes, doubled quotes are not accepted.
+var stringLiteralEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// quoteStringLiteral returns the given value as a single quoted string literal, e.g. 'O\'Brien'.
+func quoteStringLiteral(value string) string {
+	return "'" + stringLiteralEscaper.Replace(value) + "'"
+}
+
+// similarPattern translates the wildcards of a regular expression ('.*' and '.') to the wildcards
+// of a SIMILAR TO pattern ('%' and '_'). Other regex syntax is the same for SIMILAR TO.
+func similarPattern(regex string) string {
+	var b strings.Builder
+	for i := 0; i < len(regex); i++ {
+		switch {
+		case regex[i] == '\\' && i+1 < len(regex):
+			if regex[i+1] != '.' {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(regex[i+1])
+			i++
+		case strings.HasPrefix(regex[i:], ".*"):
+			b.WriteByte('%')
+			i++
+		case regex[i] == '.':
+			b.WriteByte('_')
+		case regex[i] == '%' || regex[i] == '_':
+			b.WriteByte('\\')
+			b.WriteByte(regex[i])
+		default:
+			b.WriteByte(regex[i])
+		}
+	}
+	return b.String()
+}
+
+// quoteIdentifierPath quotes the fields of the given dot separated path, e.g. 'a.b' as '"a"."b"'.
+func quoteIdentifierPath(path string) string {
+	fields := strings.Split(path, ".")
+	for i, field := range fields {
+		fields[i] = strconv.Quote(field)
+	}
+	return strings.Join(fields, ".")
+}
+
+// getAdhocKeys returns the names of the columns of all tables of the given database, which are
+// offered as ad hoc filter keys.
+func (d *Datasource) getAdhocKeys(ctx context.Context, database string) ([]string, int, error) {
+	tables, status, err := d.getTables(ctx, database)
+	if err != nil {
+		return nil, status, err
+	}
+
+	keys := []string{}
+	for _, table := range tables {
+		columns, status, err := d.getColumns(ctx, database, table)
+		if err != nil {
+			return nil, status, fmt.Errorf("table '%s': %w", table, err)
+		}
+		for _, col := range columns {
+			keys = append(keys, col.Name)
+		}
+	}
+
+	slices.Sort(keys)
+	return slices.Compact(keys), 0, nil
+}
@@ -0,0 +1,149 @@
+package plugin
+
+import (
+	"testing"
+)
+
+func TestQuoteAdhocValue(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+		parsed   string // The value of the literal, which differs from the value for macros
+	}{
+		{value: "plain", expected: `'plain'`},
+		{value: "O'Brien", expected: `'O\'Brien'`},
+		{value: `C:\temp`, expected: `'C:\\temp'`},
+		{value: `x\' OR TRUE --`, expected: `'x\\\' OR TRUE --'`},
+		{value: `'; DROP TABLE t --`, expected: `'\'; DROP TABLE t --'`},
+		{value: "line\nbreak", expected: "'line\nbreak'"},
+		{value: "$__interval", expected: `'$$__interval'`, parsed: "$$__interval"},
+		{value: "$__timeFilter(time) '$__from'", expected: `'$$__timeFilter(time) \'$$__from\''`, parsed: "$$__timeFilter(time) '$$__from'"},
+	}
+
+	for _, test := range tests {
+		quoted := quoteAdhocValue(test.value)
+		if quoted != test.expected {
+			t.Errorf("%q: expected %s, got %s", test.value, test.expected, quoted)
+		}
+		parsed := test.parsed
+		if parsed == "" {
+			parsed = test.value
+		}
+		if value := parseStringLiteral(t, quoted); value != parsed {
+			t.Errorf("%q: expected the literal %q, got %q", test.value, parsed, value)
+		}
+	}
+}
+
+func TestAdhocFilterCondition(t *testing.T) {
+	tests := []struct {
+		filter   snellerAdhocFilter
+		expected string
+	}{
+		{
+			filter:   snellerAdhocFilter{Key: "name", Operator: "=", Value: "O'Brien"},
+			expected: `"name" = 'O\'Brien'`,
+		},
+		{
+			filter:   snellerAdhocFilter{Key: "name", Operator: "!=", Value: `a\b`},
+			expected: `NOT "name" = 'a\\b'`,
+		},
+		{
+			filter:   snellerAdhocFilter{Key: "status", Operator: "=", Value: "200"},
+			expected: `("status" = 200 OR "status" = '200')`,
+		},
+		{
+			filter:   snellerAdhocFilter{Key: "ratio", Operator: "!=", Value: "1e3"},
+			expected: `NOT ("ratio" = 1000 OR "ratio" = '1e3')`,
+		},
+		{
+			filter:   snellerAdhocFilter{Key: "request.headers.host", Operator: "=", Value: "example.com"},
+			expected: `"request"."headers"."host" = 'example.com'`,
+		},
+		{
+			filter:   snellerAdhocFilter{Key: `odd"key`, Operator: "=", Value: "x"},
+			expected: `"odd\"key" = 'x'`,
+		},
+		{
+			filter:   snellerAdhocFilter{Key: "path", Operator: "=~", Value: `/api/.*\.json`},
+			expected: `"path" SIMILAR TO '/api/%.json'`,
+		},
+		{
+			filter:   snellerAdhocFilter{Key: "path", Operator: "!~", Value: `100%_d\d`},
+			expected: `"path" NOT SIMILAR TO '100\\%\\_d\\d'`,
+		},
+		{
+			filter:   snellerAdhocFilter{Key: "query", Operator: "=", Value: "$__interval"},
+			expected: `"query" = '$$__interval'`,
+		},
+	}
+
+	for _, test := range tests {
+		condition, err := adhocFilterCondition(test.filter)
+		if err != nil {
+			t.Errorf("%v: %s", test.filter, err)
+			continue
+		}
+		if condition != test.expected {
+			t.Errorf("%v: expected %s, got %s", test.filter, test.expected, condition)
+		}
+		parseQuery(t, "SELECT * FROM t WHERE "+condition)
+	}
+}
+
+func TestAdhocFilterConditionErrors(t *testing.T) {
+	for _, filter := range []snellerAdhocFilter{
+		{Key: "", Operator: "=", Value: "x"},
+		{Key: "name", Operator: "<", Value: "x"},
+	} {
+		if _, err := adhocFilterCondition(filter); err == nil {
+			t.Errorf("%v: expected an error", filter)
+		}
+	}
+}
+
+func TestAdhocNumber(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+		ok       bool
+	}{
+		{"42", "42", true},
+		{"-1", "-1", true},
+		{"+7", "7", true},
+		{"2.50", "2.5", true},
+		{".5", "0.5", true},
+		{"1e6", "1e+06", true},
+		{"Inf", "", false},
+		{"NaN", "", false},
+		{"0x10", "", false},
+		{"1e999", "", false},
+		{"1 OR 1=1", "", false},
+	}
+
+	for _, test := range tests {
+		number, ok := adhocNumber(test.value)
+		if ok != test.ok || number != test.expected {
+			t.Errorf("%q: expected %q (%v), got %q (%v)", test.value, test.expected, test.ok, number, ok)
+		}
+	}
+}
+
+func TestApplyAdhocFilters(t *testing.T) {
+	sql, err := applyAdhocFilters("SELECT * FROM t LIMIT 10;", []snellerAdhocFilter{
+		{Key: "a.b", Operator: "=", Value: "x'y"},
+		{Key: "c", Operator: "!=", Value: "1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `SELECT * FROM (SELECT * FROM t LIMIT 10) WHERE "a"."b" = 'x\'y' AND NOT ("c" = 1 OR "c" = '1')`
+	if sql != expected {
+		t.Errorf("expected %s, got %s", expected, sql)
+	}
+	parseQuery(t, sql)
+
+	if sql, _ := applyAdhocFilters("SELECT 1", nil); sql != "SELECT 1" {
+		t.Errorf("expected the unchanged query without filters, got %s", sql)
+	}
+}
@@ -1,25 +1,176 @@
 package plugin
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/SnellerInc/sneller/ion"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 )
 
+// snellerQueryEndpoint describes how queries are sent to the Sneller endpoint. Sneller-compatible
+// backends may expose the query execution at a different path or accept the query as a GET
+// parameter.
+type snellerQueryEndpoint struct {
+	Method string // The HTTP method (GET or POST)
+	Path   string // The URL path
+	Param  string // The name of the query parameter (GET only)
+}
+
+// newSnellerQueryEndpoint validates the query endpoint settings and applies the defaults.
+func newSnellerQueryEndpoint(jsonData snellerJSONData) (snellerQueryEndpoint, error) {
+	result := snellerQueryEndpoint{
+		Method: strings.ToUpper(jsonData.QueryMethod),
+		Path:   jsonData.QueryPath,
+		Param:  jsonData.QueryParam,
+	}
+
+	if result.Method == "" {
+		result.Method = http.MethodPost
+	}
+	if result.Method != http.MethodPost && result.Method != http.MethodGet {
+		return result, fmt.Errorf("invalid query method '%s': expected GET or POST", jsonData.QueryMethod)
+	}
+
+	if result.Path == "" {
+		result.Path = "/executeQuery"
+	}
+	u, err := url.Parse(result.Path)
+	if err != nil || !strings.HasPrefix(result.Path, "/") || u.Path != result.Path {
+		return result, fmt.Errorf("invalid query path '%s': expected an absolute path without query or fragment", result.Path)
+	}
+
+	if result.Param == "" {
+		result.Param = "query"
+	}
+
+	return result, nil
+}
+
+// snellerAuth describes how requests are authenticated. Reverse proxies in front of Sneller may
+// expect basic authentication or the token in a custom header.
+type snellerAuth struct {
+	Scheme string // The authentication scheme (bearer, basic or custom)
+	Header string // The name of the header containing the token (custom only)
+}
+
+// newSnellerAuth validates the authentication settings and applies the defaults.
+func newSnellerAuth(jsonData snellerJSONData) (snellerAuth, error) {
+	result := snellerAuth{
+		Scheme: strings.ToLower(jsonData.AuthScheme),
+		Header: jsonData.AuthHeader,
+	}
+
+	switch result.Scheme {
+	case "":
+		result.Scheme = snellerAuthBearer
+	case snellerAuthBearer, snellerAuthBasic:
+	case snellerAuthCustom:
+		if result.Header == "" {
+			return result, errors.New("missing auth header name: required for the 'custom' auth scheme")
+		}
+	default:
+		return result, fmt.Errorf("invalid auth scheme '%s': expected bearer, basic or custom", jsonData.AuthScheme)
+	}
+
+	return result, nil
+}
+
+type noRetryKey struct{}
+
+// withNoRetry returns a context that disables retries for all requests executed with it.
+func withNoRetry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRetryKey{}, true)
+}
+
+// retryDisabled returns true, if retries have been disabled for the given context.
+func retryDisabled(ctx context.Context) bool {
+	disabled, _ := ctx.Value(noRetryKey{}).(bool)
+	return disabled
+}
+
 // executeQuery executes a Sneller query and returns the HTTP response.
 func (d *Datasource) executeQuery(ctx context.Context, database, sql string) (*http.Response, error) {
-	return d.executeRequest(ctx, http.MethodPost, "/executeQuery", strings.NewReader(sql),
+	if d.queryEndpoint.Method == http.MethodGet {
+		return d.executeRequest(ctx, http.MethodGet, d.queryEndpoint.Path, nil,
+			map[string]string{"Accept": "application/ion"},
+			queryArgs(database, map[string]string{d.queryEndpoint.Param: sql}))
+	}
+
+	return d.executeRequest(ctx, http.MethodPost, d.queryEndpoint.Path, strings.NewReader(sql),
 		map[string]string{"Accept": "application/ion"},
-		map[string]string{"database": database})
+		queryArgs(database, map[string]string{}))
+}
+
+// queryArgs adds the 'database' argument to the given URL arguments of a query. The argument is
+// omitted for an empty database, as some gateways reject empty values.
+func queryArgs(database string, args map[string]string) map[string]string {
+	if database != "" {
+		args["database"] = database
+	}
+	return args
+}
+
+// estimateScan returns the maximum number of bytes the given query would scan. Sneller plans the
+// query without executing it for HEAD requests and reports the estimate in the response headers.
+// As HEAD requests have no body, the query is always passed as the configured query parameter.
+// Returns -1, if the endpoint does not report an estimate.
+func (d *Datasource) estimateScan(ctx context.Context, database, sql string) (int64, error) {
+	key := fmt.Sprintf("scan_%s_%s", database, sql)
+	cached, found := d.cache.Get(key)
+	if found {
+		return cached.(int64), nil
+	}
+
+	resp, err := d.executeRequest(ctx, http.MethodHead, d.queryEndpoint.Path, nil,
+		map[string]string{"Accept": "application/ion"},
+		queryArgs(database, map[string]string{d.queryEndpoint.Param: sql}))
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.DefaultLogger.Error("failed to close response body", "err", err)
+		}
+	}()
+
+	header := resp.Header.Get("X-Sneller-Max-Scanned-Bytes")
+	if header == "" {
+		return -1, nil
+	}
+
+	result, err := strconv.ParseInt(header, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid scan estimate '%s': %w", header, err)
+	}
+
+	d.cacheLookup(key, result)
+
+	return result, nil
+}
+
+// cacheLookup caches the result of a database, table or column lookup or a scan estimate for the
+// configured TTL, unless caching is disabled.
+func (d *Datasource) cacheLookup(key string, value any) {
+	if d.cacheTTL > 0 {
+		d.cache.Set(key, value, d.cacheTTL)
+	}
 }
 
 // getDatabases returns a list of database names.
@@ -57,7 +208,7 @@ func (d *Datasource) getDatabases(ctx context.Context) ([]string, int, error) {
 		return t.Name
 	})
 
-	d.cache.Set(key, names, time.Minute*1)
+	d.cacheLookup(key, names)
 
 	return names, 0, nil
 }
@@ -93,17 +244,17 @@ func (d *Datasource) getTables(ctx context.Context, database string) ([]string,
 		return nil, 500, err
 	}
 
-	d.cache.Set(key, result, time.Minute*1)
+	d.cacheLookup(key, result)
 
 	return result, 0, nil
 }
 
-// getColumns returns a list of column names for the given database and table.
-func (d *Datasource) getColumns(ctx context.Context, database, table string) ([]string, int, error) {
+// getColumns returns a list of columns for the given database and table.
+func (d *Datasource) getColumns(ctx context.Context, database, table string) ([]snellerColumnInfo, int, error) {
 	key := fmt.Sprintf("columns_%s_%s", database, table)
 	cached, found := d.cache.Get(key)
 	if found {
-		return cached.([]string), 0, nil
+		return cached.([]snellerColumnInfo), 0, nil
 	}
 
 	resp, err := d.executeQuery(ctx, database, fmt.Sprintf(`SELECT SNELLER_DATASHAPE(*) FROM (SELECT * FROM %q LIMIT 1000)`, table))
@@ -129,61 +280,270 @@ func (d *Datasource) getColumns(ctx context.Context, database, table string) ([]
 
 	fields, ok := payload["fields"]
 	if !ok {
-		return []string{}, 0, nil
+		return []snellerColumnInfo{}, 0, nil
 	}
 
 	vals, ok := fields.(map[string]any)
 	if !ok {
-		return []string{}, 0, nil
+		return []snellerColumnInfo{}, 0, nil
 	}
 
-	cols := maps.Keys(vals)
+	total := datashapeInt(payload["total"])
+
+	names := maps.Keys(vals)
+	slices.Sort(names)
+
+	cols := make([]snellerColumnInfo, len(names))
+	for i, name := range names {
+		shape, _ := vals[name].(map[string]any)
+		col := snellerColumnFromDatashape(name, shape, total)
+		cols[i] = snellerColumnInfo{
+			Name:      name,
+			FieldType: grafanaType(col),
+			Type:      col.Typ.String(),
+			Nullable:  col.Nullable || col.Optional,
+		}
+	}
 
-	d.cache.Set(key, cols, time.Minute*1)
+	d.cacheLookup(key, cols)
 
 	return cols, 0, nil
 }
 
-// newRequest creates a new HTTP request and initializes the 'Authentication' header from the
-// configured Sneller authentication token in the 'Authentication' header.
+// defaultColumnValues is the default number of distinct values returned by getColumnValues.
+const defaultColumnValues = 100
+
+// maxColumnValues is the maximum number of distinct values returned by getColumnValues.
+const maxColumnValues = 1000
+
+// getColumnValues returns up to limit distinct values of the given column, e.g. to offer them as
+// the options of a dashboard variable.
+func (d *Datasource) getColumnValues(ctx context.Context, database, table, column string, limit int) ([]any, int, error) {
+	key := fmt.Sprintf("values_%s_%s_%s_%d", database, table, column, limit)
+	cached, found := d.cache.Get(key)
+	if found {
+		return cached.([]any), 0, nil
+	}
+
+	resp, err := d.executeQuery(ctx, database, fmt.Sprintf(`SELECT DISTINCT %s AS "value" FROM %q LIMIT %d`,
+		quoteIdentifierPath(column), table, limit))
+	if err != nil {
+		if resp != nil {
+			return nil, resp.StatusCode, err
+		}
+		return nil, 500, err
+	}
+
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.DefaultLogger.Error("failed to close response body", "err", err)
+		}
+	}()
+
+	values := []any{}
+	status, err := iterateRows(NewReader(resp.Body, 1024*1024*10), func(reader *IonReader, _ int) error {
+		for reader.Next() {
+			value, err := reader.ReadValue()
+			if err != nil {
+				return err
+			}
+			if value != nil {
+				values = append(values, value)
+			}
+		}
+		return reader.Error()
+	})
+	if err != nil {
+		return nil, 500, err
+	}
+	if status.Error != "" {
+		return nil, 500, &snellerExecutionError{Message: status.Error}
+	}
+
+	d.cacheLookup(key, values)
+
+	return values, 0, nil
+}
+
+// snellerColumnFromDatashape converts the statistics of a single field returned by
+// SNELLER_DATASHAPE to a snellerColumn, using the same rules as analyzeRow.
+func snellerColumnFromDatashape(name string, shape map[string]any, total int64) *snellerColumn {
+	col := &snellerColumn{
+		Index: -1,
+		Name:  name,
+		Typ:   snellerTypeNull,
+	}
+
+	var count int64
+	for _, typ := range []struct {
+		name string
+		typ  snellerColumnType
+	}{
+		{"null", snellerTypeNull},
+		{"bool", snellerTypeBool},
+		{"int", snellerTypeNumber},
+		{"float", snellerTypeNumber},
+		{"timestamp", snellerTypeTimestamp},
+		{"string", snellerTypeString},
+		{"struct", snellerTypeStruct},
+		{"list", snellerTypeList},
+		{"decimal", snellerTypeDecimal},
+		{"blob", snellerTypeUnknown},
+		{"clob", snellerTypeUnknown},
+		{"sexp", snellerTypeUnknown},
+	} {
+		n := datashapeInt(shape[typ.name])
+		if n == 0 {
+			continue
+		}
+		count += n
+
+		if typ.typ == snellerTypeNull {
+			col.Nullable = true
+		} else if col.Typ == snellerTypeNull {
+			col.Typ = typ.typ
+		} else if col.Typ != typ.typ {
+			col.Typ = snellerTypeUnknown
+		}
+	}
+
+	if datashapeInt(shape["float"]) != 0 {
+		col.Floating = true
+		col.Signed = true
+	}
+	if datashapeInt(shape["int-min-value"]) < 0 {
+		col.Signed = true
+	}
+
+	col.Count = int(count)
+	col.Optional = count < total
+
+	return col
+}
+
+// datashapeInt converts a numeric SNELLER_DATASHAPE value to an int64.
+func datashapeInt(value any) int64 {
+	switch v := value.(type) {
+	case int64:
+		return v
+	case uint64:
+		return int64(v)
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+// newRequest creates a new HTTP request and initializes the authentication header from the
+// configured credentials, according to the configured auth scheme.
 func (d *Datasource) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
-	req, err := http.NewRequestWithContext(ctx, method, d.endpoint+path, body)
+	req, err := http.NewRequestWithContext(ctx, method, d.endpoint+d.pathPrefix+path, body)
 	if err != nil {
 		return nil, err
 	}
 
-	if token, ok := d.settings.DecryptedSecureJSONData["token"]; ok {
-		req.Header.Set("Authorization", "Bearer "+token)
+	secrets := d.settings.DecryptedSecureJSONData
+	switch d.auth.Scheme {
+	case snellerAuthBasic:
+		username, hasUsername := secrets["username"]
+		password, hasPassword := secrets["password"]
+		if hasUsername || hasPassword {
+			req.SetBasicAuth(username, password)
+		}
+	case snellerAuthCustom:
+		if token, ok := secrets["token"]; ok {
+			req.Header.Set(d.auth.Header, token)
+		}
+	default:
+		if token, ok := secrets["token"]; ok {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
 	}
 
 	return req, nil
 }
 
 // executeRequest performs an HTTP request and returns the response and/or an error with the
-// message from the response body (if any).
+// message from the response body (if any). Transient failures are retried (see retryable).
 func (d *Datasource) executeRequest(ctx context.Context, method, path string, body io.Reader, headers, args map[string]string) (*http.Response, error) {
-	req, err := d.newRequest(ctx, method, path, body)
-	if err != nil {
-		return nil, err
+	// The body is buffered to send it again on retries
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	if len(args) > 0 {
-		q := req.URL.Query()
-		for k, v := range args {
-			q.Set(k, v)
+	var resp *http.Response
+	for attempt := 0; ; attempt++ {
+		var reqBody io.Reader
+		if payload != nil {
+			reqBody = bytes.NewReader(payload)
+		}
+
+		req, err := d.newRequest(ctx, method, path, reqBody)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(args) > 0 {
+			q := req.URL.Query()
+			for k, v := range args {
+				q.Set(k, v)
+			}
+			req.URL.RawQuery = q.Encode()
+		}
+
+		if headers != nil {
+			for k, v := range headers {
+				req.Header.Set(k, v)
+			}
 		}
-		req.URL.RawQuery = q.Encode()
-	}
 
-	if headers != nil {
-		for k, v := range headers {
-			req.Header.Set(k, v)
+		resp, err = d.client.Do(req)
+		if attempt >= d.maxRetries || retryDisabled(ctx) || !retryable(ctx, resp, err) {
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+
+		if resp != nil {
+			log.DefaultLogger.Warn("retrying request", "path", path, "status", resp.StatusCode, "attempt", attempt+1)
+			_, _ = io.Copy(io.Discard, resp.Body)
+			if err := resp.Body.Close(); err != nil {
+				log.DefaultLogger.Error("failed to close response body", "err", err)
+			}
+		} else {
+			log.DefaultLogger.Warn("retrying request", "path", path, "err", err, "attempt", attempt+1)
+		}
+
+		timer := time.NewTimer(retryBackoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
 		}
 	}
 
-	resp, err := d.client.Do(req)
-	if err != nil {
-		return nil, err
+	// The transport requests and decompresses gzip responses, unless the 'Accept-Encoding' header
+	// has been set explicitly (e.g. by the custom HTTP headers of the data source settings)
+	if !resp.Uncompressed && strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		body, err := newGzipBody(resp.Body)
+		if err != nil {
+			if err := resp.Body.Close(); err != nil {
+				log.DefaultLogger.Error("failed to close response body", "err", err)
+			}
+			return nil, fmt.Errorf("gzip response: %w", err)
+		}
+		resp.Body = body
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
@@ -195,7 +555,7 @@ func (d *Datasource) executeRequest(ctx context.Context, method, path string, bo
 
 		b, err := io.ReadAll(resp.Body)
 		if err == nil && len(b) > 0 {
-			return resp, errors.New(string(b))
+			return resp, parseSnellerError(b)
 		}
 
 		return resp, fmt.Errorf("HTTP status %d", resp.StatusCode)
@@ -203,3 +563,139 @@ func (d *Datasource) executeRequest(ctx context.Context, method, path string, bo
 
 	return resp, nil
 }
+
+// gzipBody decompresses a gzip response body.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func newGzipBody(body io.ReadCloser) (*gzipBody, error) {
+	reader, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, err
+	}
+	return &gzipBody{Reader: reader, body: body}, nil
+}
+
+// Close closes the decompressor and the underlying response body.
+func (b *gzipBody) Close() error {
+	err := b.Reader.Close()
+	if closeErr := b.body.Close(); closeErr != nil {
+		return closeErr
+	}
+	return err
+}
+
+// defaultMaxRetries is the number of retries, if no number is configured.
+const defaultMaxRetries = 3
+
+// The delays between retries are variables, so that tests can shorten or extend them.
+var (
+	// retryBaseDelay is the delay before the first retry, which doubles with every retry.
+	retryBaseDelay = 250 * time.Millisecond
+	// retryMaxDelay is the upper bound of the delay between retries.
+	retryMaxDelay = 10 * time.Second
+)
+
+// retryable returns true for connection errors and responses indicating that the endpoint is
+// temporarily unavailable (e.g. during scale-up). Cancellations and timeouts are not retried.
+func retryable(ctx context.Context, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return false
+		}
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryBackoff returns the delay before the given retry attempt (starting at 0). The delay grows
+// exponentially and is randomized ("full jitter") to avoid retrying in lockstep with other
+// clients.
+func retryBackoff(attempt int) time.Duration {
+	delay := retryBaseDelay << attempt
+	if attempt >= 16 || delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay)) + 1)
+}
+
+// snellerError is an error returned by the Sneller query endpoint. Errors caused by invalid SQL
+// might contain the position of the offending part of the query. Line and column numbers start
+// at 1 and are 0 if unknown.
+type snellerError struct {
+	Message  string `json:"message"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Position *int   `json:"position,omitempty"`
+}
+
+func (e *snellerError) Error() string {
+	return e.Message
+}
+
+// hasPosition reports whether the error contains position information.
+func (e *snellerError) hasPosition() bool {
+	return e.Line > 0 || e.Position != nil
+}
+
+var (
+	regexErrorLineColumn = regexp.MustCompile(`\bat (\d+):(\d+): `)
+	regexErrorPosition   = regexp.MustCompile(`\bat position (\d+): `)
+	// regexSQLError matches error messages caused by invalid queries rather than backend failures
+	regexSQLError = regexp.MustCompile(`(?i)\b(syntax error|parse error|unexpected token|unknown (column|function|table|database)|undefined (column|function|identifier)|type error|invalid (argument|cast|type))\b`)
+)
+
+// isSQLError reports whether the given error message describes a mistake in the query (e.g. a
+// syntax error or an unknown function), which the user has to fix.
+func isSQLError(message string) bool {
+	return regexErrorLineColumn.MatchString(message) || regexErrorPosition.MatchString(message) ||
+		regexSQLError.MatchString(message)
+}
+
+// parseSnellerError parses an error response body. Both, JSON error envelopes and plain text
+// error messages are supported.
+func parseSnellerError(body []byte) *snellerError {
+	var envelope struct {
+		Error    string `json:"error"`
+		Message  string `json:"message"`
+		Line     int    `json:"line"`
+		Column   int    `json:"column"`
+		Position *int   `json:"position"`
+	}
+	if json.Unmarshal(body, &envelope) == nil && (envelope.Error != "" || envelope.Message != "") {
+		message := envelope.Error
+		if message == "" {
+			message = envelope.Message
+		}
+		return &snellerError{
+			Message:  message,
+			Line:     envelope.Line,
+			Column:   envelope.Column,
+			Position: envelope.Position,
+		}
+	}
+
+	result := &snellerError{
+		Message: strings.TrimSpace(string(body)),
+	}
+
+	if m := regexErrorLineColumn.FindStringSubmatch(result.Message); m != nil {
+		result.Line, _ = strconv.Atoi(m[1])
+		result.Column, _ = strconv.Atoi(m[2])
+	} else if m := regexErrorPosition.FindStringSubmatch(result.Message); m != nil {
+		position, _ := strconv.Atoi(m[1])
+		result.Position = &position
+	}
+
+	return result
+}
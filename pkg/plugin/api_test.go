@@ -0,0 +1,256 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExecuteQueryDatabaseArg(t *testing.T) {
+	for _, method := range []string{http.MethodPost, http.MethodGet} {
+		var args url.Values
+		ds := newTestDatasource(t, map[string]any{"QueryMethod": method}, func(w http.ResponseWriter, r *http.Request) {
+			args = r.URL.Query()
+			_, _ = w.Write(encodeResult(nil, nil))
+		})
+
+		for _, database := range []string{"", "logs"} {
+			resp, err := ds.executeQuery(context.Background(), database, "SELECT 1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+
+			value, ok := args["database"]
+			if database == "" && ok {
+				t.Errorf("%s: expected no database argument, got %v", method, value)
+			}
+			if database != "" && (len(value) != 1 || value[0] != database) {
+				t.Errorf("%s: expected database argument '%s', got %v", method, database, value)
+			}
+		}
+	}
+}
+
+func TestExecuteQueryCancel(t *testing.T) {
+	canceled := make(chan struct{})
+	ds := newTestDatasource(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		// Block until the client goes away, which is only detected after reading the body
+		_, _ = io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+		close(canceled)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := ds.executeQuery(ctx, "", "SELECT 1")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the query to return promptly, took %s", elapsed)
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the request to be canceled on the server")
+	}
+}
+
+// requestRecorder records the bodies of the requests received by a test server.
+type requestRecorder struct {
+	mu     sync.Mutex
+	bodies []string
+}
+
+// record records the body of the given request and returns the number of requests so far.
+func (r *requestRecorder) record(req *http.Request) int {
+	b, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bodies = append(r.bodies, string(b))
+	return len(r.bodies)
+}
+
+// requests returns the bodies of the recorded requests.
+func (r *requestRecorder) requests() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.bodies...)
+}
+
+// setRetryDelays sets the delays between retries for the duration of the test.
+func setRetryDelays(t *testing.T, base, max time.Duration) {
+	baseDelay, maxDelay := retryBaseDelay, retryMaxDelay
+	retryBaseDelay, retryMaxDelay = base, max
+	t.Cleanup(func() { retryBaseDelay, retryMaxDelay = baseDelay, maxDelay })
+}
+
+func TestExecuteQueryRetries(t *testing.T) {
+	setRetryDelays(t, time.Millisecond, time.Millisecond)
+
+	for _, test := range []struct {
+		name     string
+		statuses []int // The status of each attempt, the last one is repeated
+		attempts int
+		ok       bool
+	}{
+		{"BadGateway", []int{http.StatusBadGateway}, 3, false},
+		{"ServiceUnavailable", []int{http.StatusServiceUnavailable}, 3, false},
+		{"GatewayTimeout", []int{http.StatusGatewayTimeout}, 3, false},
+		{"Recovered", []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK}, 3, true},
+		{"InternalServerError", []int{http.StatusInternalServerError}, 1, false},
+		{"BadRequest", []int{http.StatusBadRequest}, 1, false},
+		{"NotFound", []int{http.StatusNotFound}, 1, false},
+		{"OK", []int{http.StatusOK}, 1, true},
+	} {
+		var recorder requestRecorder
+		ds := newTestDatasource(t, map[string]any{"MaxRetries": 2}, func(w http.ResponseWriter, r *http.Request) {
+			attempt := recorder.record(r)
+			status := test.statuses[minInt(attempt, len(test.statuses))-1]
+			w.WriteHeader(status)
+			if status == http.StatusOK {
+				_, _ = w.Write(encodeResult(nil, nil))
+			}
+		})
+
+		resp, err := ds.executeQuery(context.Background(), "", "SELECT 1")
+		if test.ok && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+
+		bodies := recorder.requests()
+		if len(bodies) != test.attempts {
+			t.Errorf("%s: expected %d attempts, got %d", test.name, test.attempts, len(bodies))
+		}
+		// The body is sent again with every retry
+		for i, body := range bodies {
+			if body != "SELECT 1" {
+				t.Errorf("%s: attempt %d: expected the query as body, got %q", test.name, i, body)
+			}
+		}
+	}
+}
+
+func TestExecuteQueryRetriesConnectionErrors(t *testing.T) {
+	setRetryDelays(t, time.Millisecond, time.Millisecond)
+
+	for _, test := range []struct {
+		failures int
+		attempts int
+		ok       bool
+	}{
+		{failures: 2, attempts: 3, ok: true},
+		{failures: 5, attempts: 4, ok: false},
+	} {
+		var recorder requestRecorder
+		ds := newTestDatasource(t, nil, func(w http.ResponseWriter, r *http.Request) {
+			if recorder.record(r) <= test.failures {
+				// Drop the connection without a response
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err == nil {
+					_ = conn.Close()
+				}
+				return
+			}
+			_, _ = w.Write(encodeResult(nil, nil))
+		})
+
+		resp, err := ds.executeQuery(context.Background(), "", "SELECT 1")
+		if test.ok && err != nil {
+			t.Errorf("%d failures: %s", test.failures, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%d failures: expected an error", test.failures)
+		}
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+
+		// The default number of retries applies
+		bodies := recorder.requests()
+		if len(bodies) != test.attempts {
+			t.Errorf("%d failures: expected %d attempts, got %d", test.failures, test.attempts, len(bodies))
+		}
+		for i, body := range bodies {
+			if body != "SELECT 1" {
+				t.Errorf("%d failures: attempt %d: expected the query as body, got %q", test.failures, i, body)
+			}
+		}
+	}
+}
+
+func TestExecuteQueryNoRetry(t *testing.T) {
+	setRetryDelays(t, time.Millisecond, time.Millisecond)
+
+	var recorder requestRecorder
+	ds := newTestDatasource(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		recorder.record(r)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	if _, err := ds.executeQuery(withNoRetry(context.Background()), "", "SELECT 1"); err == nil {
+		t.Error("expected an error")
+	}
+	if attempts := len(recorder.requests()); attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts)
+	}
+}
+
+func TestExecuteQueryCancelBackoff(t *testing.T) {
+	// The delay before the retry exceeds the test timeout
+	setRetryDelays(t, time.Hour, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var recorder requestRecorder
+	ds := newTestDatasource(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		recorder.record(r)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		time.AfterFunc(100*time.Millisecond, cancel)
+	})
+
+	start := time.Now()
+	_, err := ds.executeQuery(ctx, "", "SELECT 1")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the backoff to stop promptly, took %s", elapsed)
+	}
+	if attempts := len(recorder.requests()); attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	for attempt := 0; attempt < 40; attempt++ {
+		limit := retryMaxDelay
+		if attempt < 6 {
+			limit = retryBaseDelay << attempt
+		}
+		for i := 0; i < 100; i++ {
+			if delay := retryBackoff(attempt); delay <= 0 || delay > limit {
+				t.Fatalf("attempt %d: expected a delay in (0, %s], got %s", attempt, limit, delay)
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package plugin
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lookupCache is a concurrency-safe, size-bounded cache of lookup results. Entries expire after
+// their TTL, if any. If the cache is full, the least recently used entry is evicted.
+type lookupCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	order      *list.List // Most recently used entries first
+}
+
+type lookupCacheEntry struct {
+	key     string
+	value   any
+	expires time.Time // Zero for entries without a TTL
+}
+
+// newLookupCache creates a new, empty cache containing up to maxEntries entries.
+func newLookupCache(maxEntries int) *lookupCache {
+	return &lookupCache{
+		maxEntries: maxEntries,
+		entries:    map[string]*list.Element{},
+		order:      list.New(),
+	}
+}
+
+// Get returns the value for the given key, if it is cached and not expired.
+func (c *lookupCache) Get(key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*lookupCacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.remove(element)
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return entry.value, true
+}
+
+// Set caches the value for the given key for the given duration and evicts the least recently
+// used entries, if the cache is full. Values with a non-positive TTL do not expire.
+func (c *lookupCache) Set(key string, value any, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &lookupCacheEntry{
+		key:   key,
+		value: value,
+	}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+	for len(c.entries) > c.maxEntries {
+		c.remove(c.order.Back())
+	}
+}
+
+// Delete removes the value for the given key.
+func (c *lookupCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+}
+
+// Flush removes all entries.
+func (c *lookupCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+}
+
+func (c *lookupCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*lookupCacheEntry).key)
+}
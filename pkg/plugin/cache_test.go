@@ -0,0 +1,94 @@
+package plugin
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestLookupCacheEviction(t *testing.T) {
+	cache := newLookupCache(3)
+	for i := 0; i < 5; i++ {
+		cache.Set(fmt.Sprint(i), i, time.Minute)
+	}
+
+	for i := 0; i < 5; i++ {
+		value, ok := cache.Get(fmt.Sprint(i))
+		if expected := i >= 2; ok != expected {
+			t.Errorf("%d: expected cached %v, got %v", i, expected, ok)
+		}
+		if ok && value != i {
+			t.Errorf("%d: expected value %d, got %v", i, i, value)
+		}
+	}
+}
+
+func TestLookupCacheLeastRecentlyUsed(t *testing.T) {
+	cache := newLookupCache(2)
+	cache.Set("a", 1, time.Minute)
+	cache.Set("b", 2, time.Minute)
+	cache.Get("a")
+	cache.Set("c", 3, time.Minute)
+
+	for key, expected := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := cache.Get(key); ok != expected {
+			t.Errorf("%s: expected cached %v, got %v", key, expected, ok)
+		}
+	}
+}
+
+func TestLookupCacheExpiry(t *testing.T) {
+	cache := newLookupCache(2)
+	cache.Set("expired", 1, time.Nanosecond)
+	cache.Set("permanent", 2, 0)
+	time.Sleep(time.Millisecond)
+
+	if _, ok := cache.Get("expired"); ok {
+		t.Error("expected the expired entry to be gone")
+	}
+	if _, ok := cache.Get("permanent"); !ok {
+		t.Error("expected the entry without TTL to be cached")
+	}
+}
+
+func TestLookupCacheConcurrency(t *testing.T) {
+	cache := newLookupCache(10)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				key := fmt.Sprint(j % 20)
+				cache.Set(key, i, time.Minute)
+				cache.Get(key)
+				if j%100 == 0 {
+					cache.Delete(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if len(cache.entries) > 10 || cache.order.Len() != len(cache.entries) {
+		t.Errorf("expected at most 10 consistent entries, got %d entries and %d list elements", len(cache.entries), cache.order.Len())
+	}
+}
+
+func TestMaxCacheEntriesSetting(t *testing.T) {
+	ds := newTestDatasource(t, map[string]any{"MaxCacheEntries": 2}, nil)
+	if ds.cache.maxEntries != 2 {
+		t.Errorf("expected 2 max cache entries, got %d", ds.cache.maxEntries)
+	}
+
+	_, err := NewDatasource(backend.DataSourceInstanceSettings{JSONData: []byte(`{"MaxCacheEntries": 0}`)})
+	if err == nil {
+		t.Error("expected an error for 0 max cache entries")
+	}
+}
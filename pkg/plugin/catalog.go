@@ -0,0 +1,197 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/SnellerInc/sneller/ion"
+)
+
+// SymbolCatalog is a concurrency-safe collection of shared symbol tables. Local symbol tables
+// can import shared symbol tables by name and version, in which case the imported symbols
+// precede the local symbols.
+type SymbolCatalog struct {
+	mu     sync.RWMutex
+	tables map[string]map[int][]string
+}
+
+// NewSymbolCatalog creates a new, empty symbol table catalog.
+func NewSymbolCatalog() *SymbolCatalog {
+	return &SymbolCatalog{
+		tables: map[string]map[int][]string{},
+	}
+}
+
+// Add adds a shared symbol table with the given name and version to the catalog.
+func (c *SymbolCatalog) Add(name string, version int, symbols []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	versions, ok := c.tables[name]
+	if !ok {
+		versions = map[int][]string{}
+		c.tables[name] = versions
+	}
+	versions[version] = symbols
+}
+
+// lookup returns the symbols of the shared symbol table with the given name and version. If the
+// exact version is not available, the highest available version is returned instead.
+func (c *SymbolCatalog) lookup(name string, version int) ([]string, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	versions, ok := c.tables[name]
+	if !ok {
+		return nil, false
+	}
+	if symbols, ok := versions[version]; ok {
+		return symbols, true
+	}
+
+	best := -1
+	for v := range versions {
+		if v > best {
+			best = v
+		}
+	}
+	return versions[best], best != -1
+}
+
+// symtabImport is a single entry of the 'imports' list of a local symbol table.
+type symtabImport struct {
+	name    string
+	version int
+	maxID   int // -1 if not specified
+}
+
+// isSymtabAppend returns true, if the given symbol table annotation appends its symbols to the
+// current symbol table. Only the first field is checked for 'imports: $ion_symbol_table', as
+// Sneller always writes it first.
+func isSymtabAppend(buf []byte) bool {
+	_, body, _, err := ion.ReadAnnotation(buf)
+	if err != nil || ion.TypeOf(body) != ion.StructType {
+		return false
+	}
+
+	fields, _ := ion.Contents(body)
+	sym, fields, err := ion.ReadLabel(fields)
+	if err != nil || sym != ion.SystemSymImports || ion.TypeOf(fields) != ion.SymbolType {
+		return false
+	}
+	imports, _, err := ion.ReadSymbol(fields)
+	return err == nil && imports == ion.SystemSymSymbolTable
+}
+
+// readSymtabImports returns the shared symbol table imports of the given symbol table
+// annotation. Returns nil, if the symbol table does not import any shared symbol tables.
+func readSymtabImports(buf []byte) ([]symtabImport, error) {
+	_, body, _, err := ion.ReadAnnotation(buf)
+	if err != nil {
+		return nil, err
+	}
+	if ion.TypeOf(body) != ion.StructType {
+		return nil, nil
+	}
+
+	fields, _ := ion.Contents(body)
+	for len(fields) > 0 {
+		var sym ion.Symbol
+		sym, fields, err = ion.ReadLabel(fields)
+		if err != nil {
+			return nil, err
+		}
+		size := ion.SizeOf(fields)
+		if size <= 0 || size > len(fields) {
+			return nil, errors.New("invalid symbol table field")
+		}
+		if sym == ion.SystemSymImports && ion.TypeOf(fields) == ion.ListType {
+			return readSymtabImportList(fields[:size])
+		}
+		fields = fields[size:]
+	}
+
+	return nil, nil
+}
+
+func readSymtabImportList(buf []byte) ([]symtabImport, error) {
+	var result []symtabImport
+
+	items, _ := ion.Contents(buf)
+	for len(items) > 0 {
+		size := ion.SizeOf(items)
+		if size <= 0 || size > len(items) {
+			return nil, errors.New("invalid symbol table import")
+		}
+		item := items[:size]
+		items = items[size:]
+
+		if ion.TypeOf(item) != ion.StructType {
+			continue
+		}
+
+		imp := symtabImport{version: 1, maxID: -1}
+		fields, _ := ion.Contents(item)
+		for len(fields) > 0 {
+			sym, rest, err := ion.ReadLabel(fields)
+			if err != nil {
+				return nil, err
+			}
+			switch ion.TypeOf(rest) {
+			case ion.StringType:
+				if sym == ion.Symbol(ion.MinimumID("name")) {
+					imp.name, _, err = ion.ReadString(rest)
+				}
+			case ion.UintType, ion.IntType:
+				var value int64
+				value, _, err = ion.ReadInt(rest)
+				switch sym {
+				case ion.Symbol(ion.MinimumID("version")):
+					imp.version = int(value)
+				case ion.Symbol(ion.MinimumID("max_id")):
+					imp.maxID = int(value)
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+			size := ion.SizeOf(rest)
+			if size <= 0 || size > len(rest) {
+				return nil, errors.New("invalid symbol table import field")
+			}
+			fields = rest[size:]
+		}
+
+		// Imports without a name are ignored
+		if imp.name != "" {
+			result = append(result, imp)
+		}
+	}
+
+	return result, nil
+}
+
+// resolveSymtabImports resolves the given imports using the catalog. Symbols of shared symbol
+// tables that are not available in the catalog are reserved with an empty text, as long as the
+// import specifies the number of symbols.
+func resolveSymtabImports(catalog *SymbolCatalog, imports []symtabImport) ([]string, error) {
+	var result []string
+	for _, imp := range imports {
+		symbols, ok := catalog.lookup(imp.name, imp.version)
+		if !ok && imp.maxID < 0 {
+			return nil, fmt.Errorf("unresolved shared symbol table import '%s' (version %d)", imp.name, imp.version)
+		}
+		if imp.maxID >= 0 && len(symbols) != imp.maxID {
+			padded := make([]string, imp.maxID)
+			copy(padded, symbols)
+			symbols = padded
+		}
+		result = append(result, symbols...)
+	}
+	return result, nil
+}
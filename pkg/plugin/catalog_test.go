@@ -0,0 +1,80 @@
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/SnellerInc/sneller/ion"
+)
+
+// readSharedSymtabFixture reads the rows of the shared symbol table fixture as 'name=value'
+// pairs. Its symbol table imports 'host' and 'status' from the shared symbol table 'logs'.
+func readSharedSymtabFixture(t *testing.T, catalog *SymbolCatalog) ([]string, error) {
+	t.Helper()
+
+	f, err := os.Open("testdata/shared_symtab.ion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var rows []string
+	reader := NewReader(f, 1024)
+	reader.UseCatalog(catalog)
+	_, err = iterateRows(reader, func(reader *IonReader, _ int) error {
+		var fields []string
+		for reader.Next() {
+			name, err := reader.FieldName()
+			if err != nil {
+				return err
+			}
+			var value any
+			if reader.Type() == ion.StringType {
+				value, err = reader.ReadString()
+			} else {
+				value, err = reader.ReadInt()
+			}
+			if err != nil {
+				return err
+			}
+			fields = append(fields, fmt.Sprintf("%s=%v", name, value))
+		}
+		rows = append(rows, strings.Join(fields, " "))
+		return reader.Error()
+	})
+	return rows, err
+}
+
+func TestSharedSymtabImports(t *testing.T) {
+	catalog := NewSymbolCatalog()
+	catalog.Add("logs", 1, []string{"host", "status"})
+
+	rows, err := readSharedSymtabFixture(t, catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"host=a status=200 level=info",
+		"host=b status=500 level=error",
+	}
+	if fmt.Sprint(rows) != fmt.Sprint(expected) {
+		t.Errorf("expected rows %v, got %v", expected, rows)
+	}
+}
+
+func TestSharedSymtabImportsWithoutCatalog(t *testing.T) {
+	// The import declares its 'max_id', so the local symbols are still resolved correctly
+	rows, err := readSharedSymtabFixture(t, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"=a =200 level=info",
+		"=b =500 level=error",
+	}
+	if fmt.Sprint(rows) != fmt.Sprint(expected) {
+		t.Errorf("expected rows %v, got %v", expected, rows)
+	}
+}
@@ -1,16 +1,21 @@
 package plugin
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
+	"net/url"
+	"regexp"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/SnellerInc/sneller/ion"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
@@ -18,9 +23,10 @@ import (
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
-	cache "github.com/patrickmn/go-cache"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 )
 
 // Make sure Datasource implements required interfaces. This is important to do
@@ -32,6 +38,7 @@ var (
 	_ backend.QueryDataHandler      = (*Datasource)(nil)
 	_ backend.CheckHealthHandler    = (*Datasource)(nil)
 	_ backend.CallResourceHandler   = (*Datasource)(nil)
+	_ backend.StreamHandler         = (*Datasource)(nil)
 	_ instancemgmt.InstanceDisposer = (*Datasource)(nil)
 )
 
@@ -43,12 +50,79 @@ func NewDatasource(settings backend.DataSourceInstanceSettings) (instancemgmt.In
 		return nil, fmt.Errorf("json unmarshal: %w", err)
 	}
 
+	queryEndpoint, err := newSnellerQueryEndpoint(jsonData)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := newSnellerAuth(jsonData)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultLimits := maps.Clone(snellerDefaultLimits)
+	for panelType, limit := range jsonData.DefaultLimits {
+		if limit < 0 {
+			return nil, fmt.Errorf("invalid default limit %d for panel type '%s'", limit, panelType)
+		}
+		defaultLimits[panelType] = limit
+	}
+
+	for name := range jsonData.QueryTemplates {
+		if !regexTemplateName.MatchString(name) {
+			return nil, fmt.Errorf("invalid query template name '%s'", name)
+		}
+	}
+
 	opts, err := settings.HTTPClientOptions()
 	if err != nil {
 		return nil, fmt.Errorf("http client options: %w", err)
 	}
 
-	opts.Timeouts.Timeout = 10 * time.Minute
+	opts.Timeouts.Timeout, err = parseTimeout(jsonData.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	maxRetries := defaultMaxRetries
+	if jsonData.MaxRetries != nil {
+		maxRetries = *jsonData.MaxRetries
+	}
+	if maxRetries < 0 {
+		return nil, fmt.Errorf("invalid max retries %d: expected a non-negative number", maxRetries)
+	}
+
+	maxRows := defaultMaxRows
+	if jsonData.MaxRows != nil {
+		maxRows = *jsonData.MaxRows
+	}
+	if maxRows < 0 {
+		return nil, fmt.Errorf("invalid max rows %d: expected a non-negative number", maxRows)
+	}
+
+	maxConcurrentQueries := defaultMaxConcurrentQueries
+	if jsonData.MaxConcurrentQueries != nil {
+		maxConcurrentQueries = *jsonData.MaxConcurrentQueries
+	}
+	if maxConcurrentQueries < 0 {
+		return nil, fmt.Errorf("invalid max concurrent queries %d: expected a non-negative number", maxConcurrentQueries)
+	}
+
+	maxCacheEntries := defaultMaxCacheEntries
+	if jsonData.MaxCacheEntries != nil {
+		maxCacheEntries = *jsonData.MaxCacheEntries
+	}
+	if maxCacheEntries <= 0 {
+		return nil, fmt.Errorf("invalid max cache entries %d: expected a positive number", maxCacheEntries)
+	}
+
+	cacheTTL := defaultCacheTTL
+	if jsonData.CacheTTL != nil {
+		if *jsonData.CacheTTL < 0 {
+			return nil, fmt.Errorf("invalid cache TTL %v: expected a non-negative number of seconds", *jsonData.CacheTTL)
+		}
+		cacheTTL = time.Duration(*jsonData.CacheTTL * float64(time.Second))
+	}
 
 	client, err := httpclient.New(opts)
 	if err != nil {
@@ -56,14 +130,33 @@ func NewDatasource(settings backend.DataSourceInstanceSettings) (instancemgmt.In
 	}
 
 	ds := Datasource{
-		settings: settings,
-		endpoint: jsonData.Endpoint,
-		client:   client,
-		cache:    cache.New(5*time.Minute, 5*time.Minute),
+		settings:      settings,
+		region:        jsonData.Region,
+		endpoint:      strings.TrimRight(jsonData.Endpoint, "/"),
+		pathPrefix:    normalizePathPrefix(jsonData.PathPrefix),
+		queryEndpoint: queryEndpoint,
+		auth:          auth,
+		database:      strings.TrimSpace(jsonData.DefaultDatabase),
+		maxScanBytes:  jsonData.MaxScanBytes,
+		templates:     jsonData.QueryTemplates,
+		defaultLimits: defaultLimits,
+		maxRetries:    maxRetries,
+		maxRows:       maxRows,
+		cacheTTL:      cacheTTL,
+		client:        client,
+		cache:         newLookupCache(maxCacheEntries),
+		inflight:      newInflightQueries(),
+	}
+
+	if jsonData.SymbolTableCache {
+		ds.symtabs = NewSymtabCache()
+	}
+	if maxConcurrentQueries > 0 {
+		ds.querySlots = make(chan struct{}, maxConcurrentQueries)
 	}
 
 	mux := datasource.NewQueryTypeMux()
-	//mux.HandleFunc("logs", ds.handleQuery)
+	mux.HandleFunc(snellerQueryTypeLogs, ds.handleQuery)
 	//mux.HandleFunc("traces", ds.handleQuery)
 	mux.HandleFunc("", ds.handleQuery)
 	ds.handler = mux
@@ -71,23 +164,133 @@ func NewDatasource(settings backend.DataSourceInstanceSettings) (instancemgmt.In
 	return &ds, nil
 }
 
+// defaultTimeout is the HTTP request timeout used, if no timeout is configured.
+const defaultTimeout = 10 * time.Minute
+
+// defaultCacheTTL is the duration lookups are cached for, if no TTL is configured.
+const defaultCacheTTL = time.Minute
+
+// defaultMaxCacheEntries is the maximum number of cached lookups, if no limit is configured.
+const defaultMaxCacheEntries = 1000
+
+// defaultMaxConcurrentQueries is the maximum number of concurrent queries, if no limit is
+// configured.
+const defaultMaxConcurrentQueries = 10
+
+// defaultMaxRows is the maximum number of rows returned by a query, if no limit is configured.
+const defaultMaxRows = 1000000
+
+// normalizePathPrefix returns the given path prefix with a leading and without a trailing slash,
+// or an empty string if no prefix is configured.
+func normalizePathPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// parseTimeout parses the configured timeout in seconds. Returns the default timeout, if the
+// timeout is not set or zero.
+func parseTimeout(raw json.RawMessage) (time.Duration, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return defaultTimeout, nil
+	}
+
+	var seconds float64
+	err := json.Unmarshal(raw, &seconds)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid timeout %s: expected a non-negative number of seconds", raw)
+	}
+	if seconds == 0 {
+		return defaultTimeout, nil
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
 // Datasource is an example datasource which can respond to data queries, reports
 // its health and has streaming skills.
 type Datasource struct {
-	settings backend.DataSourceInstanceSettings
-	handler  backend.QueryDataHandler
-	endpoint string
-	client   *http.Client
-	cache    *cache.Cache
+	settings      backend.DataSourceInstanceSettings
+	handler       backend.QueryDataHandler
+	region        string
+	endpoint      string
+	pathPrefix    string
+	queryEndpoint snellerQueryEndpoint
+	auth          snellerAuth
+	database      string
+	maxScanBytes  int64
+	templates     map[string]snellerQueryTemplate
+	defaultLimits map[string]int64
+	maxRetries    int
+	maxRows       int
+	cacheTTL      time.Duration
+	client        *http.Client
+	cache         *lookupCache
+	symtabs       *SymtabCache
+	inflight      *inflightQueries
+	querySlots    chan struct{} // Limits the number of concurrent queries, nil if unlimited
 }
 
 // Dispose here tells plugin SDK that plugin wants to clean up resources when a new instance
 // created. As soon as datasource settings change detected by SDK old datasource instance will
 // be disposed and a new one will be created using NewSampleDatasource factory function.
 func (d *Datasource) Dispose() {
+	d.inflight.cancelAll()
+	d.cache.Flush()
 	d.client.CloseIdleConnections()
 }
 
+// inflightQueries tracks the cancel functions of all in-flight queries of a datasource instance.
+type inflightQueries struct {
+	mu       sync.Mutex
+	cancels  map[*context.CancelFunc]struct{}
+	disposed bool
+}
+
+func newInflightQueries() *inflightQueries {
+	return &inflightQueries{
+		cancels: map[*context.CancelFunc]struct{}{},
+	}
+}
+
+// track derives a context that is cancelled when all in-flight queries get cancelled. The
+// returned function must be called after the query completed.
+func (q *inflightQueries) track(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.disposed {
+		cancel()
+		return ctx, func() {}
+	}
+
+	key := &cancel
+	q.cancels[key] = struct{}{}
+
+	return ctx, func() {
+		q.mu.Lock()
+		delete(q.cancels, key)
+		q.mu.Unlock()
+		cancel()
+	}
+}
+
+// cancelAll cancels all in-flight queries, as well as all queries started afterwards.
+func (q *inflightQueries) cancelAll() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.disposed = true
+	for cancel := range q.cancels {
+		(*cancel)()
+	}
+	q.cancels = map[*context.CancelFunc]struct{}{}
+}
+
 // QueryData handles multiple queries and returns multiple responses.
 // req contains the queries []DataQuery (where each query contains RefID as a unique identifier).
 // The QueryDataResponse contains a map of RefID to the response for each query, and each response
@@ -104,16 +307,16 @@ func (d *Datasource) QueryData(ctx context.Context, req *backend.QueryDataReques
 // datasource configuration page which allows users to verify that
 // a datasource is working as expected.
 func (d *Datasource) CheckHealth(ctx context.Context, _ *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
-	req, err := d.newRequest(ctx, http.MethodPost, "/executeQuery", strings.NewReader("SELECT 1+2"))
-	if err != nil {
-		return nil, err
-	}
-
-	resp, err := d.client.Do(req)
+	// The connectivity check uses the configured query endpoint and the retries of regular queries
+	resp, err := d.executeQuery(ctx, "", "SELECT 1+2")
 	if err != nil {
+		message := fmt.Sprintf("HTTP request: %s", err)
+		if resp != nil {
+			message = fmt.Sprintf("HTTP error %d: %s - %s", resp.StatusCode, err, resp.Request.URL.Redacted())
+		}
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
-			Message: fmt.Sprintf("HTTP request: %s", err),
+			Message: message,
 		}, nil
 	}
 	defer func() {
@@ -122,29 +325,47 @@ func (d *Datasource) CheckHealth(ctx context.Context, _ *backend.CheckHealthRequ
 		}
 	}()
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		var message string
-		b, err := io.ReadAll(resp.Body)
-		if err != nil && len(b) > 0 {
-			message = fmt.Sprintf("HTTP error %d: %s", resp.StatusCode, string(b))
-		} else {
-			message = fmt.Sprintf("HTTP error %d", resp.StatusCode)
+	// Verify the default database after the connectivity check, so that authentication errors
+	// are reported as such
+	if d.database != "" {
+		d.cache.Delete("databases")
+		databases, _, err := d.getDatabases(ctx)
+		if err != nil {
+			return &backend.CheckHealthResult{
+				Status:  backend.HealthStatusError,
+				Message: fmt.Sprintf("list databases: %s", err),
+			}, nil
+		}
+		if !slices.Contains(databases, d.database) {
+			return &backend.CheckHealthResult{
+				Status:  backend.HealthStatusError,
+				Message: fmt.Sprintf("default database '%s' does not exist", d.database),
+			}, nil
 		}
-
-		message += " - " + req.URL.String()
-
-		return &backend.CheckHealthResult{
-			Status:  backend.HealthStatusError,
-			Message: message,
-		}, nil
 	}
 
 	return &backend.CheckHealthResult{
 		Status:  backend.HealthStatusOk,
-		Message: "OK",
+		Message: healthMessage(resp.Header.Get("X-Sneller-Version"), d.region),
 	}, nil
 }
 
+// healthMessage returns the message of a successful health check, including the Sneller version
+// reported by the server and the configured region, if available.
+func healthMessage(version, region string) string {
+	var details []string
+	if version != "" {
+		details = append(details, fmt.Sprintf("Sneller %s", version))
+	}
+	if region != "" && region != "custom" {
+		details = append(details, fmt.Sprintf("region %s", region))
+	}
+	if len(details) == 0 {
+		return "OK"
+	}
+	return fmt.Sprintf("OK (%s)", strings.Join(details, ", "))
+}
+
 func (d *Datasource) CallResource(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
 	segments := strings.Split(req.Path, "/")
 	switch segments[0] {
@@ -157,13 +378,50 @@ func (d *Datasource) CallResource(ctx context.Context, req *backend.CallResource
 			})
 		}
 		return sender.Send(d.handleCallResourceTables(ctx, segments[1]))
+	case "validate":
+		return sender.Send(d.handleCallResourceValidate(ctx, req.Body))
 	case "columns":
-		if len(segments) != 3 {
+		// The database may be empty to use the default database, the table is required
+		if len(segments) != 3 || segments[2] == "" {
+			return sender.Send(&backend.CallResourceResponse{
+				Status: http.StatusBadRequest,
+			})
+		}
+		return sender.Send(d.handleCallResourceColumns(ctx, segments[1], segments[2], resourceFlag(req, "fieldTypes")))
+	case "values":
+		// The database may be empty to use the default database, the table and column are required
+		if len(segments) != 4 || segments[2] == "" || segments[3] == "" {
+			return sender.Send(&backend.CallResourceResponse{
+				Status: http.StatusBadRequest,
+			})
+		}
+		limit := resourceInt(req, "limit", defaultColumnValues)
+		if limit <= 0 || limit > maxColumnValues {
+			limit = maxColumnValues
+		}
+		return sender.Send(d.handleCallResourceValues(ctx, segments[1], segments[2], segments[3], limit))
+	case "keys":
+		// The database may be omitted to use the default database
+		if len(segments) > 2 {
+			return sender.Send(&backend.CallResourceResponse{
+				Status: http.StatusBadRequest,
+			})
+		}
+		return sender.Send(d.handleCallResourceAdhocKeys(ctx, strings.Join(segments[1:], "")))
+	case "debug":
+		if len(segments) != 2 || segments[1] != "symbols" {
+			return sender.Send(&backend.CallResourceResponse{
+				Status: http.StatusNotFound,
+			})
+		}
+		return sender.Send(d.handleCallResourceDebugSymbols(ctx, req.Body))
+	case "templates":
+		if len(segments) != 2 {
 			return sender.Send(&backend.CallResourceResponse{
 				Status: http.StatusBadRequest,
 			})
 		}
-		return sender.Send(d.handleCallResourceColumns(ctx, segments[1], segments[2]))
+		return sender.Send(d.handleCallResourceTemplate(ctx, segments[1], req.Body))
 	default:
 		return sender.Send(&backend.CallResourceResponse{
 			Status: http.StatusNotFound,
@@ -213,15 +471,64 @@ func (d *Datasource) handleCallResourceTables(ctx context.Context, database stri
 	}
 }
 
-func (d *Datasource) handleCallResourceColumns(ctx context.Context, database, table string) *backend.CallResourceResponse {
-	databases, status, err := d.getColumns(ctx, database, table)
+func (d *Datasource) handleCallResourceColumns(ctx context.Context, database, table string, fieldTypes bool) *backend.CallResourceResponse {
+	columns, status, err := d.getColumns(ctx, database, table)
 	if err != nil {
 		return &backend.CallResourceResponse{
 			Status: status,
 			Body:   []byte(err.Error()),
 		}
 	}
-	result, err := json.Marshal(databases)
+	var result []byte
+	if fieldTypes {
+		result, err = json.Marshal(columns)
+	} else {
+		result, err = json.Marshal(sliceSelect(columns, func(c snellerColumnInfo) string {
+			return c.Name
+		}))
+	}
+	if err != nil {
+		return &backend.CallResourceResponse{
+			Status: status,
+			Body:   []byte(err.Error()),
+		}
+	}
+	return &backend.CallResourceResponse{
+		Status: http.StatusOK,
+		Body:   result,
+	}
+}
+
+func (d *Datasource) handleCallResourceValues(ctx context.Context, database, table, column string, limit int) *backend.CallResourceResponse {
+	values, status, err := d.getColumnValues(ctx, database, table, column, limit)
+	if err != nil {
+		return &backend.CallResourceResponse{
+			Status: status,
+			Body:   []byte(err.Error()),
+		}
+	}
+	result, err := json.Marshal(values)
+	if err != nil {
+		return &backend.CallResourceResponse{
+			Status: status,
+			Body:   []byte(err.Error()),
+		}
+	}
+	return &backend.CallResourceResponse{
+		Status: http.StatusOK,
+		Body:   result,
+	}
+}
+
+func (d *Datasource) handleCallResourceAdhocKeys(ctx context.Context, database string) *backend.CallResourceResponse {
+	keys, status, err := d.getAdhocKeys(ctx, database)
+	if err != nil {
+		return &backend.CallResourceResponse{
+			Status: status,
+			Body:   []byte(err.Error()),
+		}
+	}
+	result, err := json.Marshal(keys)
 	if err != nil {
 		return &backend.CallResourceResponse{
 			Status: status,
@@ -234,6 +541,286 @@ func (d *Datasource) handleCallResourceColumns(ctx context.Context, database, ta
 	}
 }
 
+// validateExplainPrefix is prepended to queries to validate them without executing them. The
+// line break keeps the column numbers of error positions intact.
+const validateExplainPrefix = "EXPLAIN\n"
+
+type snellerValidationResult struct {
+	Valid bool          `json:"valid"`
+	SQL   string        `json:"sql"`
+	Error *snellerError `json:"error,omitempty"`
+}
+
+// handleCallResourceValidate validates the query in the request body by requesting its execution
+// plan from Sneller, without executing the query itself. Macros are interpolated for the last
+// hour, so error positions refer to the interpolated query that is returned as well.
+func (d *Datasource) handleCallResourceValidate(ctx context.Context, body []byte) *backend.CallResourceResponse {
+	var input snellerQuery
+	err := json.Unmarshal(body, &input)
+	if err != nil {
+		return &backend.CallResourceResponse{
+			Status: http.StatusBadRequest,
+			Body:   []byte(err.Error()),
+		}
+	}
+
+	now := time.Now()
+	query := backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: now.Add(-time.Hour),
+			To:   now,
+		},
+		Interval:      time.Minute,
+		MaxDataPoints: 1000,
+	}
+
+	database := d.queryDatabase(&input)
+	sql := newSnellerMacroEngine(input.Variables).Interpolate(query, input.SQL)
+
+	result := snellerValidationResult{
+		Valid: true,
+		SQL:   sql,
+	}
+
+	resp, err := d.executeQuery(ctx, database, validateExplainPrefix+sql)
+	if err != nil {
+		var serr *snellerError
+		if resp == nil || resp.StatusCode != http.StatusBadRequest || !errors.As(err, &serr) {
+			status := http.StatusInternalServerError
+			if resp != nil {
+				status = resp.StatusCode
+			}
+			return &backend.CallResourceResponse{
+				Status: status,
+				Body:   []byte(err.Error()),
+			}
+		}
+
+		// Compensate for the EXPLAIN prefix
+		if serr.Line > 0 {
+			serr.Line--
+		}
+		if serr.Position != nil {
+			position := *serr.Position - len(validateExplainPrefix)
+			if position < 0 {
+				position = 0
+			}
+			serr.Position = &position
+		}
+
+		result.Valid = false
+		result.Error = serr
+	} else {
+		if err := resp.Body.Close(); err != nil {
+			log.DefaultLogger.Error("failed to close response body", "err", err)
+		}
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		return &backend.CallResourceResponse{
+			Status: http.StatusInternalServerError,
+			Body:   []byte(err.Error()),
+		}
+	}
+	return &backend.CallResourceResponse{
+		Status: http.StatusOK,
+		Body:   b,
+	}
+}
+
+// handleCallResourceTemplate executes the named query template with the parameters in the
+// request body and returns the resulting data frame.
+func (d *Datasource) handleCallResourceTemplate(ctx context.Context, name string, body []byte) *backend.CallResourceResponse {
+	template, ok := d.templates[name]
+	if !ok || !regexTemplateName.MatchString(name) {
+		return &backend.CallResourceResponse{
+			Status: http.StatusNotFound,
+			Body:   []byte(fmt.Sprintf("unknown query template '%s'", name)),
+		}
+	}
+
+	var input snellerTemplateRequest
+	if len(body) != 0 {
+		// Numbers are kept as literals, so that integers above 2^53 are not rounded
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		err := decoder.Decode(&input)
+		if err != nil {
+			return &backend.CallResourceResponse{
+				Status: http.StatusBadRequest,
+				Body:   []byte(err.Error()),
+			}
+		}
+	}
+
+	sql, err := expandQueryTemplate(template.SQL, input.Params)
+	if err != nil {
+		return &backend.CallResourceResponse{
+			Status: http.StatusBadRequest,
+			Body:   []byte(err.Error()),
+		}
+	}
+
+	now := time.Now()
+	query := backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: now.Add(-time.Hour),
+			To:   now,
+		},
+		Interval:      time.Minute,
+		MaxDataPoints: 1000,
+	}
+	if input.From != 0 {
+		query.TimeRange.From = time.UnixMilli(input.From)
+	}
+	if input.To != 0 {
+		query.TimeRange.To = time.UnixMilli(input.To)
+	}
+
+	macros := newSnellerMacroEngine(nil)
+	sql = macros.Interpolate(query, sql)
+
+	database := d.queryDatabase(&snellerQuery{Database: &template.Database})
+	resp, err := d.executeQuery(ctx, database, sql)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		return &backend.CallResourceResponse{
+			Status: status,
+			Body:   []byte(err.Error()),
+		}
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.DefaultLogger.Error("failed to close response body", "err", err)
+		}
+	}()
+
+	frame, err := frameFromSnellerResult(name, sql, resp.Body, macros.timeCandidate, macros.timeUnit, &snellerQuery{}, d.symtabs)
+	if err != nil {
+		return &backend.CallResourceResponse{
+			Status: http.StatusInternalServerError,
+			Body:   []byte(err.Error()),
+		}
+	}
+
+	b, err := json.Marshal(frame)
+	if err != nil {
+		return &backend.CallResourceResponse{
+			Status: http.StatusInternalServerError,
+			Body:   []byte(err.Error()),
+		}
+	}
+	return &backend.CallResourceResponse{
+		Status: http.StatusOK,
+		Body:   b,
+	}
+}
+
+// handleCallResourceDebugSymbols executes the query in the request body and returns the symbol
+// table that was used to decode the result. The response is a JSON list of symbols indexed by
+// symbol ID.
+func (d *Datasource) handleCallResourceDebugSymbols(ctx context.Context, body []byte) *backend.CallResourceResponse {
+	var input snellerQuery
+	err := json.Unmarshal(body, &input)
+	if err != nil {
+		return &backend.CallResourceResponse{
+			Status: http.StatusBadRequest,
+			Body:   []byte(err.Error()),
+		}
+	}
+
+	now := time.Now()
+	query := backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: now.Add(-time.Hour),
+			To:   now,
+		},
+		Interval:      time.Minute,
+		MaxDataPoints: 1000,
+	}
+
+	database := d.queryDatabase(&input)
+	sql := newSnellerMacroEngine(input.Variables).Interpolate(query, input.SQL)
+
+	resp, err := d.executeQuery(ctx, database, sql)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		return &backend.CallResourceResponse{
+			Status: status,
+			Body:   []byte(err.Error()),
+		}
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.DefaultLogger.Error("failed to close response body", "err", err)
+		}
+	}()
+
+	reader := NewReader(resp.Body, 1024*1024*10) // 10 MiB
+	for reader.Next() {
+		// Skip all top-level values, the symbol table is updated as a side effect. Next does not
+		// advance past a value that can not be decoded.
+		if reader.Error() != nil {
+			break
+		}
+	}
+	if err := reader.Error(); err != nil {
+		return &backend.CallResourceResponse{
+			Status: http.StatusInternalServerError,
+			Body:   []byte(err.Error()),
+		}
+	}
+
+	symbols := make([]string, reader.Symbols.MaxID())
+	for i := range symbols {
+		symbols[i] = reader.Symbols.Get(ion.Symbol(i))
+	}
+
+	b, err := json.Marshal(symbols)
+	if err != nil {
+		return &backend.CallResourceResponse{
+			Status: http.StatusInternalServerError,
+			Body:   []byte(err.Error()),
+		}
+	}
+	return &backend.CallResourceResponse{
+		Status: http.StatusOK,
+		Body:   b,
+	}
+}
+
+// resourceInt returns the value of the given integer URL parameter of a resource request, or the
+// given default value, if it is missing or invalid.
+func resourceInt(req *backend.CallResourceRequest, name string, defaultValue int) int {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return defaultValue
+	}
+	value, err := strconv.Atoi(u.Query().Get(name))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// resourceFlag reports whether the boolean URL query parameter with the given name is set for
+// the given resource request.
+func resourceFlag(req *backend.CallResourceRequest, name string) bool {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return false
+	}
+	value, _ := strconv.ParseBool(u.Query().Get(name))
+	return value
+}
+
 func (d *Datasource) handleQuery(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
 	response := backend.NewQueryDataResponse()
 
@@ -242,10 +829,36 @@ func (d *Datasource) handleQuery(ctx context.Context, req *backend.QueryDataRequ
 
 	var mutex sync.Mutex
 
+	// Queries sharing the same RefID would silently overwrite each other's responses
+	refIDs := make(map[string]int, len(req.Queries))
+	for _, q := range req.Queries {
+		refIDs[q.RefID]++
+	}
+
 	// Execute each query and store the results by query RefID
 	for _, q := range req.Queries {
+		if count := refIDs[q.RefID]; count > 1 {
+			mutex.Lock()
+			response.Responses[q.RefID] = backend.ErrDataResponse(backend.StatusBadRequest,
+				fmt.Sprintf("duplicate RefID '%s' used by %d queries", q.RefID, count))
+			mutex.Unlock()
+
+			wg.Done()
+			continue
+		}
+
 		go func(query backend.DataQuery) {
-			resp := d.query(ctx, req.PluginContext, query)
+			var resp backend.DataResponse
+			release, err := d.acquireQuerySlot(ctx)
+			if err != nil {
+				resp = backend.DataResponse{Status: backend.StatusOK}
+				if !errors.Is(err, context.Canceled) {
+					resp = backend.ErrDataResponse(backend.StatusTimeout, fmt.Sprintf("waiting for other queries: %s", err))
+				}
+			} else {
+				resp = d.safeQuery(ctx, req.PluginContext, query)
+				release()
+			}
 
 			mutex.Lock()
 			defer mutex.Unlock()
@@ -260,6 +873,92 @@ func (d *Datasource) handleQuery(ctx context.Context, req *backend.QueryDataRequ
 	return response, nil
 }
 
+// acquireQuerySlot waits until fewer than the configured maximum number of queries are executed
+// and returns a function to release the slot again. Fails, if the context is done before.
+func (d *Datasource) acquireQuerySlot(ctx context.Context) (func(), error) {
+	if d.querySlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case d.querySlots <- struct{}{}:
+		return func() { <-d.querySlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// safeQuery executes the query like query, but converts a panic into an error response, so that
+// a single malformed result does not crash the whole plugin.
+func (d *Datasource) safeQuery(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery) (resp backend.DataResponse) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.DefaultLogger.Error("query panicked", "refID", query.RefID, "panic", r, "stack", string(debug.Stack()))
+			resp = backend.ErrDataResponse(backend.StatusInternal, fmt.Sprintf("internal error: %v", r))
+		}
+	}()
+
+	return d.query(ctx, pCtx, query)
+}
+
+// prepareQuery parses the query model and returns the interpolated SQL text of the given query,
+// along with the database it is executed against.
+func (d *Datasource) prepareQuery(query backend.DataQuery) (*snellerQuery, *snellerMacroEngine, string, string, error) {
+	// Unmarshal the JSON into our query model
+	var input snellerQuery
+	err := json.Unmarshal(query.JSON, &input)
+	if err != nil {
+		return nil, nil, "", "", fmt.Errorf("json unmarshal: %w", err)
+	}
+	input.maxRows = d.maxRows
+
+	macros := newSnellerMacroEngine(input.Variables)
+
+	database := d.queryDatabase(&input)
+	sql, err := applyAdhocFilters(input.SQL, input.AdhocFilters)
+	if err != nil {
+		return nil, nil, "", "", err
+	}
+	sql = macros.Interpolate(query, sql)
+
+	if input.Since != nil {
+		// Only fetch rows newer than the given time (incremental polling). The outer query can
+		// only filter on the projected time column, which may be renamed by an alias.
+		if macros.timeCandidate == "" {
+			return nil, nil, "", "", errors.New("since: the query does not contain a $__time(field) macro")
+		}
+		column := timeColumnName(input.SQL, macros.timeCandidate)
+		if column == "" {
+			return nil, nil, "", "", fmt.Errorf("since: the time field '%s' is not a column of the SELECT list, add an alias (e.g. '$__timeGroup(%s, 5m) AS time')",
+				macros.timeCandidate, macros.timeCandidate)
+		}
+		sql = fmt.Sprintf("SELECT * FROM (%s) WHERE %s > `%s`", trimStatement(sql), strconv.Quote(column), input.Since.UTC().Format(time.RFC3339Nano))
+	}
+
+	panelType := input.PanelType
+	if panelType == "" {
+		panelType = query.QueryType
+	}
+	if limit := d.defaultLimits[panelType]; limit > 0 && !regexLimit.MatchString(sql) {
+		// Avoid over-fetching for panels that only display a limited number of rows
+		sql = fmt.Sprintf("SELECT * FROM (%s) LIMIT %d", trimStatement(sql), limit)
+		input.defaultLimit = limit
+	}
+
+	return &input, macros, database, sql, nil
+}
+
+// queryDatabase returns the database of the given query. Queries without a database, including
+// an empty or blank database, use the configured default database. Without either, tables are
+// qualified in the query text (e.g. 'db.table').
+func (d *Datasource) queryDatabase(input *snellerQuery) string {
+	if input.Database != nil {
+		if database := strings.TrimSpace(*input.Database); database != "" {
+			return database
+		}
+	}
+	return d.database
+}
+
 func (d *Datasource) query(ctx context.Context, _ backend.PluginContext, query backend.DataQuery) backend.DataResponse {
 	ctx, span := tracing.DefaultTracer().Start(
 		ctx,
@@ -275,28 +974,39 @@ func (d *Datasource) query(ctx context.Context, _ backend.PluginContext, query b
 	)
 	defer span.End()
 
-	// Unmarshal the JSON into our query model
-	var input snellerQuery
-	err := json.Unmarshal(query.JSON, &input)
+	// Cancel the query when the datasource instance gets disposed
+	ctx, done := d.inflight.track(ctx)
+	defer done()
+
+	input, macros, database, sql, err := d.prepareQuery(query)
 	if err != nil {
-		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("json unmarshal: %v", err.Error()))
+		return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
+	}
+	if input.NoRetry {
+		ctx = withNoRetry(ctx)
 	}
 
-	macros := newSnellerMacroEngine()
-
-	database := ""
-	if input.Database != nil && *input.Database != "" {
-		database = *input.Database
+	if d.maxScanBytes > 0 {
+		// Reject queries that would scan too much data before executing them
+		estimate, err := d.estimateScan(ctx, database, sql)
+		if err != nil {
+			return backend.ErrDataResponse(backend.StatusInternal, fmt.Sprintf("scan estimate: %s", err))
+		}
+		if estimate < 0 {
+			log.DefaultLogger.Warn("scan estimate not available, skipping scan limit check")
+		} else if estimate > d.maxScanBytes {
+			return backend.ErrDataResponse(backend.StatusBadRequest,
+				fmt.Sprintf("query would scan up to %d bytes, which exceeds the limit of %d bytes", estimate, d.maxScanBytes))
+		}
 	}
-	sql := macros.Interpolate(query, input.SQL)
 
+	start := time.Now()
 	resp, err := d.executeQuery(ctx, database, sql)
 	if err != nil {
-		if errors.Is(err, context.Canceled) {
+		if errors.Is(ctx.Err(), context.Canceled) {
 			// Grafana cancels the context when the same query is executed again before the
-			// previous one completed
-			// TODO: This workaround does not have the desired effect
-			return backend.ErrDataResponse(backend.StatusOK, "OK")
+			// previous one completed. The response is discarded, so no error is reported.
+			return backend.DataResponse{Status: backend.StatusOK}
 		}
 		if errors.Is(err, context.DeadlineExceeded) {
 			return backend.ErrDataResponse(backend.StatusTimeout, fmt.Sprintf("HTTP request: %s", err))
@@ -308,9 +1018,25 @@ func (d *Datasource) query(ctx context.Context, _ backend.PluginContext, query b
 			case http.StatusForbidden:
 				return backend.ErrDataResponse(backend.StatusForbidden, fmt.Sprintf("forbidden: %s", err))
 			case http.StatusBadRequest:
-				return backend.ErrDataResponse(backend.StatusValidationFailed, fmt.Sprintf("bad request: %s", err))
+				response := backend.ErrDataResponse(backend.StatusValidationFailed, fmt.Sprintf("bad request: %s", err))
+				var serr *snellerError
+				if errors.As(err, &serr) && serr.hasPosition() {
+					// Attach the error position to allow the frontend to highlight the offending
+					// part of the query
+					frame := data.NewFrame(query.RefID)
+					frame.Meta = &data.FrameMeta{
+						ExecutedQueryString: sql,
+						Custom:              serr,
+					}
+					response.Frames = data.Frames{frame}
+				}
+				return response
 			}
 		}
+		var serr *snellerError
+		if errors.As(err, &serr) && isSQLError(serr.Message) {
+			return backend.ErrDataResponse(backend.StatusValidationFailed, err.Error())
+		}
 		return backend.ErrDataResponse(backend.StatusInternal, err.Error())
 	}
 	defer func() {
@@ -321,29 +1047,124 @@ func (d *Datasource) query(ctx context.Context, _ backend.PluginContext, query b
 
 	span.AddEvent("query done")
 
-	frame, err := frameFromSnellerResult(query.RefID, sql, resp.Body, macros.timeCandidate)
+	frame, err := frameFromSnellerResult(query.RefID, sql, resp.Body, macros.timeCandidate, macros.timeUnit, input, d.symtabs)
 	if err != nil {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			// Canceled while streaming the response
+			return backend.DataResponse{Status: backend.StatusOK}
+		}
+		var eerr *snellerExecutionError
+		if errors.As(err, &eerr) {
+			status := backend.StatusInternal
+			if isSQLError(eerr.Message) {
+				status = backend.StatusValidationFailed
+			}
+			return backend.ErrDataResponse(status, err.Error())
+		}
 		return backend.ErrDataResponse(backend.StatusInternal, fmt.Sprintf("frame from rows: %s", err))
 	}
 
-	ft := frame.TimeSeriesSchema().Type
+	frames, err := queryFrames(query, input, macros, frame, time.Since(start), false)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
+	}
+
+	return backend.DataResponse{
+		Status: backend.StatusOK,
+		Frames: frames,
+	}
+}
+
+// queryFrames returns the response frames for the frame built from the result of the given query,
+// e.g. the log lines frame for logs queries or a frame per series for long time series. If wide is
+// set, long time series are returned as a single wide frame instead.
+func queryFrames(query backend.DataQuery, input *snellerQuery, macros *snellerMacroEngine, frame *data.Frame, elapsed time.Duration, wide bool) (data.Frames, error) {
+	if len(macros.timeCandidates) > 1 {
+		frame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityInfo,
+			Text: fmt.Sprintf("multiple time fields are marked by macros (%s), '%s' is used as time field",
+				strings.Join(macros.timeCandidates, ", "), macros.timeCandidate),
+		})
+	}
+
+	if query.QueryType == snellerQueryTypeLogs {
+		var err error
+		frame, err = logsQueryFrame(frame, macros.timeCandidate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	frames := data.Frames{frame}
+	if input.StatsFrame {
+		frames = append(frames, statsFrame(query.RefID, frame.Meta, elapsed))
+	}
+
+	schema := frame.TimeSeriesSchema()
+	ft := schema.Type
+	if frame.Meta.Type == data.FrameTypeLogLines {
+		ft = data.TimeSeriesTypeNot
+	} else if isTimeValueFrame(frame) {
+		ft = data.TimeSeriesTypeWide
+	}
 	switch ft {
 	case data.TimeSeriesTypeWide:
 		frame.Meta.Type = data.FrameTypeTimeSeriesWide
 		frame.Meta.PreferredVisualization = data.VisTypeGraph
 	case data.TimeSeriesTypeLong:
-		// TODO: This SDK function is very slow and allocates a lot
+		// Each combination of the string and boolean fields becomes a separate series, labeled
+		// with all of them (e.g. '{region="us", service="api"}')
+		err := sortByTime(frame, schema.TimeIndex)
+		if err != nil {
+			log.DefaultLogger.Warn("failed to convert long frame to wide frame", "err", err)
+			break
+		}
+		if !wide {
+			if series, ok := splitLongFrame(frame, schema); ok {
+				frames = append(series, frames[1:]...)
+				break
+			}
+		}
+		// This SDK function is very slow and allocates a lot, but supports all field types
 		f, err := data.LongToWide(frame, &data.FillMissing{
 			Mode: data.FillModeNull,
 		})
-		if err == nil {
-			frame = f
-			frame.Meta.PreferredVisualization = data.VisTypeGraph
+		if err != nil {
+			log.DefaultLogger.Warn("failed to convert long frame to wide frame", "err", err)
+			break
 		}
+		frames[0] = f
+		f.Meta.PreferredVisualization = data.VisTypeGraph
 	}
 
-	return backend.DataResponse{
-		Status: backend.StatusOK,
-		Frames: data.Frames{frame},
+	return frames, nil
+}
+
+// regexLimit matches queries ending with a LIMIT clause.
+var regexLimit = regexp.MustCompile(`(?i)\bLIMIT\s+\d+(\s+OFFSET\s+\d+)?\s*;?\s*$`)
+
+// trimStatement removes trailing semicolons and whitespace from the given query, so that it can
+// be wrapped in a subquery.
+func trimStatement(sql string) string {
+	return strings.TrimRight(sql, "; \t\r\n")
+}
+
+// isLongFrame returns true, if queryFrames converts the given frame of a query result from a long
+// to a wide time series.
+func isLongFrame(query backend.DataQuery, frame *data.Frame) bool {
+	if query.QueryType == snellerQueryTypeLogs || isTimeValueFrame(frame) {
+		return false
+	}
+	return frame.TimeSeriesSchema().Type == data.TimeSeriesTypeLong
+}
+
+// isTimeValueFrame returns true, if the frame consists of exactly one time field and one numeric
+// field. Such frames are always time series, e.g. sparse metrics, regardless of the schema
+// detection of the SDK.
+func isTimeValueFrame(frame *data.Frame) bool {
+	if len(frame.Fields) != 2 {
+		return false
 	}
+	a, b := frame.Fields[0].Type(), frame.Fields[1].Type()
+	return (a.Time() && b.Numeric()) || (a.Numeric() && b.Time())
 }
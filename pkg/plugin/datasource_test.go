@@ -0,0 +1,252 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/SnellerInc/sneller/ion"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"golang.org/x/exp/slices"
+)
+
+// newTestDatasource creates a datasource with the given settings, whose endpoint is a test
+// server using the given handler.
+func newTestDatasource(t *testing.T, jsonData map[string]any, handler http.HandlerFunc) *Datasource {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	if jsonData == nil {
+		jsonData = map[string]any{}
+	}
+	jsonData["Endpoint"] = server.URL
+	b, err := json.Marshal(jsonData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance, err := NewDatasource(backend.DataSourceInstanceSettings{JSONData: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := instance.(*Datasource)
+	t.Cleanup(ds.Dispose)
+	return ds
+}
+
+// resultHandler returns a handler, which responds to all requests with the given result.
+func resultHandler(result []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/ion")
+		_, _ = w.Write(result)
+	}
+}
+
+func TestDuplicateRefIDs(t *testing.T) {
+	ds := newTestDatasource(t, nil, resultHandler(encodeResult([]ion.Datum{row("x", 1)}, nil)))
+
+	query := json.RawMessage(`{"SQL": "SELECT x FROM t"}`)
+	resp, err := ds.handleQuery(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{RefID: "A", JSON: query},
+			{RefID: "A", JSON: query},
+			{RefID: "B", JSON: query},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Responses) != 2 {
+		t.Fatalf("expected 2 responses, got %d", len(resp.Responses))
+	}
+	if a := resp.Responses["A"]; a.Error == nil || a.Status != backend.StatusBadRequest {
+		t.Errorf("A: expected a bad request error, got %v", a.Error)
+	}
+	if b := resp.Responses["B"]; b.Error != nil || len(b.Frames) == 0 {
+		t.Errorf("B: expected frames, got error %v", b.Error)
+	}
+}
+
+func TestTimeValueFrame(t *testing.T) {
+	// The fixture contains a time field and a nullable float field
+	f, err := os.Open("testdata/time_value.ion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	frame, err := frameFromSnellerResult("A", "SELECT time, value FROM metrics", f, "time", 0, &snellerQuery{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames, err := queryFrames(backend.DataQuery{RefID: "A"}, &snellerQuery{}, newSnellerMacroEngine(nil), frame, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 {
+		t.Fatalf("expected 1 frame, got %d", len(frames))
+	}
+	if frames[0].Meta.Type != data.FrameTypeTimeSeriesWide {
+		t.Errorf("expected type %s, got %s", data.FrameTypeTimeSeriesWide, frames[0].Meta.Type)
+	}
+}
+
+func TestIsTimeValueFrame(t *testing.T) {
+	times := data.NewField("time", nil, []time.Time{{}})
+	values := data.NewField("value", nil, []*float64{nil})
+	text := data.NewField("text", nil, []string{""})
+
+	for _, test := range []struct {
+		name     string
+		fields   []*data.Field
+		expected bool
+	}{
+		{"TimeValue", []*data.Field{times, values}, true},
+		{"ValueTime", []*data.Field{values, times}, true},
+		{"TimeText", []*data.Field{times, text}, false},
+		{"TimeOnly", []*data.Field{times}, false},
+		{"TimeValueText", []*data.Field{times, values, text}, false},
+	} {
+		if actual := isTimeValueFrame(data.NewFrame("A", test.fields...)); actual != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestQueryFramesWideCompositeLabels(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	frame := data.NewFrame("A",
+		data.NewField("time", nil, []time.Time{start, start, start.Add(time.Minute), start.Add(time.Minute)}),
+		data.NewField("region", nil, []string{"us", "eu", "us", "eu"}),
+		data.NewField("service", nil, []string{"api", "api", "api", "web"}),
+		data.NewField("requests", nil, []int64{1, 2, 3, 4}),
+	)
+	frame.Meta = &data.FrameMeta{}
+
+	frames, err := queryFrames(backend.DataQuery{RefID: "A"}, &snellerQuery{}, newSnellerMacroEngine(nil), frame, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 {
+		t.Fatalf("expected 1 frame, got %d", len(frames))
+	}
+
+	var labels []string
+	for _, field := range frames[0].Fields[1:] {
+		labels = append(labels, field.Labels.String())
+	}
+	expected := "[region=eu, service=api region=eu, service=web region=us, service=api]"
+	if fmt.Sprint(labels) != expected {
+		t.Errorf("expected labels %s, got %v", expected, labels)
+	}
+}
+
+// recordingHandler returns a handler, which records the database argument and the SQL text of
+// the last query and responds with an empty result.
+func recordingHandler(database *[]string, sql *string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*database = r.URL.Query()["database"]
+		b, _ := io.ReadAll(r.Body)
+		*sql = string(b)
+		_, _ = w.Write(encodeResult(nil, nil))
+	}
+}
+
+func TestCrossDatabaseQuery(t *testing.T) {
+	var database []string
+	var sql string
+	ds := newTestDatasource(t, nil, recordingHandler(&database, &sql))
+
+	query := `SELECT a.host, b.owner FROM logs.requests a JOIN inventory.hosts b ON a.host = b.host`
+	resp := ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{
+		RefID: "A",
+		JSON:  json.RawMessage(fmt.Sprintf(`{"SQL": %q}`, query)),
+	})
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if database != nil {
+		t.Errorf("expected no database argument, got %v", database)
+	}
+	if sql != query {
+		t.Errorf("expected the qualified table names to be kept, got %s", sql)
+	}
+}
+
+func TestDefaultDatabase(t *testing.T) {
+	for _, test := range []struct {
+		name            string
+		defaultDatabase string
+		database        *string
+		expected        []string
+	}{
+		{"NoDefault", "", nil, nil},
+		{"Default", "logs", nil, []string{"logs"}},
+		{"Empty", "logs", ptr(""), []string{"logs"}},
+		{"Blank", "logs", ptr("  "), []string{"logs"}},
+		{"Explicit", "logs", ptr("metrics"), []string{"metrics"}},
+		{"ExplicitNoDefault", "", ptr("metrics"), []string{"metrics"}},
+	} {
+		var database []string
+		var sql string
+		ds := newTestDatasource(t, map[string]any{"DefaultDatabase": test.defaultDatabase}, recordingHandler(&database, &sql))
+
+		b, err := json.Marshal(snellerQuery{Database: test.database, SQL: "SELECT 1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{RefID: "A", JSON: b})
+		if resp.Error != nil {
+			t.Fatalf("%s: %s", test.name, resp.Error)
+		}
+		if !slices.Equal(database, test.expected) {
+			t.Errorf("%s: expected database %v, got %v", test.name, test.expected, database)
+		}
+	}
+}
+
+func TestDebugSymbolsMalformedResult(t *testing.T) {
+	result := encodeResult([]ion.Datum{row("name", "a"), row("name", "b")}, nil)
+	for _, test := range []struct {
+		name   string
+		result []byte
+	}{
+		{"Truncated", result[:len(result)-3]},
+		{"Malformed", append(encodeRows(row("name", "a")), 0x2e)}, // An integer without length
+	} {
+		ds := newTestDatasource(t, nil, resultHandler(test.result))
+
+		done := make(chan *backend.CallResourceResponse)
+		go func() {
+			done <- ds.handleCallResourceDebugSymbols(context.Background(), []byte(`{"SQL": "SELECT * FROM t"}`))
+		}()
+
+		select {
+		case resp := <-done:
+			if resp.Status != http.StatusInternalServerError {
+				t.Errorf("%s: expected status %d, got %d (%s)", test.name, http.StatusInternalServerError, resp.Status, resp.Body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: expected the malformed result to fail", test.name)
+		}
+
+		resp := ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{
+			RefID: "A",
+			JSON:  json.RawMessage(`{"SQL": "SELECT * FROM t"}`),
+		})
+		if resp.Error == nil {
+			t.Errorf("%s: expected a query error", test.name)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package plugin
+
+import (
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/SnellerInc/sneller/ion"
+)
+
+// Decimal is an arbitrary-precision ION decimal value with the numeric value
+// 'Coefficient * 10^Exponent'. The Sneller ION library does not support decimals.
+type Decimal struct {
+	Coefficient *big.Int
+	Exponent    int
+}
+
+// String returns the exact textual representation of the decimal, e.g. '-12.340'. The sign of
+// a negative zero is not kept, as the coefficient can not represent it.
+func (d Decimal) String() string {
+	if d.Coefficient == nil {
+		return "0"
+	}
+
+	digits := new(big.Int).Abs(d.Coefficient).String()
+	sign := ""
+	if d.Coefficient.Sign() < 0 {
+		sign = "-"
+	}
+
+	if d.Exponent >= 0 {
+		if d.Coefficient.Sign() == 0 {
+			return "0"
+		}
+		return sign + digits + strings.Repeat("0", d.Exponent)
+	}
+
+	scale := -d.Exponent
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
+
+// Float64 returns the nearest floating point value of the decimal.
+func (d Decimal) Float64() float64 {
+	value, _ := strconv.ParseFloat(d.String(), 64)
+	return value
+}
+
+// MarshalJSON encodes the decimal as a JSON number without losing precision.
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+var errInvalidDecimal = errors.New("invalid decimal value")
+
+// readDecimal decodes the given binary ION decimal value.
+func readDecimal(buf []byte) (Decimal, error) {
+	if ion.TypeOf(buf) != ion.DecimalType {
+		return Decimal{}, errInvalidDecimal
+	}
+	body, _ := ion.Contents(buf)
+	if body == nil {
+		return Decimal{}, errInvalidDecimal
+	}
+	if len(body) == 0 {
+		// 0d0
+		return Decimal{Coefficient: new(big.Int)}, nil
+	}
+
+	exp, body, ok := readVarInt(body)
+	if !ok {
+		return Decimal{}, errInvalidDecimal
+	}
+
+	// Coefficient (Int): big-endian magnitude with the sign in the highest bit
+	coef := new(big.Int)
+	if len(body) > 0 {
+		magnitude := append([]byte{body[0] & 0x7f}, body[1:]...)
+		coef.SetBytes(magnitude)
+		if body[0]&0x80 != 0 {
+			coef.Neg(coef)
+		}
+	}
+
+	return Decimal{Coefficient: coef, Exponent: exp}, nil
+}
+
+// readVarInt reads a binary ION VarInt field: a big-endian number of 7-bit groups terminated by
+// a byte with the highest bit set, with the sign in the second highest bit of the first byte.
+func readVarInt(buf []byte) (int, []byte, bool) {
+	if len(buf) == 0 {
+		return 0, buf, false
+	}
+
+	negative := buf[0]&0x40 != 0
+	value := int(buf[0] & 0x3f)
+	n := 0
+	for buf[n]&0x80 == 0 {
+		n++
+		if n == len(buf) || n > 4 {
+			return 0, buf, false
+		}
+		value = value<<7 | int(buf[n]&0x7f)
+	}
+
+	if negative {
+		value = -value
+	}
+	return value, buf[n+1:], true
+}
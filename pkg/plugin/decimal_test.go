@@ -0,0 +1,148 @@
+package plugin
+
+import (
+	"encoding/json"
+	"math"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/SnellerInc/sneller/ion"
+)
+
+// encodeDecimal encodes a binary ION decimal with the value 'coefficient * 10^exponent'. The
+// coefficient is given as a decimal string, '-0' encodes a negative zero.
+func encodeDecimal(coefficient string, exponent int) []byte {
+	// Exponent (VarInt): 7-bit groups, the sign in the second highest bit of the first byte
+	magnitude := exponent
+	if magnitude < 0 {
+		magnitude = -magnitude
+	}
+	exp := []byte{byte(magnitude&0x7f) | 0x80}
+	for magnitude >>= 7; magnitude != 0; magnitude >>= 7 {
+		exp = append([]byte{byte(magnitude & 0x7f)}, exp...)
+	}
+	if exp[0]&0x40 != 0 {
+		exp = append([]byte{0}, exp...)
+	}
+	if exponent < 0 {
+		exp[0] |= 0x40
+	}
+
+	// Coefficient (Int): big-endian magnitude, the sign in the highest bit
+	value, _ := new(big.Int).SetString(coefficient, 10)
+	coef := new(big.Int).Abs(value).Bytes()
+	negative := coefficient[0] == '-'
+	if len(coef) != 0 && coef[0]&0x80 != 0 || len(coef) == 0 && negative {
+		coef = append([]byte{0}, coef...)
+	}
+	if negative {
+		coef[0] |= 0x80
+	}
+
+	body := append(exp, coef...)
+	if len(body) < 14 {
+		return append([]byte{0x50 | byte(len(body))}, body...)
+	}
+	// Longer values are followed by their length (VarUInt)
+	length := []byte{byte(len(body)&0x7f) | 0x80}
+	for n := len(body) >> 7; n != 0; n >>= 7 {
+		length = append([]byte{byte(n & 0x7f)}, length...)
+	}
+	return append(append([]byte{0x5e}, length...), body...)
+}
+
+func TestReadDecimal(t *testing.T) {
+	for _, test := range []struct {
+		coefficient string
+		exponent    int
+		expected    string
+		float       float64
+	}{
+		{"0", 0, "0", 0},
+		{"1234", 0, "1234", 1234},
+		{"-1234", 0, "-1234", -1234},
+		{"12", 3, "12000", 12000},
+		{"-12340", -3, "-12.340", -12.34},
+		{"5", -1, "0.5", 0.5},
+		{"5", -3, "0.005", 0.005},
+		{"-5", -3, "-0.005", -0.005},
+		{"1", -100, "0." + strings.Repeat("0", 99) + "1", 1e-100},
+		{"1", 200, "1" + strings.Repeat("0", 200), 1e200},
+		{"0", -2, "0.00", 0},
+		{"0", 5, "0", 0},
+		// The sign of negative zero is not kept, like for big.Int
+		{"-0", 0, "0", 0},
+		{"-0", -2, "0.00", 0},
+		// Coefficients beyond 64 bits
+		{"123456789012345678901234567890123456789", -20, "1234567890123456789.01234567890123456789", 1234567890123456789.01234567890123456789},
+		{"-340282366920938463463374607431768211456", 0, "-340282366920938463463374607431768211456", -math.Pow(2, 128)},
+		// The float loses precision, the string does not
+		{"9007199254740993", 0, "9007199254740993", 9007199254740992},
+		{"12345678901234567891", -1, "1234567890123456789.1", 1234567890123456789.1},
+	} {
+		buf := encodeDecimal(test.coefficient, test.exponent)
+		value, err := readDecimal(buf)
+		if err != nil {
+			t.Errorf("%sd%d: %s", test.coefficient, test.exponent, err)
+			continue
+		}
+		if s := value.String(); s != test.expected {
+			t.Errorf("%sd%d: expected %s, got %s", test.coefficient, test.exponent, test.expected, s)
+		}
+		if f := value.Float64(); f != test.float {
+			t.Errorf("%sd%d: expected float %v, got %v", test.coefficient, test.exponent, test.float, f)
+		}
+		if b, err := json.Marshal(value); err != nil || string(b) != test.expected {
+			t.Errorf("%sd%d: expected JSON %s, got %s (%v)", test.coefficient, test.exponent, test.expected, b, err)
+		}
+	}
+}
+
+func TestReadDecimalEmpty(t *testing.T) {
+	// 0d0 is encoded without exponent and coefficient
+	value, err := readDecimal([]byte{0x50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := value.String(); s != "0" {
+		t.Errorf("expected 0, got %s", s)
+	}
+	if s := (Decimal{}).String(); s != "0" {
+		t.Errorf("expected 0 for the zero value, got %s", s)
+	}
+}
+
+func TestReadDecimalErrors(t *testing.T) {
+	for _, buf := range [][]byte{
+		{0x21, 0x01},                      // Integer
+		{0x52, 0x00, 0x01},                // Unterminated exponent
+		{0x57, 0, 0, 0, 0, 0, 0x81, 0x01}, // Exponent beyond 5 bytes
+		{0x53, 0xc2},                      // Truncated value
+	} {
+		if _, err := readDecimal(buf); err == nil {
+			t.Errorf("%x: expected an error", buf)
+		}
+	}
+}
+
+func TestReadNullableDecimal(t *testing.T) {
+	buf := append(encodeDecimal("-12340", -3), 0x5f) // null.decimal
+	reader := newBufferedReader(buf, &ion.Symtab{})
+
+	var values []*Decimal
+	for reader.Next() {
+		value, err := reader.ReadNullableDecimal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, value)
+	}
+	if err := reader.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(values) != 2 || values[0] == nil || values[0].String() != "-12.340" || values[1] != nil {
+		t.Errorf("expected [-12.340 <nil>], got %v", values)
+	}
+}
@@ -0,0 +1,189 @@
+package plugin
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/SnellerInc/sneller/ion"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// maxFlattenDepth is the maximum depth up to which struct columns are flattened, if the
+// 'FlattenObjects' option is set. Deeper nested values are returned as JSON.
+const maxFlattenDepth = 8
+
+// flattenedKey returns the lookup key of the flattened struct column with the given field path. The
+// key starts with a NUL character, which is not expected in the names of the result-set fields.
+func flattenedKey(path []string) string {
+	return "\x00" + strings.Join(path, "\x00")
+}
+
+// renameCollidingColumns renames the columns of fields whose name collides with the name of a
+// flattened struct column, e.g. the field 'a.b' and the flattened field 'b' of the struct 'a'. The
+// colliding columns are named after their quoted identifier, i.e. '"a.b"'.
+func renameCollidingColumns(schema *snellerSchema) {
+	flattened := map[string]bool{}
+	for _, col := range schema.Columns {
+		if col.Path != nil {
+			flattened[col.Name] = true
+		}
+	}
+	if len(flattened) == 0 {
+		return
+	}
+	for _, col := range schema.Columns {
+		if col.Path == nil && flattened[col.Name] {
+			col.Name = strconv.Quote(col.Name)
+		}
+	}
+}
+
+// mergeRaggedColumns merges flattened struct columns back into a single column, if the struct
+// field is not a struct in all rows (e.g. a string in some rows). The values of the merged column
+// are returned as JSON. Struct fields that are null in some rows are not merged, but the null
+// values are dropped, as the flattened columns are null in these rows anyway.
+func mergeRaggedColumns(schema *snellerSchema, lookup map[string]*snellerColumn) error {
+	for i := 0; i < len(schema.Columns); i++ {
+		parent := schema.Columns[i]
+		prefix := parent.path()
+
+		var children []*snellerColumn
+		for _, col := range schema.Columns {
+			if len(col.Path) > len(prefix) && slices.Equal(col.Path[:len(prefix)], prefix) {
+				children = append(children, col)
+			}
+		}
+		if len(children) == 0 {
+			continue
+		}
+
+		if parent.Typ == snellerTypeNull {
+			schema.Columns = slices.Delete(schema.Columns, i, i+1)
+			delete(lookup, parent.key())
+			i--
+			continue
+		}
+
+		err := mergeColumns(parent, children, &schema.Symbols)
+		if err != nil {
+			return err
+		}
+
+		// The merged column takes the position of the first column of the group
+		columns := schema.Columns[:0]
+		merged := false
+		for _, col := range schema.Columns {
+			if col == parent || slices.Contains(children, col) {
+				if col != parent {
+					delete(lookup, col.key())
+				}
+				if !merged {
+					columns = append(columns, parent)
+					merged = true
+				}
+				continue
+			}
+			columns = append(columns, col)
+		}
+		schema.Columns = columns
+		i = slices.Index(schema.Columns, parent)
+	}
+
+	return nil
+}
+
+// flatValue is a value of a flattened column, with the path relative to the merged column.
+type flatValue struct {
+	path  []string
+	value ion.Datum
+}
+
+// mergeColumns replaces the values of the parent column by the values of the parent column and
+// the structs rebuilt from the values of the flattened child columns.
+func mergeColumns(parent *snellerColumn, children []*snellerColumn, symbols *ion.Symtab) error {
+	values := map[int]ion.Datum{}
+	err := parent.vector.spooled().replay(symbols, 0, func(reader *IonReader, index int) error {
+		value, err := readDatum(reader, symbols)
+		values[index] = value
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	fields := map[int][]flatValue{}
+	for _, col := range children {
+		path := col.Path[len(parent.path()):]
+		err := col.vector.spooled().replay(symbols, 0, func(reader *IonReader, index int) error {
+			value, err := readDatum(reader, symbols)
+			fields[index] = append(fields[index], flatValue{path: path, value: value})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		col.vector = nil
+	}
+
+	rows := append(maps.Keys(values), maps.Keys(fields)...)
+	slices.Sort(rows)
+	rows = slices.Compact(rows)
+
+	spool := &columnSpool{}
+	for _, row := range rows {
+		if value, ok := values[row]; ok {
+			spool.appendDatum(value, row, symbols)
+		} else {
+			spool.appendDatum(unflatten(fields[row], symbols), row, symbols)
+		}
+	}
+
+	parent.vector = &columnVector{spool: spool}
+	parent.Typ = snellerTypeUnknown
+	parent.Count = len(rows)
+	parent.Numbers, parent.NumericTexts, parent.OtherValues = 0, 0, len(rows)
+
+	return nil
+}
+
+// unflatten rebuilds the struct of the given flattened values.
+func unflatten(values []flatValue, symbols *ion.Symtab) ion.Datum {
+	var names []string
+	groups := map[string][]flatValue{}
+	for _, v := range values {
+		name := v.path[0]
+		if _, ok := groups[name]; !ok {
+			names = append(names, name)
+		}
+		groups[name] = append(groups[name], flatValue{path: v.path[1:], value: v.value})
+	}
+
+	fields := make([]ion.Field, 0, len(names))
+	for _, name := range names {
+		group := groups[name]
+		var nested []flatValue
+		for _, v := range group {
+			if len(v.path) != 0 {
+				nested = append(nested, v)
+			}
+		}
+		if len(nested) != 0 {
+			fields = append(fields, ion.Field{Label: name, Datum: unflatten(nested, symbols)})
+		} else {
+			fields = append(fields, ion.Field{Label: name, Datum: group[len(group)-1].value})
+		}
+	}
+
+	return ion.NewStruct(symbols, fields).Datum()
+}
+
+// readDatum reads the current value of the reader.
+func readDatum(reader *IonReader, symbols *ion.Symtab) (ion.Datum, error) {
+	buf, err := reader.raw()
+	if err != nil {
+		return ion.Empty, err
+	}
+	value, _, err := ion.ReadDatum(symbols, buf)
+	return value, err
+}
@@ -0,0 +1,134 @@
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/SnellerInc/sneller/ion"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// describeFields returns the names and values of the fields of the given frame, e.g. 'a=[1 2]
+// b=[x <nil>]'.
+func describeFields(frame *data.Frame) string {
+	var fields []string
+	for _, field := range frame.Fields {
+		fields = append(fields, fmt.Sprintf("%s=%v", field.Name, concreteValues(field)))
+	}
+	return strings.Join(fields, " ")
+}
+
+// flattenedFrame returns the frame of a result with the given rows.
+func flattenedFrame(t *testing.T, options *snellerQuery, rows ...ion.Datum) *data.Frame {
+	t.Helper()
+	result := encodeResult(rows, nil)
+	frame, err := frameFromSnellerResult("A", "SELECT * FROM logs", bytes.NewReader(result), "", 0, options, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestFlattenNestedStructs(t *testing.T) {
+	rows := []ion.Datum{
+		row("host", "a", "metrics", row("cpu", 1.5, "disk", row("read", 1, "write", 2))),
+		row("host", "b", "metrics", row("cpu", 2.5, "disk", row("read", 3))),
+	}
+	for _, test := range []struct {
+		options  *snellerQuery
+		expected string
+	}{
+		{&snellerQuery{FlattenObjects: true}, "host=[a b] metrics.cpu=[1.5 2.5] metrics.disk.read=[1 3] metrics.disk.write=[2 <nil>]"},
+		{&snellerQuery{FlattenTopLevel: true}, `host=[a b] metrics.cpu=[1.5 2.5] metrics.disk=[{"read":1,"write":2} {"read":3}]`},
+		{&snellerQuery{}, `host=[a b] metrics=[{"cpu":1.5,"disk":{"read":1,"write":2}} {"cpu":2.5,"disk":{"read":3}}]`},
+	} {
+		frame := flattenedFrame(t, test.options, rows...)
+		if actual := describeFields(frame); actual != test.expected {
+			t.Errorf("%+v: expected %s, got %s", *test.options, test.expected, actual)
+		}
+	}
+}
+
+func TestFlattenRaggedStruct(t *testing.T) {
+	// The flattened columns are merged back into a JSON column, as 'a' is not a struct in all rows.
+	// Null values don't prevent flattening.
+	options := &snellerQuery{FlattenObjects: true}
+	frame := flattenedFrame(t, options,
+		row("a", row("b", 1, "c", row("d", "x"))),
+		row("a", "text"),
+		row("a", row("c", row("d", "y"))),
+	)
+	if actual, expected := describeFields(frame), `a=[{"b":1,"c":{"d":"x"}} "text" {"c":{"d":"y"}}]`; actual != expected {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+
+	frame = flattenedFrame(t, options,
+		row("a", row("b", 1)),
+		row("a", nil),
+	)
+	if actual, expected := describeFields(frame), "a.b=[1 <nil>]"; actual != expected {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+}
+
+func TestFlattenKeyCollisions(t *testing.T) {
+	options := &snellerQuery{FlattenObjects: true}
+	for _, test := range []struct {
+		rows     []ion.Datum
+		expected string
+	}{
+		{
+			// The field 'a.b' and the flattened field 'b' of the struct 'a' in the same row
+			rows:     []ion.Datum{row("a.b", 1, "a", row("b", 2))},
+			expected: `"a.b"=[1] a.b=[2]`,
+		},
+		{
+			rows:     []ion.Datum{row("a", row("b", 1)), row("a.b", 2)},
+			expected: `a.b=[1 <nil>] "a.b"=[<nil> 2]`,
+		},
+		{
+			rows:     []ion.Datum{row("a", row("b", row("c", 1)), "a.b.c", 2, "a.b", 3)},
+			expected: `a.b.c=[1] "a.b.c"=[2] a.b=[3]`,
+		},
+		{
+			// The ragged struct is merged, so that the names don't collide anymore
+			rows:     []ion.Datum{row("a", row("b", 1), "a.b", 2), row("a", "x", "a.b", 3)},
+			expected: `a=[{"b":1} "x"] a.b=[2 3]`,
+		},
+	} {
+		frame := flattenedFrame(t, options, test.rows...)
+		if actual := describeFields(frame); actual != test.expected {
+			t.Errorf("expected %s, got %s", test.expected, actual)
+		}
+	}
+
+	// Fields are only renamed if structs are flattened
+	frame := flattenedFrame(t, &snellerQuery{}, row("a.b", 1, "a", row("b", 2)))
+	if actual, expected := describeFields(frame), `a.b=[1] a=[{"b":2}]`; actual != expected {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+}
+
+func TestFlattenDepthLimit(t *testing.T) {
+	// Nested structs 'l1' to 'l10', the innermost with the value 'x'
+	value := row("v", "x")
+	for i := 10; i > 1; i-- {
+		value = row(fmt.Sprintf("l%d", i), value)
+	}
+	value = row("l1", value)
+
+	for _, test := range []struct {
+		options  *snellerQuery
+		expected string
+	}{
+		{&snellerQuery{FlattenObjects: true}, `l1.l2.l3.l4.l5.l6.l7.l8.l9=[{"l10":{"v":"x"}}]`},
+		{&snellerQuery{FlattenTopLevel: true}, `l1.l2=[{"l3":{"l4":{"l5":{"l6":{"l7":{"l8":{"l9":{"l10":{"v":"x"}}}}}}}}}]`},
+	} {
+		frame := flattenedFrame(t, test.options, value)
+		if actual := describeFields(frame); actual != test.expected {
+			t.Errorf("%+v: expected %s, got %s", *test.options, test.expected, actual)
+		}
+	}
+}
@@ -30,3 +30,17 @@ func sliceSelect[T, U any](ts []T, f func(T) U) []U {
 	}
 	return us
 }
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,112 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SnellerInc/sneller/date"
+	"github.com/SnellerInc/sneller/expr"
+	"github.com/SnellerInc/sneller/expr/partiql"
+	"github.com/SnellerInc/sneller/ion"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// encodeResult encodes the given rows like a Sneller query result, i.e. a symbol table followed
+// by the rows and the final status. A nil status encodes an empty final status.
+func encodeResult(rows []ion.Datum, status []ion.Field) []byte {
+	return encodeStream(rows, ion.NewStruct(nil, status).Datum())
+}
+
+// encodeRows encodes the given rows after a BVM and a new symbol table, but without a final
+// status. Concatenated, the results resemble the chunks of a result stream, which reset the
+// symbol table.
+func encodeRows(rows ...ion.Datum) []byte {
+	return encodeStream(rows, ion.Empty)
+}
+
+func encodeStream(rows []ion.Datum, status ion.Datum) []byte {
+	var symbols ion.Symtab
+	var body ion.Buffer
+	for _, row := range rows {
+		row.Encode(&body, &symbols)
+	}
+	if !status.IsEmpty() {
+		ion.Annotation(&symbols, "final_status", status).Encode(&body, &symbols)
+	}
+
+	var result ion.Buffer
+	symbols.Marshal(&result, true)
+	result.UnsafeAppend(body.Bytes())
+	return result.Bytes()
+}
+
+// row returns a struct datum with the given fields, given as alternating names and values.
+func row(fields ...any) ion.Datum {
+	var result []ion.Field
+	for i := 0; i < len(fields); i += 2 {
+		result = append(result, ion.Field{Label: fields[i].(string), Datum: datum(fields[i+1])})
+	}
+	return ion.NewStruct(nil, result).Datum()
+}
+
+// datum converts the given Go value to a datum.
+func datum(value any) ion.Datum {
+	switch v := value.(type) {
+	case nil:
+		return ion.Null
+	case ion.Datum:
+		return v
+	case bool:
+		return ion.Bool(v)
+	case int:
+		return ion.Int(int64(v))
+	case int64:
+		return ion.Int(v)
+	case uint64:
+		return ion.Uint(v)
+	case float64:
+		return ion.Float(v)
+	case string:
+		return ion.String(v)
+	case time.Time:
+		return ion.Timestamp(date.FromTime(v))
+	}
+	panic("unsupported value")
+}
+
+// concreteValues returns the values of the given field, with nil for null values.
+func concreteValues(field *data.Field) []any {
+	result := make([]any, field.Len())
+	for i := range result {
+		if value, ok := field.ConcreteAt(i); ok {
+			result[i] = value
+		}
+	}
+	return result
+}
+
+// ptr returns a pointer to the given value.
+func ptr[T any](value T) *T {
+	return &value
+}
+
+// parseQuery parses the given query like Sneller.
+func parseQuery(t *testing.T, sql string) *expr.Query {
+	t.Helper()
+	query, err := partiql.Parse([]byte(sql))
+	if err != nil {
+		t.Fatalf("%s: %s", sql, err)
+	}
+	return query
+}
+
+// parseStringLiteral returns the value of the given string literal, as parsed by Sneller.
+func parseStringLiteral(t *testing.T, literal string) string {
+	t.Helper()
+	query := parseQuery(t, "SELECT "+literal+" FROM t")
+	value, ok := query.Body.(*expr.Select).Columns[0].Expr.(expr.String)
+	if !ok {
+		t.Fatalf("%s: not a string literal", literal)
+	}
+	return string(value)
+}
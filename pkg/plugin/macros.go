@@ -1,33 +1,65 @@
 package plugin
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"golang.org/x/exp/slices"
 )
 
 type snellerMacroEngine struct {
 	regexDateRange *regexp.Regexp
+	regexInterval  *regexp.Regexp
 	regexMacroFunc *regexp.Regexp
-	timeCandidate  string
+	regexTimeField *regexp.Regexp
+	regexTimeGroup *regexp.Regexp
+	regexVariable  *regexp.Regexp
+	timeCandidate  string        // The first field marked as time field, which is used as time field
+	timeCandidates []string      // All fields marked as time field, in the order of the macros
+	timeUnit       time.Duration // The unit of integer time field values, 0 for the default (ms)
+	variables      map[string]snellerVariable
 }
 
 const (
 	reIdentifier = `([_a-zA-Z0-9]+)`
 )
 
-func newSnellerMacroEngine() *snellerMacroEngine {
+const (
+	// macroEscape is the escaped form of the macro prefix, which is kept as a literal '$__'
+	macroEscape = `$$__`
+	// macroEscapePlaceholder temporarily replaces escaped macro prefixes during interpolation. It is
+	// prefixed with further NUL characters, if the query contains it already.
+	macroEscapePlaceholder = "\x00__"
+)
+
+// newSnellerMacroEngine creates a new macro engine. The variables contain the state of the
+// dashboard template variables, as reported by the frontend.
+func newSnellerMacroEngine(variables map[string]snellerVariable) *snellerMacroEngine {
 	return &snellerMacroEngine{
-		regexDateRange: regexp.MustCompile(`\$\{__(from|to)(?::(date(?::(?:iso|seconds))?))?}`),
+		regexDateRange: regexp.MustCompile(`\$\{__(from|to)(?::(date(?::[^}]+)?))?}`),
+		regexInterval:  regexp.MustCompile(`\$__interval\b`),
 		regexMacroFunc: regexp.MustCompile(`\$__` + reIdentifier + `\(` + reIdentifier + `\)`),
+		regexTimeField: regexp.MustCompile(`\$__time\(\s*([_a-zA-Z0-9]+)\s*,\s*(s|ms|us|ns)\s*\)`),
+		regexTimeGroup: regexp.MustCompile(`\$__timeGroup\(\s*([_a-zA-Z0-9.]+)\s*,\s*(\$__interval|\d+(?:ms|s|m|h|d|w))\s*\)`),
+		regexVariable:  regexp.MustCompile(`\$\{` + reIdentifier + `(?::(\w+))?}|\$` + reIdentifier + `\b`),
+		variables:      variables,
 	}
 }
 
 func (m *snellerMacroEngine) Interpolate(query backend.DataQuery, sql string) string {
+	// Escaped macros (e.g. '$$__interval_ms') are kept as literal text
+	placeholder := macroEscapePlaceholder
+	for strings.Contains(sql, placeholder) {
+		placeholder = "\x00" + placeholder
+	}
+	sql = strings.ReplaceAll(sql, macroEscape, placeholder)
+
 	// See https://grafana.com/docs/grafana/latest/dashboards/variables/add-template-variables/#__from-and-__to
 	sql = replaceAllStringSubmatchFunc(m.regexDateRange, sql, func(groups []string) string {
 		var t *time.Time
@@ -50,9 +82,8 @@ func (m *snellerMacroEngine) Interpolate(query backend.DataQuery, sql string) st
 		case "date:seconds":
 			return strconv.FormatInt((*t).Unix(), 10)
 		}
-		// TODO: support custom format
 
-		return groups[0]
+		return formatMomentDate(*t, strings.TrimPrefix(groups[2], "date:"))
 	})
 
 	// See https://grafana.com/docs/grafana/latest/dashboards/variables/add-template-variables/#__interval_ms
@@ -63,23 +94,364 @@ func (m *snellerMacroEngine) Interpolate(query backend.DataQuery, sql string) st
 	limit := strconv.FormatInt(query.MaxDataPoints, 10)
 	sql = strings.ReplaceAll(sql, `$__max_data_points`, limit)
 
+	// Time buckets with an explicit interval. TIME_BUCKET returns Unix seconds, which would not be
+	// detected as a time field, so DATE_BIN is used in this case as well.
+	sql = replaceAllStringSubmatchFunc(m.regexTimeGroup, sql, func(groups []string) string {
+		interval := query.Interval
+		if groups[2] != "$__interval" {
+			interval = parseGrafanaInterval(groups[2])
+		}
+		if interval <= 0 {
+			return groups[0]
+		}
+		m.addTimeCandidate(groups[1])
+		return fmt.Sprintf("DATE_BIN('%d milliseconds', %s, `%s`)", interval.Milliseconds(), groups[1], query.TimeRange.From.Format(time.RFC3339))
+	})
+
+	// Time fields with an explicit epoch unit for integer values
+	sql = replaceAllStringSubmatchFunc(m.regexTimeField, sql, func(groups []string) string {
+		if m.addTimeCandidate(groups[1]) {
+			m.timeUnit = parseEpochUnit(groups[2])
+		}
+		return groups[1]
+	})
+
+	// See https://grafana.com/docs/grafana/latest/dashboards/variables/add-template-variables/#__interval
+	// Grafana's format (e.g. '5m') is not valid SQL, so the interval is expanded to seconds. The
+	// regex does not match '$__interval_ms' and explicit '$__timeGroup' intervals are expanded
+	// before.
+	sql = m.regexInterval.ReplaceAllLiteralString(sql, formatIntervalSeconds(query.Interval))
+
 	// Macro functions
 	sql = replaceAllStringSubmatchFunc(m.regexMacroFunc, sql, func(groups []string) string {
 		switch groups[1] {
 		case "time":
 			// Custom macro to help the plugin determining the `time` field
-			if m.timeCandidate == "" {
-				m.timeCandidate = groups[2]
-			}
+			m.addTimeCandidate(groups[2])
 			return groups[2]
 		case "timeFilter":
 			// See https://grafana.com/docs/grafana/latest/dashboards/variables/add-template-variables/#timefilter-or-__timefilter
 			return fmt.Sprintf("%s BETWEEN `%s` AND `%s`", groups[2], query.TimeRange.From.Format(time.RFC3339), query.TimeRange.To.Format(time.RFC3339))
+		case "unixEpochFilter":
+			// Like $__timeFilter, but for fields containing Unix timestamps in seconds
+			return fmt.Sprintf("%s BETWEEN %d AND %d", groups[2], query.TimeRange.From.Unix(), query.TimeRange.To.Unix())
 		case "timeGroup":
 			return m.Interpolate(query, fmt.Sprintf("DATE_BIN('$__interval_ms milliseconds', %s, `${__from:date:iso}`)", groups[2]))
 		}
 		return groups[0]
 	})
 
-	return sql
+	// See https://grafana.com/docs/grafana/latest/datasources/mysql/#macros
+	sql = m.expandConditionalAll(sql)
+
+	// Template variables that have not been interpolated by the frontend
+	// See https://grafana.com/docs/grafana/latest/dashboards/variables/variable-syntax/#advanced-variable-format-options
+	sql = replaceAllStringSubmatchFunc(m.regexVariable, sql, func(groups []string) string {
+		name := groups[1] + groups[3]
+		variable, ok := m.variables[name]
+		if !ok || strings.HasPrefix(name, "__") {
+			return groups[0]
+		}
+		value, ok := formatVariable(variable.Values, groups[2])
+		if !ok {
+			return groups[0]
+		}
+		return value
+	})
+
+	return strings.ReplaceAll(sql, placeholder, "$__")
+}
+
+// addTimeCandidate records a field marked as time field by a macro. Returns true, if it is the
+// first candidate, which is used as the time field.
+func (m *snellerMacroEngine) addTimeCandidate(name string) bool {
+	if !slices.Contains(m.timeCandidates, name) {
+		m.timeCandidates = append(m.timeCandidates, name)
+	}
+	if m.timeCandidate != "" {
+		return false
+	}
+	m.timeCandidate = name
+	return true
+}
+
+// expandConditionalAll expands '$__conditionalAll(expr, variable)' macros to '1=1', if the 'All'
+// option of the variable is selected, or to 'expr' otherwise. The expression may contain
+// arbitrary (nested) parentheses and commas, so the arguments can not be matched by a regex.
+func (m *snellerMacroEngine) expandConditionalAll(sql string) string {
+	const prefix = "$__conditionalAll("
+
+	var result strings.Builder
+	for {
+		start := strings.Index(sql, prefix)
+		if start < 0 {
+			break
+		}
+
+		args, end := splitMacroArgs(sql[start+len(prefix):])
+		if end < 0 || len(args) < 2 {
+			// Unterminated or malformed macro
+			break
+		}
+
+		expr := strings.Join(args[:len(args)-1], ",")
+		name := strings.TrimSpace(args[len(args)-1])
+		name = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(name, "$"), "{"), "}")
+
+		result.WriteString(sql[:start])
+		if m.variables[name].All {
+			result.WriteString("1=1")
+		} else {
+			result.WriteString(strings.TrimSpace(expr))
+		}
+		sql = sql[start+len(prefix)+end+1:]
+	}
+	result.WriteString(sql)
+
+	return result.String()
+}
+
+// parseGrafanaInterval parses Grafana interval strings like '100ms', '5s', '1m', '1h', '1d',
+// '1w' or '1y'. Returns 0 for invalid, negative or out of range intervals.
+func parseGrafanaInterval(s string) time.Duration {
+	units := []struct {
+		suffix string
+		unit   time.Duration
+	}{
+		{"ms", time.Millisecond},
+		{"s", time.Second},
+		{"m", time.Minute},
+		{"h", time.Hour},
+		{"d", 24 * time.Hour},
+		{"w", 7 * 24 * time.Hour},
+		{"y", 365 * 24 * time.Hour},
+	}
+	for _, u := range units {
+		if !strings.HasSuffix(s, u.suffix) {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSuffix(s, u.suffix), 10, 64)
+		if err != nil || n < 0 || n > math.MaxInt64/int64(u.unit) {
+			return 0
+		}
+		return time.Duration(n) * u.unit
+	}
+	return 0
+}
+
+// parseEpochUnit parses the epoch unit of a '$__time(field, unit)' macro ('s', 'ms', 'us' or
+// 'ns'). Returns 0 for unknown units.
+func parseEpochUnit(s string) time.Duration {
+	switch s {
+	case "s":
+		return time.Second
+	case "ms":
+		return time.Millisecond
+	case "us":
+		return time.Microsecond
+	case "ns":
+		return time.Nanosecond
+	}
+	return 0
+}
+
+// momentTokens maps the Moment.js format tokens, which are used by Grafana for custom date
+// formats, to Go layouts. Longer tokens come first, as they are matched by prefix.
+var momentTokens = []struct {
+	token  string
+	layout string
+}{
+	{"YYYY", "2006"}, {"YY", "06"},
+	{"MMMM", "January"}, {"MMM", "Jan"}, {"MM", "01"}, {"M", "1"},
+	{"dddd", "Monday"}, {"ddd", "Mon"},
+	{"DD", "02"}, {"D", "2"},
+	{"HH", "15"}, {"H", ""},
+	{"hh", "03"}, {"h", "3"},
+	{"mm", "04"}, {"m", "4"},
+	{"ss", "05"}, {"s", "5"},
+	{"SSS", ".000"}, {"SS", ".00"}, {"S", ".0"},
+	{"A", "PM"}, {"a", "pm"},
+	{"ZZ", "-0700"}, {"Z", "-07:00"},
+	{"X", ""}, {"x", ""},
+}
+
+// formatMomentDate formats the given time using a Moment.js style format like 'YYYY-MM-DD
+// HH:mm:ss', as used by the '${__from:date:format}' variable. Text in square brackets and unknown
+// tokens are kept literally.
+func formatMomentDate(t time.Time, format string) string {
+	var b strings.Builder
+	for len(format) > 0 {
+		if format[0] == '[' {
+			if end := strings.IndexByte(format, ']'); end > 0 {
+				b.WriteString(format[1:end])
+				format = format[end+1:]
+				continue
+			}
+		}
+
+		matched := false
+		for _, token := range momentTokens {
+			if !strings.HasPrefix(format, token.token) {
+				continue
+			}
+			switch token.token {
+			case "H":
+				b.WriteString(strconv.Itoa(t.Hour()))
+			case "X":
+				b.WriteString(strconv.FormatInt(t.Unix(), 10))
+			case "x":
+				b.WriteString(strconv.FormatInt(t.UnixMilli(), 10))
+			case "SSS", "SS", "S":
+				// Go only supports fractional seconds after a period
+				b.WriteString(t.Format(token.layout)[1:])
+			default:
+				b.WriteString(t.Format(token.layout))
+			}
+			format = format[len(token.token):]
+			matched = true
+			break
+		}
+		if !matched {
+			b.WriteByte(format[0])
+			format = format[1:]
+		}
+	}
+	return b.String()
+}
+
+// formatIntervalSeconds formats the given interval as a numeric SQL literal in seconds, e.g. '30'
+// or '0.5', which can be used in arithmetic expressions.
+func formatIntervalSeconds(interval time.Duration) string {
+	return strconv.FormatFloat(interval.Seconds(), 'f', -1, 64)
+}
+
+// formatVariable formats the given variable values using the given Grafana variable format
+// option. Single values are never wrapped in a list. An empty selection expands to 'NULL' for
+// formats that are typically used in 'IN (...)' clauses. Returns false for unsupported formats.
+func formatVariable(values []string, format string) (string, bool) {
+	join := func(quote func(string) string) string {
+		if len(values) == 0 {
+			return "NULL"
+		}
+		quoted := make([]string, len(values))
+		for i, v := range values {
+			quoted[i] = quote(v)
+		}
+		return strings.Join(quoted, ",")
+	}
+
+	switch format {
+	case "", "glob":
+		if len(values) == 1 {
+			return values[0], true
+		}
+		if len(values) == 0 {
+			return "NULL", true
+		}
+		return "{" + strings.Join(values, ",") + "}", true
+	case "raw", "csv":
+		if len(values) == 0 {
+			return "NULL", true
+		}
+		return strings.Join(values, ","), true
+	case "pipe":
+		return strings.Join(values, "|"), true
+	case "singlequote":
+		return join(quoteStringLiteral), true
+	case "doublequote":
+		// Double quoted values are identifiers, which are quoted like ad hoc filter keys
+		return join(strconv.Quote), true
+	case "json":
+		var b []byte
+		if len(values) == 1 {
+			b, _ = json.Marshal(values[0])
+		} else {
+			b, _ = json.Marshal(append([]string{}, values...))
+		}
+		return string(b), true
+	}
+	return "", false
+}
+
+// splitMacroArgs splits the comma separated macro arguments in s up to the closing parenthesis.
+// Commas inside of nested parentheses or quotes are ignored, quotes may contain backslash escaped
+// characters. Returns the index of the closing parenthesis or -1, if it is missing.
+func splitMacroArgs(s string) ([]string, int) {
+	var args []string
+	depth := 0
+	var quote byte
+	last := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			if depth == 0 {
+				return append(args, s[last:i]), i
+			}
+			depth--
+		case c == ',' && depth == 0:
+			args = append(args, s[last:i])
+			last = i + 1
+		}
+	}
+	return nil, -1
+}
+
+// regexTemplateName matches valid query template and parameter names.
+var regexTemplateName = regexp.MustCompile(`^[_a-zA-Z][_a-zA-Z0-9]*$`)
+
+// regexTemplateParam matches parameter references in query templates.
+var regexTemplateParam = regexp.MustCompile(`\{\{\s*([^{}]*?)\s*}}`)
+
+// expandQueryTemplate replaces the '{{name}}' parameter references in the given query template
+// with the given parameter values. Strings are quoted like ad hoc filter values (see
+// quoteAdhocValue), numbers and booleans are inserted as literals. All referenced parameters must
+// be given.
+func expandQueryTemplate(sql string, params map[string]any) (string, error) {
+	for name := range params {
+		if !regexTemplateName.MatchString(name) {
+			return "", fmt.Errorf("invalid parameter name '%s'", name)
+		}
+	}
+
+	var err error
+	result := replaceAllStringSubmatchFunc(regexTemplateParam, sql, func(groups []string) string {
+		name := groups[1]
+		value, ok := params[name]
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("missing parameter '%s'", name)
+			}
+			return groups[0]
+		}
+
+		switch v := value.(type) {
+		case nil:
+			return "NULL"
+		case bool:
+			return strings.ToUpper(strconv.FormatBool(v))
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		case json.Number:
+			return v.String()
+		case string:
+			return quoteAdhocValue(v)
+		}
+		if err == nil {
+			err = fmt.Errorf("unsupported value for parameter '%s': %T", name, value)
+		}
+		return groups[0]
+	})
+
+	return result, err
 }
@@ -0,0 +1,363 @@
+package plugin
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestTimeFilterMacros(t *testing.T) {
+	query := backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2023, 1, 1, 1, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, test := range []struct {
+		sql      string
+		expected string
+	}{
+		{
+			"SELECT * FROM logs WHERE $__timeFilter(timestamp)",
+			"SELECT * FROM logs WHERE timestamp BETWEEN `2023-01-01T00:00:00Z` AND `2023-01-01T01:00:00Z`",
+		},
+		{
+			"SELECT * FROM logs WHERE $__unixEpochFilter(created)",
+			"SELECT * FROM logs WHERE created BETWEEN 1672531200 AND 1672534800",
+		},
+		{
+			"SELECT * FROM logs WHERE $__timeFilter(timestamp) AND $__unixEpochFilter(created)",
+			"SELECT * FROM logs WHERE timestamp BETWEEN `2023-01-01T00:00:00Z` AND `2023-01-01T01:00:00Z` AND created BETWEEN 1672531200 AND 1672534800",
+		},
+		{
+			"SELECT '$$__unixEpochFilter(created)' FROM logs",
+			"SELECT '$__unixEpochFilter(created)' FROM logs",
+		},
+	} {
+		if actual := newSnellerMacroEngine(nil).Interpolate(query, test.sql); actual != test.expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.sql, test.expected, actual)
+		}
+	}
+}
+
+func TestExpandQueryTemplate(t *testing.T) {
+	const template = "SELECT * FROM logs WHERE name = {{name}} AND {{ limit }} > 0"
+
+	for _, test := range []struct {
+		name     any
+		expected string
+	}{
+		{"plain", `SELECT * FROM logs WHERE name = 'plain' AND 10 > 0`},
+		{"O'Brien", `SELECT * FROM logs WHERE name = 'O\'Brien' AND 10 > 0`},
+		{`C:\temp`, `SELECT * FROM logs WHERE name = 'C:\\temp' AND 10 > 0`},
+		{`x\' OR TRUE --`, `SELECT * FROM logs WHERE name = 'x\\\' OR TRUE --' AND 10 > 0`},
+		{"$__interval", `SELECT * FROM logs WHERE name = '$$__interval' AND 10 > 0`},
+		{nil, `SELECT * FROM logs WHERE name = NULL AND 10 > 0`},
+		{true, `SELECT * FROM logs WHERE name = TRUE AND 10 > 0`},
+		{2.5, `SELECT * FROM logs WHERE name = 2.5 AND 10 > 0`},
+		{json.Number("7"), `SELECT * FROM logs WHERE name = 7 AND 10 > 0`},
+	} {
+		sql, err := expandQueryTemplate(template, map[string]any{"name": test.name, "limit": 10.0})
+		if err != nil {
+			t.Errorf("%v: %s", test.name, err)
+			continue
+		}
+		if sql != test.expected {
+			t.Errorf("%v: expected\n%s\ngot\n%s", test.name, test.expected, sql)
+		}
+		parseQuery(t, sql)
+	}
+
+	// The parsed literals are the same as the parameter values
+	for _, value := range []string{"O'Brien", `C:\temp`, `x\' OR TRUE --`, `'\\'`} {
+		sql, err := expandQueryTemplate("{{value}}", map[string]any{"value": value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed := parseStringLiteral(t, sql); parsed != value {
+			t.Errorf("%q: expected the literal %q, got %q", value, value, parsed)
+		}
+	}
+}
+
+func TestExpandQueryTemplateErrors(t *testing.T) {
+	for _, test := range []struct {
+		sql    string
+		params map[string]any
+	}{
+		{"SELECT {{missing}}", map[string]any{}},
+		{"SELECT {{a}}", map[string]any{"a": []any{1.0}}},
+		{"SELECT 1", map[string]any{"not valid": 1.0}},
+	} {
+		if _, err := expandQueryTemplate(test.sql, test.params); err == nil {
+			t.Errorf("%s: expected an error", test.sql)
+		}
+	}
+}
+
+func TestFormatVariable(t *testing.T) {
+	values := []string{"a", "O'Brien", `C:\temp`}
+
+	for _, test := range []struct {
+		format   string
+		values   []string
+		expected string
+	}{
+		{"", values, `{a,O'Brien,C:\temp}`},
+		{"", []string{"a"}, "a"},
+		{"", nil, "NULL"},
+		{"glob", values, `{a,O'Brien,C:\temp}`},
+		{"glob", []string{"a"}, "a"},
+		{"raw", values, `a,O'Brien,C:\temp`},
+		{"raw", nil, "NULL"},
+		{"csv", values, `a,O'Brien,C:\temp`},
+		{"csv", []string{"a"}, "a"},
+		{"csv", nil, "NULL"},
+		{"pipe", values, `a|O'Brien|C:\temp`},
+		{"pipe", nil, ""},
+		{"singlequote", values, `'a','O\'Brien','C:\\temp'`},
+		{"singlequote", []string{`x\' OR TRUE --`}, `'x\\\' OR TRUE --'`},
+		{"singlequote", nil, "NULL"},
+		{"doublequote", values, `"a","O'Brien","C:\\temp"`},
+		{"doublequote", []string{`say "hi"`}, `"say \"hi\""`},
+		{"doublequote", nil, "NULL"},
+		{"json", values, `["a","O'Brien","C:\\temp"]`},
+		{"json", []string{"a"}, `"a"`},
+		{"json", nil, `[]`},
+	} {
+		actual, ok := formatVariable(test.values, test.format)
+		if !ok {
+			t.Errorf("%s %q: unsupported format", test.format, test.values)
+			continue
+		}
+		if actual != test.expected {
+			t.Errorf("%s %q: expected %s, got %s", test.format, test.values, test.expected, actual)
+		}
+	}
+
+	if _, ok := formatVariable(values, "percentencode"); ok {
+		t.Error("expected an unsupported format")
+	}
+}
+
+func TestQuotedVariablesParse(t *testing.T) {
+	values := []string{"O'Brien", `C:\temp`, `x\' OR TRUE --`, `''`}
+	engine := newSnellerMacroEngine(map[string]snellerVariable{"names": {Values: values}})
+
+	sql := engine.Interpolate(backend.DataQuery{}, "SELECT * FROM t WHERE name IN (${names:singlequote})")
+	expected := `SELECT * FROM t WHERE name IN ('O\'Brien','C:\\temp','x\\\' OR TRUE --','\'\'')`
+	if sql != expected {
+		t.Fatalf("expected\n%s\ngot\n%s", expected, sql)
+	}
+	parseQuery(t, sql)
+
+	for _, value := range values {
+		if parsed := parseStringLiteral(t, quoteStringLiteral(value)); parsed != value {
+			t.Errorf("%q: expected the literal %q, got %q", value, value, parsed)
+		}
+	}
+}
+
+func TestConditionalAll(t *testing.T) {
+	variables := map[string]snellerVariable{
+		"all":    {All: true, Values: []string{"a", "b", "c"}},
+		"empty":  {},
+		"single": {Values: []string{"a"}},
+		"multi":  {Values: []string{"a", "b"}},
+	}
+
+	for _, test := range []struct {
+		sql      string
+		expected string
+	}{
+		{
+			"WHERE $__conditionalAll(host IN (${all:singlequote}), $all)",
+			"WHERE 1=1",
+		},
+		{
+			// An empty selection matches no rows
+			"WHERE $__conditionalAll(host IN (${empty:singlequote}), $empty)",
+			"WHERE host IN (NULL)",
+		},
+		{
+			"WHERE $__conditionalAll(host IN (${single:singlequote}), $single)",
+			"WHERE host IN ('a')",
+		},
+		{
+			"WHERE $__conditionalAll(host IN (${multi:singlequote}), ${multi})",
+			"WHERE host IN ('a','b')",
+		},
+		{
+			"WHERE $__conditionalAll(host IN (${all:singlequote}), $all) AND $__conditionalAll(host = $single, $single)",
+			"WHERE 1=1 AND host = a",
+		},
+		{
+			// Commas inside of parentheses and quotes don't separate the arguments
+			"WHERE $__conditionalAll(COALESCE(host, 'x,y') IN ('a,b', 'O\\'Brien, ('), $multi)",
+			"WHERE COALESCE(host, 'x,y') IN ('a,b', 'O\\'Brien, (')",
+		},
+		{
+			// Variables that are not given are not selected
+			"WHERE $__conditionalAll(host = 'a', $unknown)",
+			"WHERE host = 'a'",
+		},
+		{
+			// Unterminated macros are kept
+			"WHERE $__conditionalAll(host = 'a', $all",
+			"WHERE $__conditionalAll(host = 'a', {a,b,c}",
+		},
+	} {
+		if actual := newSnellerMacroEngine(variables).Interpolate(backend.DataQuery{}, test.sql); actual != test.expected {
+			t.Errorf("%q: expected\n%q\ngot\n%q", test.sql, test.expected, actual)
+		}
+	}
+}
+
+func TestFormatMomentDate(t *testing.T) {
+	morning := time.Date(2023, 3, 5, 9, 7, 8, 123456789, time.FixedZone("", 5*3600+1800))
+	evening := time.Date(2023, 12, 24, 21, 30, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		format   string
+		expected string
+	}{
+		{"YYYY", "2023"},
+		{"YY", "23"},
+		{"MMMM", "March"},
+		{"MMM", "Mar"},
+		{"MM", "03"},
+		{"M", "3"},
+		{"dddd", "Sunday"},
+		{"ddd", "Sun"},
+		{"DD", "05"},
+		{"D", "5"},
+		{"HH", "09"},
+		{"H", "9"},
+		{"hh", "09"},
+		{"h", "9"},
+		{"mm", "07"},
+		{"m", "7"},
+		{"ss", "08"},
+		{"s", "8"},
+		{"SSS", "123"},
+		{"SS", "12"},
+		{"S", "1"},
+		{"A", "AM"},
+		{"a", "am"},
+		{"ZZ", "+0530"},
+		{"Z", "+05:30"},
+		{"X", "1677987428"},
+		{"x", "1677987428123"},
+		{"YYYY-MM-DD HH:mm:ss.SSS", "2023-03-05 09:07:08.123"},
+		{"YYYYMMDD", "20230305"},
+		// Text in square brackets and unknown characters are kept literally
+		{"[Year] YYYY", "Year 2023"},
+		{"[YYYY-MM-DD] YYYY", "YYYY-MM-DD 2023"},
+		{"YYYY[]MM", "202303"},
+		{"YYYY-MM-DDTHH:mm", "2023-03-05T09:07"},
+		{"[YYYY", "[2023"},
+		{"", ""},
+	} {
+		if actual := formatMomentDate(morning, test.format); actual != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.format, test.expected, actual)
+		}
+	}
+
+	for format, expected := range map[string]string{
+		"HH H hh h A a": "21 21 09 9 PM pm",
+		"D MMMM YYYY":   "24 December 2023",
+		"ZZ Z":          "+0000 +00:00",
+	} {
+		if actual := formatMomentDate(evening, format); actual != expected {
+			t.Errorf("%q: expected %q, got %q", format, expected, actual)
+		}
+	}
+}
+
+func TestParseGrafanaInterval(t *testing.T) {
+	for _, test := range []struct {
+		interval string
+		expected time.Duration
+	}{
+		{"100ms", 100 * time.Millisecond},
+		{"5s", 5 * time.Second},
+		{"1m", time.Minute},
+		{"2h", 2 * time.Hour},
+		{"1d", 24 * time.Hour},
+		{"2w", 14 * 24 * time.Hour},
+		{"1y", 365 * 24 * time.Hour},
+		{"0s", 0},
+		{"106751d", 106751 * 24 * time.Hour},
+		// Invalid intervals
+		{"", 0},
+		{"5", 0},
+		{"s", 0},
+		{"ms", 0},
+		{"1.5h", 0},
+		{"5x", 0},
+		{"h5", 0},
+		{"5 m", 0},
+		{"-1h", 0},
+		{"106752d", 0},
+		{"99999999999999999999s", 0},
+	} {
+		if actual := parseGrafanaInterval(test.interval); actual != test.expected {
+			t.Errorf("%q: expected %s, got %s", test.interval, test.expected, actual)
+		}
+	}
+}
+
+func TestEscapedMacros(t *testing.T) {
+	query := backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2023, 1, 1, 1, 0, 0, 0, time.UTC),
+		},
+		Interval:      time.Minute,
+		MaxDataPoints: 100,
+	}
+	variables := map[string]snellerVariable{"host": {All: true, Values: []string{"a"}}}
+
+	for _, test := range []struct {
+		sql      string
+		expected string
+	}{
+		{
+			"SELECT * FROM logs WHERE $$__timeFilter(timestamp)",
+			"SELECT * FROM logs WHERE $__timeFilter(timestamp)",
+		},
+		{
+			"SELECT '$$__timeFilter(timestamp)' FROM logs WHERE $__timeFilter(timestamp)",
+			"SELECT '$__timeFilter(timestamp)' FROM logs WHERE timestamp BETWEEN `2023-01-01T00:00:00Z` AND `2023-01-01T01:00:00Z`",
+		},
+		{
+			"SELECT $__interval_ms, '$$__interval_ms', $__interval, '$$__interval', $__max_data_points, '$$__max_data_points'",
+			"SELECT 60000, '$__interval_ms', 60, '$__interval', 100, '$__max_data_points'",
+		},
+		{
+			"SELECT $$__timeGroup(timestamp, 1h), $$__time(timestamp), $$__unixEpochFilter(created)",
+			"SELECT $__timeGroup(timestamp, 1h), $__time(timestamp), $__unixEpochFilter(created)",
+		},
+		{
+			"SELECT * FROM logs WHERE $__conditionalAll(host = '$$__x', $host) AND $$__conditionalAll(a, $host)",
+			"SELECT * FROM logs WHERE 1=1 AND $__conditionalAll(a, a)",
+		},
+		{
+			// Only the dollar signs right before the underscores are an escaped macro prefix
+			"SELECT $$$__interval_ms, $$$$__interval_ms",
+			"SELECT $$__interval_ms, $$$__interval_ms",
+		},
+		{
+			// Literal NUL characters are kept, even if they look like the placeholder
+			"SELECT '\x00__a', '\x00\x00__b', '\x00$$__c', $__interval_ms, '$$__d'",
+			"SELECT '\x00__a', '\x00\x00__b', '\x00$__c', 60000, '$__d'",
+		},
+	} {
+		if actual := newSnellerMacroEngine(variables).Interpolate(query, test.sql); actual != test.expected {
+			t.Errorf("%q: expected\n%q\ngot\n%q", test.sql, test.expected, actual)
+		}
+	}
+}
@@ -1,75 +1,225 @@
 package plugin
 
 import (
-	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/SnellerInc/sneller/ion"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 )
 
-// frameFromSnellerResult builds a Grafana data frame from a raw Sneller query result.
-func frameFromSnellerResult(refID, sql string, input io.Reader, timeField string) (*data.Frame, error) {
-	// Buffer query result in memory
-
-	b, err := io.ReadAll(input)
-	if err != nil {
-		return nil, err
+// frameFromSnellerResult builds a Grafana data frame from a raw Sneller query result. If symtabs
+// is not nil, the parsed symbol tables are shared with other queries against the same table.
+// The result is read in a single pass. The values of each column are collected in a native vector
+// and handed over to the field once the column type is known (see columnVector).
+func frameFromSnellerResult(refID, sql string, input io.Reader, timeField string, timeUnit time.Duration, options *snellerQuery, symtabs *SymtabCache) (*data.Frame, error) {
+	reader := NewReader(input, 1024*1024*10) // 10 MiB
+	if symtabs != nil {
+		reader.UseSymtabCache(symtabs, symtabCacheKey(sql))
 	}
 
 	// Step 1: Derive schema
 
-	schema, err := deriveSchema(b)
+	schema, err := deriveSchema(reader, sql, options, nil)
 	if err != nil {
 		return nil, err
 	}
 
+	return frameFromSchema(refID, sql, schema, 0, timeField, timeUnit, options)
+}
+
+// frameFromSchema builds a Grafana data frame from the rows of the given schema from the given row
+// on. The column values are released, unless the schema is partial (see snellerSchema.snapshot).
+func frameFromSchema(refID, sql string, schema *snellerSchema, from int, timeField string, timeUnit time.Duration, options *snellerQuery) (*data.Frame, error) {
+	rowCount := schema.RowCount - from
+
 	if schema.FinalStatus == nil {
 		return nil, errors.New("query execution failed: 'missing ::final_status annotation'")
 	}
 	if schema.FinalStatus.Error != "" {
-		return nil, fmt.Errorf("query execution failed: '%s'", schema.FinalStatus.Error)
+		return nil, &snellerExecutionError{Message: schema.FinalStatus.Error}
 	}
 
 	// Step 2: Read values
 
+	var err error
+	var notices []data.Notice
+
+	if timeField == "" {
+		timeField = selectTimeColumn(schema)
+	}
+
+	if schema.Skipped != 0 {
+		notices = append(notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text: fmt.Sprintf("only the first %d of %d rows are returned (see the 'maxRows' setting of the data source)",
+				schema.RowCount, schema.RowCount+schema.Skipped),
+		})
+	}
+
+	if options.defaultLimit > 0 && int64(schema.RowCount+schema.Skipped) >= options.defaultLimit {
+		notices = append(notices, data.Notice{
+			Severity: data.NoticeSeverityInfo,
+			Text: fmt.Sprintf("the result is limited to %d rows, add a LIMIT clause to the query to change the limit (see the 'defaultLimits' setting of the data source)",
+				options.defaultLimit),
+		})
+	}
+
+	if options.DropEmptyColumns {
+		var dropped []string
+		columns := schema.Columns[:0]
+		for _, column := range schema.Columns {
+			if column.Count == 0 || column.Typ == snellerTypeNull {
+				dropped = append(dropped, column.Name)
+				continue
+			}
+			columns = append(columns, column)
+		}
+		schema.Columns = columns
+		if len(dropped) != 0 {
+			notices = append(notices, data.Notice{
+				Severity: data.NoticeSeverityInfo,
+				Text:     fmt.Sprintf("dropped %d empty column(s): %s", len(dropped), strings.Join(dropped, ", ")),
+			})
+		}
+	}
+
 	fieldVals := make([]*fieldValues, len(schema.Columns))
-	i := 0
-	for _, column := range schema.Columns {
+	for i, column := range schema.Columns {
 		isTimeField := (column.Name == timeField) &&
-			((column.Typ == snellerTypeString) || (column.Typ == snellerTypeNumber && !column.Floating))
+			((column.Typ == snellerTypeString) || (column.Typ == snellerTypeNumber && !column.Floating) ||
+				(column.Typ == snellerTypeTimestamp))
+		isBoolField := (column.Typ == snellerTypeNumber) && slices.Contains(options.BoolColumns, column.Name)
+		isIntegralField := options.IntegralFloats && (column.Typ == snellerTypeNumber) && column.Floating && !column.Fractional
+		isUnsafeField := options.SafeIntegers && (column.Typ == snellerTypeNumber) && !column.Floating && column.Unsafe
+		isDecimalStringField := options.DecimalStrings && (column.Typ == snellerTypeDecimal)
+
+		var values *fieldValues
+		switch {
+		case options.Format == snellerFormatRaw:
+			// Bypass type inference and return every value as JSON
+			values = newFieldValues[*json.RawMessage](column.Name, rowCount, readJSONNullable)
+		case column.NumericText:
+			// Numeric texts are parsed
+			if column.Nullable || column.Optional {
+				values = newFieldValues[*float64](column.Name, rowCount, readFloat64FromNumberOrTextNullable)
+			} else {
+				values = newFieldValues[float64](column.Name, rowCount, readFloat64FromNumberOrText)
+			}
+		case isBoolField:
+			values = withVector(newFieldValues[*bool](column.Name, rowCount, readBoolFromNumberNullable), vectorBoolsFromNumbers)
+		case isUnsafeField:
+			// JavaScript numbers can not represent these values exactly
+			values = withVector(newFieldValues[*string](column.Name, rowCount, readIntegerAsStringNullable), vectorIntegerStrings)
+			notices = append(notices, data.Notice{
+				Severity: data.NoticeSeverityInfo,
+				Text:     fmt.Sprintf("field '%s' contains integers beyond ±2^53 and is returned as strings", column.Name),
+			})
+		case isDecimalStringField:
+			// Keep the full precision of decimals, e.g. for monetary values
+			values = newFieldValues[*string](column.Name, rowCount, readDecimalAsStringNullable)
+		case isIntegralField:
+			// Floating point columns containing only integral values are displayed as integers
+			if column.Nullable || column.Optional {
+				values = withVector(newFieldValues[*int64](column.Name, rowCount, readInt64FromNumberNullable), vectorNullable(vectorInt64sFromNumbers))
+			} else {
+				values = withVector(newFieldValues[int64](column.Name, rowCount, readInt64FromNumber), vectorInt64sFromNumbers)
+			}
+		default:
+			values, err = grafanaFieldValues(column.Name, rowCount, column, isTimeField, timeUnit)
+			if err != nil {
+				return nil, err
+			}
+		}
 
-		values, err := grafanaFieldValues(column.Name, schema.RowCount, column, isTimeField)
+		values.Label = column.Label
+		values.Isolate = options.PartialColumns
+		if schema.Partial {
+			err = readColumnRange(column, values, &schema.Symbols, from)
+		} else {
+			err = readColumnValues(column, values, &schema.Symbols)
+		}
 		if err != nil {
 			return nil, err
 		}
-
 		fieldVals[i] = values
-		i++
 	}
 
-	_, err = iterateRows(b, func(reader *IonReader, index int) error {
-		return readRowValues(reader, index, fieldVals)
-	})
-
 	// Step 3: Construct Grafana data fields
 
 	fields := make([]*data.Field, len(fieldVals))
+	var fullFields []*data.Field
 	for i := range fieldVals {
+		fieldVals[i].finish(rowCount)
 		fields[i] = data.NewField(fieldVals[i].Name, nil, fieldVals[i].Values)
+		if unit := schema.Columns[i].Unit; unit != "" && fields[i].Type().Numeric() {
+			fields[i].SetConfig(&data.FieldConfig{Unit: unit})
+		}
+
+		if options.MaxStringLength > 0 && fields[i].Type().NonNullableType() == data.FieldTypeString {
+			if options.FullStrings {
+				full := data.NewField(fieldVals[i].Name+"_full", nil, fieldVals[i].Values)
+				fullFields = append(fullFields, full)
+			}
+			fields[i] = truncateStrings(fields[i], options.MaxStringLength)
+		}
+
+		if fieldVals[i].Err != nil {
+			fields[i] = nullFrom(fields[i], fieldVals[i].ErrIndex)
+			notices = append(notices, data.Notice{
+				Severity: data.NoticeSeverityWarning,
+				Text: fmt.Sprintf("field '%s' failed to read at row %d, remaining values are null (%s)",
+					fieldVals[i].Name, fieldVals[i].ErrIndex, fieldVals[i].Err),
+			})
+		}
+
+		if options.TimeAsEpoch && fields[i].Type().Time() {
+			fields[i] = timeToEpoch(fields[i])
+		}
+
+		if options.JSONFormat == snellerJSONIndented && fields[i].Type().NonNullableType() == data.FieldTypeJSON {
+			fields[i], err = indentJSON(fields[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if fieldVals[i].Warnings != 0 {
+			notices = append(notices, data.Notice{
+				Severity: data.NoticeSeverityWarning,
+				Text: fmt.Sprintf("%d value(s) of field '%s' were replaced (%s)",
+					fieldVals[i].Warnings, fieldVals[i].Name, fieldVals[i].Warning),
+			})
+		}
+
+		if unit, ok := options.Units[fieldVals[i].Name]; ok {
+			fields[i], err = applyFieldUnit(fields[i], unit)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	frame := data.NewFrame(refID, fields...)
+	frame := data.NewFrame(refID, append(fields, fullFields...)...)
+	if timeField != "" {
+		promoteTimeField(frame, timeField)
+	}
 	frame.Meta = &data.FrameMeta{
 		Type:                   data.FrameTypeTable,
 		PreferredVisualization: data.VisTypeTable,
 		ExecutedQueryString:    sql,
+		Notices:                notices,
 		Stats: []data.QueryStat{
 			{
 				FieldConfig: data.FieldConfig{DisplayName: "Hits"},
@@ -83,12 +233,326 @@ func frameFromSnellerResult(refID, sql string, input io.Reader, timeField string
 				FieldConfig: data.FieldConfig{DisplayName: "Scanned", Unit: "bytes"},
 				Value:       float64(schema.FinalStatus.Scanned),
 			},
+			{
+				FieldConfig: data.FieldConfig{DisplayName: "Rows"},
+				Value:       float64(schema.RowCount),
+			},
 		},
 	}
+	if elapsed, ok := schema.FinalStatus.elapsed(); ok {
+		frame.Meta.Stats = append(frame.Meta.Stats, data.QueryStat{
+			FieldConfig: data.FieldConfig{DisplayName: "Elapsed", Unit: "ms"},
+			Value:       elapsed,
+		})
+	}
+
+	// Step 4: Apply client-side transformations
+
+	for _, name := range options.CounterColumns {
+		err = counterDeltas(frame, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(options.Extract) != 0 {
+		names := maps.Keys(options.Extract)
+		slices.Sort(names)
+		for _, name := range names {
+			field, err := extractJSONField(frame, name, options.Extract[name])
+			if err != nil {
+				return nil, err
+			}
+			frame.Fields = append(frame.Fields, field)
+		}
+	}
+
+	if options.Unpivot != "" {
+		keyName, valueName := options.UnpivotKey, options.UnpivotValue
+		if keyName == "" {
+			keyName = "key"
+		}
+		if valueName == "" {
+			valueName = "value"
+		}
+		frame, err = unpivotFrame(frame, options.Unpivot, keyName, valueName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(options.GroupBy) != 0 || len(options.Aggregations) != 0 {
+		frame, err = aggregateFrame(frame, options.GroupBy, options.Aggregations)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if options.Format == snellerFormatLogs {
+		frame, err = logsFrame(frame, timeField, options.MessageField, options.LogLabels)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if options.TimeFieldName != "" && timeField != "" {
+		// Rename the time field last, as all other options refer to the original column names
+		for _, field := range frame.Fields {
+			if field.Name == timeField {
+				field.Name = options.TimeFieldName
+			}
+		}
+	}
 
 	return frame, nil
 }
 
+// statsFrame builds a single row frame named '<refID>_stats' from the query statistics in the
+// given frame meta, which allows panels to visualize the query performance. The given elapsed
+// time is only used, if Sneller did not report the execution time itself.
+func statsFrame(refID string, meta *data.FrameMeta, elapsed time.Duration) *data.Frame {
+	fields := []*data.Field{
+		data.NewField("Time", nil, []time.Time{time.Now()}),
+	}
+	hasElapsed := false
+	for _, stat := range meta.Stats {
+		field := data.NewField(stat.DisplayName, nil, []float64{stat.Value})
+		if stat.Unit != "" {
+			field.SetConfig(&data.FieldConfig{Unit: stat.Unit})
+		}
+		fields = append(fields, field)
+		hasElapsed = hasElapsed || stat.DisplayName == "Elapsed"
+	}
+	if !hasElapsed {
+		fields = append(fields, data.NewField("Elapsed", nil, []float64{float64(elapsed.Milliseconds())}).
+			SetConfig(&data.FieldConfig{Unit: "ms"}))
+	}
+
+	frame := data.NewFrame(refID+"_stats", fields...)
+	frame.RefID = refID
+	frame.Meta = &data.FrameMeta{
+		Type:                   data.FrameTypeTable,
+		PreferredVisualization: data.VisTypeTable,
+	}
+
+	return frame
+}
+
+// applyFieldUnit sets the display unit, display name and decimals of the given field and scales
+// its numeric values, if requested. Scaled fields are always converted to float64 fields, which
+// means that integer values beyond 2^53 lose precision.
+func applyFieldUnit(field *data.Field, unit snellerFieldUnit) (*data.Field, error) {
+	config := &data.FieldConfig{}
+	if field.Config != nil {
+		*config = *field.Config
+	}
+
+	if unit.Scale != 0 && unit.Scale != 1 && field.Type().Numeric() {
+		values := make([]*float64, field.Len())
+		for i := range values {
+			value, err := field.NullableFloatAt(i)
+			if err != nil {
+				return nil, err
+			}
+			if value != nil {
+				scaled := *value * unit.Scale
+				value = &scaled
+			}
+			values[i] = value
+		}
+
+		if field.Type().Nullable() {
+			field = data.NewField(field.Name, field.Labels, values)
+		} else {
+			field = data.NewField(field.Name, field.Labels, sliceSelect(values, func(v *float64) float64 {
+				return *v
+			}))
+		}
+	}
+
+	if unit.Unit != "" {
+		config.Unit = unit.Unit
+	}
+	if unit.DisplayName != "" {
+		config.DisplayNameFromDS = unit.DisplayName
+	}
+	if unit.Decimals != nil {
+		config.SetDecimals(*unit.Decimals)
+	}
+	field.SetConfig(config)
+
+	return field, nil
+}
+
+// symtabCacheRegex matches the first table referenced by a query.
+var symtabCacheRegex = regexp.MustCompile(`(?i)\bFROM\s+("[^"]+"|[_a-zA-Z0-9.]+)`)
+
+// symtabCacheKey returns the symbol table cache key for the given query. Results of queries
+// against the same table are likely to share the same symbol table.
+func symtabCacheKey(sql string) string {
+	match := symtabCacheRegex.FindStringSubmatch(sql)
+	if match == nil {
+		return sql
+	}
+	return strings.Trim(match[1], `"`)
+}
+
+// selectColumns returns the output column names of the outermost SELECT list of the given query,
+// as far as they can be determined from the query text. Wildcards are returned as '*' and
+// expressions without an alias as empty names. Queries that only select '*' from a subquery
+// (e.g. wrapped by the 'since' option) return the columns of the subquery. Returns nil, if the
+// query does not start with a SELECT list.
+func selectColumns(sql string) []string {
+	items, from := selectItems(sql)
+	if items == nil {
+		return nil
+	}
+
+	result := make([]string, len(items))
+	for i, item := range items {
+		result[i] = selectColumnName(item)
+	}
+
+	if len(result) == 1 && result[0] == "*" {
+		// SELECT * FROM (subquery) ...
+		if len(from) > 4 {
+			from = strings.TrimSpace(from[4:])
+			if strings.HasPrefix(from, "(") {
+				if inner := selectColumns(from[1:]); inner != nil {
+					return inner
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+// selectItems returns the trimmed items of the outermost SELECT list of the given query and the
+// remainder of the query starting at the FROM clause. Returns nil, if the query does not start
+// with a SELECT list.
+func selectItems(sql string) ([]string, string) {
+	sql = strings.TrimSpace(sql)
+	if len(sql) < 6 || !strings.EqualFold(sql[:6], "SELECT") || (len(sql) > 6 && isIdentifierChar(sql[6])) {
+		return nil, ""
+	}
+	sql = sql[6:]
+	if trimmed := strings.TrimSpace(sql); len(trimmed) > 9 && strings.EqualFold(trimmed[:9], "DISTINCT ") {
+		sql = trimmed[9:]
+	}
+
+	// Split the SELECT list at top-level commas up to the top-level FROM clause
+	var items []string
+	depth, last := 0, 0
+	var quote byte
+	end := len(sql)
+scan:
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				// Escaped character, e.g. 'it\'s'
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			items = append(items, strings.TrimSpace(sql[last:i]))
+			last = i + 1
+		case depth == 0 && (c == 'F' || c == 'f') && i > 0 && isSQLSpace(sql[i-1]) &&
+			len(sql) > i+4 && strings.EqualFold(sql[i:i+4], "FROM") && isSQLSpace(sql[i+4]):
+			end = i
+			break scan
+		}
+	}
+	items = append(items, strings.TrimSpace(sql[last:end]))
+
+	return items, strings.TrimSpace(sql[end:])
+}
+
+// regexTimeMacroItem matches select items consisting of a single $__time(field) macro.
+var regexTimeMacroItem = regexp.MustCompile(`^\$__time\(\s*([_a-zA-Z0-9]+)\s*(?:,\s*\w+\s*)?\)$`)
+
+// timeColumnName returns the output column name of the SELECT list item of the given query, that
+// marks the given field as time field using the $__time or $__timeGroup macro. The query must
+// not be interpolated yet. Returns an empty string, if the name can not be determined, e.g. for
+// $__timeGroup macros without an alias.
+func timeColumnName(sql, field string) string {
+	items, _ := selectItems(sql)
+	macro := regexp.MustCompile(`\$__time(Group)?\(\s*` + regexp.QuoteMeta(field) + `\s*[,)]`)
+	for _, item := range items {
+		if !macro.MatchString(item) {
+			continue
+		}
+		if match := regexSelectAlias.FindStringSubmatch(item); match != nil {
+			return strings.Trim(match[1], `"`)
+		}
+		if match := regexTimeMacroItem.FindStringSubmatch(item); match != nil {
+			return match[1]
+		}
+		return ""
+	}
+	return ""
+}
+
+// regexSelectAlias matches select items with an explicit alias.
+var regexSelectAlias = regexp.MustCompile(`(?is)\s+AS\s+("[^"]+"|[_a-zA-Z][_a-zA-Z0-9]*)$`)
+
+// regexSelectPath matches select items that are plain column paths, e.g. 'a.b.c'.
+var regexSelectPath = regexp.MustCompile(`^("[^"]+"|[_a-zA-Z][_a-zA-Z0-9]*)(\.("[^"]+"|[_a-zA-Z][_a-zA-Z0-9]*))*$`)
+
+// selectColumnName returns the output column name of a single SELECT list item.
+func selectColumnName(item string) string {
+	if item == "*" || strings.HasSuffix(item, ".*") {
+		return "*"
+	}
+	if match := regexSelectAlias.FindStringSubmatch(item); match != nil {
+		return strings.Trim(match[1], `"`)
+	}
+	if regexSelectPath.MatchString(item) {
+		// Paths are named after their last component
+		parts := strings.Split(item, ".")
+		return strings.Trim(parts[len(parts)-1], `"`)
+	}
+	return ""
+}
+
+func isSQLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// isIdentifierChar returns true, if c can be part of an unquoted identifier or keyword.
+func isIdentifierChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// selectTimeColumn returns the name of the only timestamp column of the given schema, which is
+// used as time field, if no field is marked by a macro. Returns an empty string, if there is no
+// timestamp column or the choice would be ambiguous.
+func selectTimeColumn(schema *snellerSchema) string {
+	var candidates []string
+	for _, col := range schema.Columns {
+		if col.Typ == snellerTypeTimestamp {
+			candidates = append(candidates, col.Name)
+		}
+	}
+	if len(candidates) > 1 {
+		log.DefaultLogger.Debug("ambiguous time field, use the $__time(field) macro", "candidates", candidates)
+		return ""
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[0]
+}
+
 // ---
 
 func grafanaType(column *snellerColumn) data.FieldType {
@@ -105,10 +569,14 @@ func grafanaType(column *snellerColumn) data.FieldType {
 		if column.Floating {
 			result = data.FieldTypeFloat64
 		} else {
-			if column.Signed {
-				result = data.FieldTypeInt64
+			// Sneller encodes non-negative integers as 'uint' and negative integers as 'int'
+			// values. A single negative value makes the whole column signed, in which case the
+			// 'uint' values are read as int64 as well.
+			// Integers beyond the int64 range are only supported by unsigned columns.
+			if column.Signed && column.Overflow {
+				result = data.FieldTypeFloat64
 			} else {
-				result = data.FieldTypeUint64
+				result = narrowIntegerType(column)
 			}
 		}
 	case snellerTypeTimestamp:
@@ -119,6 +587,10 @@ func grafanaType(column *snellerColumn) data.FieldType {
 		result = data.FieldTypeJSON
 	case snellerTypeList:
 		result = data.FieldTypeJSON
+	case snellerTypeDecimal:
+		result = data.FieldTypeFloat64
+	case snellerTypeBlob:
+		result = data.FieldTypeString
 	default:
 		return data.FieldTypeUnknown
 	}
@@ -130,23 +602,70 @@ func grafanaType(column *snellerColumn) data.FieldType {
 	return result
 }
 
-func grafanaFieldValues(name string, rowCount int, column *snellerColumn, isTimeField bool) (*fieldValues, error) {
+// narrowIntegerType returns the narrowest Grafana integer type that fits the range of the values
+// of the given integer column. Columns without range information are typed as int64 or uint64.
+func narrowIntegerType(column *snellerColumn) data.FieldType {
+	if column.Signed {
+		switch {
+		case !column.Ranged:
+			return data.FieldTypeInt64
+		case column.Min >= math.MinInt8 && column.Max <= math.MaxInt8:
+			return data.FieldTypeInt8
+		case column.Min >= math.MinInt16 && column.Max <= math.MaxInt16:
+			return data.FieldTypeInt16
+		case column.Min >= math.MinInt32 && column.Max <= math.MaxInt32:
+			return data.FieldTypeInt32
+		}
+		return data.FieldTypeInt64
+	}
+
+	switch {
+	case !column.Ranged:
+		return data.FieldTypeUint64
+	case column.Max <= math.MaxUint8:
+		return data.FieldTypeUint8
+	case column.Max <= math.MaxUint16:
+		return data.FieldTypeUint16
+	case column.Max <= math.MaxUint32:
+		return data.FieldTypeUint32
+	}
+	return data.FieldTypeUint64
+}
+
+func grafanaFieldValues(name string, rowCount int, column *snellerColumn, isTimeField bool, timeUnit time.Duration) (*fieldValues, error) {
 	typ := grafanaType(column)
 
 	if isTimeField {
+		if column.Typ == snellerTypeNumber && !column.Floating {
+			// Epoch values are converted regardless of their range
+			ranged := *column
+			ranged.Ranged = false
+			typ = grafanaType(&ranged)
+		}
 		switch typ {
 		case data.FieldTypeUint64:
 			fallthrough
 		case data.FieldTypeInt64:
-			return newFieldValues[time.Time](name, rowCount, readTimeFromInt64), nil
+			return withVector(newFieldValues[time.Time](name, rowCount, readTimeFromInt64(timeUnit)), vectorTimesFromInt64(timeUnit)), nil
 		case data.FieldTypeNullableInt64:
-			return newFieldValues[*time.Time](name, rowCount, readTimeFromInt64Nullable), nil
+			return withVector(newFieldValues[*time.Time](name, rowCount, readTimeFromInt64Nullable(timeUnit)), vectorNullable(vectorTimesFromInt64(timeUnit))), nil
 		case data.FieldTypeString:
-			return newFieldValues[time.Time](name, rowCount, readTimeFromString), nil
+			return withVector(newFieldValues[time.Time](name, rowCount, readTimeFromString), vectorTimesFromStrings), nil
 		case data.FieldTypeNullableString:
-			return newFieldValues[*time.Time](name, rowCount, readTimeFromStringNullable), nil
+			return withVector(newFieldValues[*time.Time](name, rowCount, readTimeFromStringNullable), vectorTimesFromStringsNullable), nil
+		case data.FieldTypeTime, data.FieldTypeNullableTime:
+			// Timestamps don't need to be converted
+		default:
+			return nil, fmt.Errorf("unsupported field type for time field: %s", typ)
 		}
-		return nil, fmt.Errorf("unsupported field type for time field: %s", typ)
+	}
+
+	if column.Typ == snellerTypeBlob {
+		// Binary values are returned as base64 strings
+		if typ.Nullable() {
+			return newFieldValues[*string](name, rowCount, readBytesAsBase64Nullable), nil
+		}
+		return newFieldValues[string](name, rowCount, readBytesAsBase64), nil
 	}
 
 	switch typ {
@@ -155,29 +674,53 @@ func grafanaFieldValues(name string, rowCount int, column *snellerColumn, isTime
 	case data.FieldTypeNullableJSON:
 		return newFieldValues[*json.RawMessage](name, rowCount, readJSONNullable), nil
 	case data.FieldTypeBool:
-		return newFieldValues[bool](name, rowCount, readBool), nil
+		return withVector(newFieldValues[bool](name, rowCount, readBool), vectorBools), nil
 	case data.FieldTypeNullableBool:
-		return newFieldValues[*bool](name, rowCount, readBoolNullable), nil
+		return withVector(newFieldValues[*bool](name, rowCount, readBoolNullable), vectorNullable(vectorBools)), nil
+	case data.FieldTypeUint8:
+		return withVector(newFieldValues[uint8](name, rowCount, readNarrowUint[uint8]), vectorNarrowUints[uint8]), nil
+	case data.FieldTypeNullableUint8:
+		return withVector(newFieldValues[*uint8](name, rowCount, readNarrowUintNullable[uint8]), vectorNullable(vectorNarrowUints[uint8])), nil
+	case data.FieldTypeUint16:
+		return withVector(newFieldValues[uint16](name, rowCount, readNarrowUint[uint16]), vectorNarrowUints[uint16]), nil
+	case data.FieldTypeNullableUint16:
+		return withVector(newFieldValues[*uint16](name, rowCount, readNarrowUintNullable[uint16]), vectorNullable(vectorNarrowUints[uint16])), nil
+	case data.FieldTypeUint32:
+		return withVector(newFieldValues[uint32](name, rowCount, readNarrowUint[uint32]), vectorNarrowUints[uint32]), nil
+	case data.FieldTypeNullableUint32:
+		return withVector(newFieldValues[*uint32](name, rowCount, readNarrowUintNullable[uint32]), vectorNullable(vectorNarrowUints[uint32])), nil
 	case data.FieldTypeUint64:
-		return newFieldValues[uint64](name, rowCount, readUint64), nil
+		return withVector(newFieldValues[uint64](name, rowCount, readUint64), vectorUint64s), nil
 	case data.FieldTypeNullableUint64:
-		return newFieldValues[*uint64](name, rowCount, readUint64Nullable), nil
+		return withVector(newFieldValues[*uint64](name, rowCount, readUint64Nullable), vectorNullable(vectorUint64s)), nil
+	case data.FieldTypeInt8:
+		return withVector(newFieldValues[int8](name, rowCount, readNarrowInt[int8]), vectorNarrowInts[int8]), nil
+	case data.FieldTypeNullableInt8:
+		return withVector(newFieldValues[*int8](name, rowCount, readNarrowIntNullable[int8]), vectorNullable(vectorNarrowInts[int8])), nil
+	case data.FieldTypeInt16:
+		return withVector(newFieldValues[int16](name, rowCount, readNarrowInt[int16]), vectorNarrowInts[int16]), nil
+	case data.FieldTypeNullableInt16:
+		return withVector(newFieldValues[*int16](name, rowCount, readNarrowIntNullable[int16]), vectorNullable(vectorNarrowInts[int16])), nil
+	case data.FieldTypeInt32:
+		return withVector(newFieldValues[int32](name, rowCount, readNarrowInt[int32]), vectorNarrowInts[int32]), nil
+	case data.FieldTypeNullableInt32:
+		return withVector(newFieldValues[*int32](name, rowCount, readNarrowIntNullable[int32]), vectorNullable(vectorNarrowInts[int32])), nil
 	case data.FieldTypeInt64:
-		return newFieldValues[int64](name, rowCount, readInt64), nil
+		return withVector(newFieldValues[int64](name, rowCount, readInt64), vectorInt64s), nil
 	case data.FieldTypeNullableInt64:
-		return newFieldValues[*int64](name, rowCount, readInt64Nullable), nil
+		return withVector(newFieldValues[*int64](name, rowCount, readInt64Nullable), vectorNullable(vectorInt64s)), nil
 	case data.FieldTypeFloat64:
-		return newFieldValues[float64](name, rowCount, readFloat64), nil
+		return withVector(newFieldValues[float64](name, rowCount, readFloat64), vectorFloat64s), nil
 	case data.FieldTypeNullableFloat64:
-		return newFieldValues[*float64](name, rowCount, readFloat64Nullable), nil
+		return withVector(newFieldValues[*float64](name, rowCount, readFloat64Nullable), vectorNullable(vectorFloat64s)), nil
 	case data.FieldTypeTime:
-		return newFieldValues[time.Time](name, rowCount, readTime), nil
+		return withVector(newFieldValues[time.Time](name, rowCount, readTime), vectorTimes), nil
 	case data.FieldTypeNullableTime:
-		return newFieldValues[*time.Time](name, rowCount, readTimeNullable), nil
+		return withVector(newFieldValues[*time.Time](name, rowCount, readTimeNullable), vectorNullable(vectorTimes)), nil
 	case data.FieldTypeString:
-		return newFieldValues[string](name, rowCount, readString), nil
+		return withVector(newFieldValues[string](name, rowCount, newStringInterner().readString), vectorStrings), nil
 	case data.FieldTypeNullableString:
-		return newFieldValues[*string](name, rowCount, readStringNullable), nil
+		return withVector(newFieldValues[*string](name, rowCount, newStringInterner().readStringNullable), vectorNullable(vectorStrings)), nil
 	}
 
 	return nil, fmt.Errorf("unsupported field type: %s", typ)
@@ -186,7 +729,10 @@ func grafanaFieldValues(name string, rowCount int, column *snellerColumn, isTime
 // ---
 
 func readJSON(r *IonReader) (json.RawMessage, error) {
-	value, _ := readJSONNullable(r)
+	value, err := readJSONNullable(r)
+	if err != nil {
+		return nil, err
+	}
 	return *value, nil
 }
 
@@ -212,6 +758,25 @@ func readBoolNullable(r *IonReader) (*bool, error) {
 	return r.ReadNullableBool()
 }
 
+// readBoolFromNumberNullable reads a numeric value as a boolean. 0 maps to false, 1 maps to true
+// and all other values map to nil.
+func readBoolFromNumberNullable(r *IonReader) (*bool, error) {
+	value, err := r.ReadNullableNumber()
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var result bool
+	switch *value {
+	case 0:
+		result = false
+	case 1:
+		result = true
+	default:
+		return nil, nil
+	}
+	return &result, nil
+}
+
 func readUint64(r *IonReader) (uint64, error) {
 	return r.ReadUint()
 }
@@ -228,6 +793,140 @@ func readInt64Nullable(r *IonReader) (*int64, error) {
 	return r.ReadNullableInt()
 }
 
+// readNarrowUint reads an unsigned integer value into a narrower type. The range of the column
+// is checked by narrowIntegerType, so the conversion does not truncate the value.
+func readNarrowUint[T uint8 | uint16 | uint32](r *IonReader) (T, error) {
+	value, err := r.ReadUint()
+	return T(value), err
+}
+
+func readNarrowUintNullable[T uint8 | uint16 | uint32](r *IonReader) (*T, error) {
+	if r.Type() == ion.NullType {
+		return nil, r.ReadNull()
+	}
+	value, err := readNarrowUint[T](r)
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+// readNarrowInt reads a signed or unsigned integer value into a narrower type. The range of the
+// column is checked by narrowIntegerType, so the conversion does not truncate the value.
+func readNarrowInt[T int8 | int16 | int32](r *IonReader) (T, error) {
+	value, err := r.ReadInt()
+	return T(value), err
+}
+
+func readNarrowIntNullable[T int8 | int16 | int32](r *IonReader) (*T, error) {
+	if r.Type() == ion.NullType {
+		return nil, r.ReadNull()
+	}
+	value, err := readNarrowInt[T](r)
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+// readInt64FromNumber reads a numeric value as an integer. Floating point values are truncated.
+func readInt64FromNumber(r *IonReader) (int64, error) {
+	if r.Type() == ion.FloatType {
+		value, err := r.ReadFloat()
+		return int64(value), err
+	}
+	return r.ReadInt()
+}
+
+func readInt64FromNumberNullable(r *IonReader) (*int64, error) {
+	if r.Type() == ion.NullType {
+		return nil, r.ReadNull()
+	}
+	value, err := readInt64FromNumber(r)
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+// readFloat64FromNumberOrText reads a numeric value or a text value containing a number.
+func readFloat64FromNumberOrText(r *IonReader) (float64, error) {
+	switch r.Type() {
+	case ion.StringType, ion.SymbolType:
+		text, err := r.ReadText()
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseFloat(text, 64)
+	}
+	return r.ReadNumber()
+}
+
+func readFloat64FromNumberOrTextNullable(r *IonReader) (*float64, error) {
+	if r.Type() == ion.NullType {
+		return nil, r.ReadNull()
+	}
+	value, err := readFloat64FromNumberOrText(r)
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+// readDecimalAsStringNullable reads a nullable decimal value and returns its exact textual
+// representation.
+func readDecimalAsStringNullable(r *IonReader) (*string, error) {
+	value, err := r.ReadNullableDecimal()
+	if err != nil || value == nil {
+		return nil, err
+	}
+	result := value.String()
+	return &result, nil
+}
+
+// readBytesAsBase64 reads a blob value and returns it base64 encoded, like blobs nested in JSON
+// values.
+func readBytesAsBase64(r *IonReader) (string, error) {
+	value, err := r.ReadBytes()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(value), nil
+}
+
+func readBytesAsBase64Nullable(r *IonReader) (*string, error) {
+	if r.Type() == ion.NullType {
+		return nil, r.ReadNull()
+	}
+	result, err := readBytesAsBase64(r)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// readIntegerAsStringNullable reads an integer value as a decimal string.
+func readIntegerAsStringNullable(r *IonReader) (*string, error) {
+	var result string
+	switch r.Type() {
+	case ion.NullType:
+		return nil, r.ReadNull()
+	case ion.UintType:
+		value, err := r.ReadUint()
+		if err != nil {
+			return nil, err
+		}
+		result = strconv.FormatUint(value, 10)
+	default:
+		value, err := r.ReadInt()
+		if err != nil {
+			return nil, err
+		}
+		result = strconv.FormatInt(value, 10)
+	}
+	return &result, nil
+}
+
 func readFloat64(r *IonReader) (float64, error) {
 	return r.ReadNumber()
 }
@@ -236,22 +935,102 @@ func readFloat64Nullable(r *IonReader) (*float64, error) {
 	return r.ReadNullableNumber()
 }
 
-func readString(r *IonReader) (string, error) {
-	return r.ReadText()
+// stringInternerMaxEntries is the maximum number of distinct values kept by a stringInterner.
+// Values of high-cardinality columns beyond that are not deduplicated.
+const stringInternerMaxEntries = 4096
+
+// stringInterner deduplicates the repeated values of a single text column, so that equal values
+// share a single string (and pointer, for nullable columns). This mostly reduces the memory usage
+// of low-cardinality columns, e.g. 'status' or 'host'.
+type stringInterner struct {
+	values map[string]*string
+}
+
+func newStringInterner() *stringInterner {
+	return &stringInterner{
+		values: map[string]*string{},
+	}
+}
+
+// read reads a text value and returns the interned string.
+func (s *stringInterner) read(r *IonReader) (*string, error) {
+	if r.Type() == ion.StringType {
+		b, err := r.readStringShared()
+		if err != nil {
+			return nil, err
+		}
+		if value, ok := s.values[string(b)]; ok {
+			return value, nil
+		}
+		return s.store(string(b)), nil
+	}
+
+	// Symbols already share the string of the symbol table
+	text, err := r.ReadText()
+	if err != nil {
+		return nil, err
+	}
+	if value, ok := s.values[text]; ok {
+		return value, nil
+	}
+	return s.store(text), nil
+}
+
+func (s *stringInterner) store(value string) *string {
+	if len(s.values) < stringInternerMaxEntries {
+		s.values[value] = &value
+	}
+	return &value
+}
+
+func (s *stringInterner) readString(r *IonReader) (string, error) {
+	value, err := s.read(r)
+	if err != nil {
+		return "", err
+	}
+	return *value, nil
+}
+
+// readStringNullable reads a nullable text value. Explicit empty strings are returned as a pointer
+// to an empty string, while nil is only returned for ION null values. Rows missing the field
+// altogether are never read and therefore keep the nil zero value as well.
+func (s *stringInterner) readStringNullable(r *IonReader) (*string, error) {
+	if r.Type() == ion.NullType {
+		return nil, r.ReadNull()
+	}
+	return s.read(r)
 }
 
-func readStringNullable(r *IonReader) (*string, error) {
-	return r.ReadNullableText()
-}
+var (
+	minTime = time.Date(1, time.January, 1, 0, 0, 0, 0, time.UTC)
+	maxTime = time.Date(9999, time.December, 31, 23, 59, 59, 999999999, time.UTC)
+)
 
+// readTime reads a timestamp value. Out-of-range components (e.g. leap seconds) are normalized
+// by the ION library. Timestamps that can not be decoded are replaced by the zero time and
+// timestamps outside the years 1 to 9999 are clamped. In both cases a valueWarning is returned.
 func readTime(r *IonReader) (time.Time, error) {
 	value, err := r.ReadTimestamp()
 	if err != nil {
+		if r.Type() == ion.TimestampType {
+			return time.Time{}, &valueWarning{Message: fmt.Sprintf("malformed timestamp: %s", err)}
+		}
 		return time.Time{}, err
 	}
-	return value.Time(), nil
+
+	result := value.Time()
+	if result.Before(minTime) {
+		return minTime, &valueWarning{Message: fmt.Sprintf("timestamp out of range: %s", result)}
+	}
+	if result.After(maxTime) {
+		return maxTime, &valueWarning{Message: fmt.Sprintf("timestamp out of range: %s", result)}
+	}
+
+	return result, nil
 }
 
+// readTimeNullable reads a nullable timestamp value. Malformed and out-of-range timestamps are
+// replaced by nil.
 func readTimeNullable(r *IonReader) (*time.Time, error) {
 	if r.Type() == ion.NullType {
 		return nil, r.ReadNull()
@@ -263,39 +1042,78 @@ func readTimeNullable(r *IonReader) (*time.Time, error) {
 	return &value, nil
 }
 
-func readTimeFromInt64(r *IonReader) (time.Time, error) {
-	value, err := r.ReadInt()
-	if err != nil {
-		return time.Time{}, err
+// readTimeFromInt64 returns a read function for Unix timestamps in the given unit. Milliseconds
+// are used if the unit is 0.
+func readTimeFromInt64(unit time.Duration) func(r *IonReader) (time.Time, error) {
+	return func(r *IonReader) (time.Time, error) {
+		value, err := r.ReadInt()
+		if err != nil {
+			return time.Time{}, err
+		}
+		switch unit {
+		case time.Second:
+			return time.Unix(value, 0), nil
+		case time.Microsecond:
+			return time.UnixMicro(value), nil
+		case time.Nanosecond:
+			return time.Unix(0, value), nil
+		}
+		return time.UnixMilli(value), nil
 	}
-	return time.UnixMilli(value), nil
 }
 
-func readTimeFromInt64Nullable(r *IonReader) (*time.Time, error) {
-	if r.Type() == ion.NullType {
-		return nil, r.ReadNull()
-	}
-	result, err := readTimeFromInt64(r)
-	if err != nil {
-		return nil, err
+func readTimeFromInt64Nullable(unit time.Duration) func(r *IonReader) (*time.Time, error) {
+	read := readTimeFromInt64(unit)
+	return func(r *IonReader) (*time.Time, error) {
+		if r.Type() == ion.NullType {
+			return nil, r.ReadNull()
+		}
+		result, err := read(r)
+		if err != nil {
+			return nil, err
+		}
+		return &result, nil
 	}
-	return &result, nil
 }
 
+// timeLayouts are the layouts accepted for string time fields, in order of priority. Timestamps
+// without a time zone are interpreted as UTC.
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// readTimeFromString reads a string timestamp in one of the timeLayouts. Strings that can not be
+// parsed are replaced by the zero time and a valueWarning is returned.
 func readTimeFromString(r *IonReader) (time.Time, error) {
 	value, err := r.ReadString()
 	if err != nil {
 		return time.Time{}, err
 	}
 
-	result, err := time.Parse(time.RFC3339, value)
-	if err != nil {
-		return time.Time{}, err
+	result, warning := parseTime(value)
+	if warning != nil {
+		return result, warning
 	}
-
 	return result, nil
 }
 
+// parseTime parses a string timestamp in one of the timeLayouts. Returns the zero time and a
+// warning, if the string can not be parsed.
+func parseTime(value string) (time.Time, *valueWarning) {
+	for _, layout := range timeLayouts {
+		result, err := time.Parse(layout, value)
+		if err == nil {
+			return result, nil
+		}
+	}
+
+	return time.Time{}, &valueWarning{Message: fmt.Sprintf("malformed timestamp: '%s'", value)}
+}
+
 func readTimeFromStringNullable(r *IonReader) (*time.Time, error) {
 	if r.Type() == ion.NullType {
 		return nil, r.ReadNull()
@@ -320,8 +1138,35 @@ const (
 	snellerTypeString                             // Go: string
 	snellerTypeStruct                             // Go: map[string]any
 	snellerTypeList                               // Go: []any
+	snellerTypeDecimal                            // Go: Decimal
+	snellerTypeBlob                               // Go: []byte
 )
 
+// String returns the name of the column type.
+func (t snellerColumnType) String() string {
+	switch t {
+	case snellerTypeNull:
+		return "null"
+	case snellerTypeBool:
+		return "bool"
+	case snellerTypeNumber:
+		return "number"
+	case snellerTypeTimestamp:
+		return "timestamp"
+	case snellerTypeString:
+		return "string"
+	case snellerTypeStruct:
+		return "struct"
+	case snellerTypeList:
+		return "list"
+	case snellerTypeDecimal:
+		return "decimal"
+	case snellerTypeBlob:
+		return "blob"
+	}
+	return "unknown"
+}
+
 // snellerType returns the matching Sneller column type for a given ION type.
 func snellerType(typ ion.Type) snellerColumnType {
 	switch typ {
@@ -335,6 +1180,8 @@ func snellerType(typ ion.Type) snellerColumnType {
 		return snellerTypeNumber
 	case ion.FloatType:
 		return snellerTypeNumber
+	case ion.DecimalType:
+		return snellerTypeDecimal
 	case ion.TimestampType:
 		return snellerTypeTimestamp
 	case ion.SymbolType:
@@ -345,6 +1192,8 @@ func snellerType(typ ion.Type) snellerColumnType {
 		return snellerTypeStruct
 	case ion.ListType:
 		return snellerTypeList
+	case ion.BlobType:
+		return snellerTypeBlob
 	default:
 		return snellerTypeUnknown
 	}
@@ -352,14 +1201,59 @@ func snellerType(typ ion.Type) snellerColumnType {
 
 // snellerColumn represents a single column in the result-set of a Sneller query.
 type snellerColumn struct {
-	Index    int               // The column index (or -1 if not stable)
-	Name     string            // The column name
-	Typ      snellerColumnType // The column type
-	Nullable bool              // The column supports 'null' values
-	Optional bool              // The column supports 'missing' values
-	Floating bool              // The column contains at least one floating point numeric value
-	Signed   bool              // The column contains at least one signed numeric value
-	Count    int               // The number of rows containing a value for this column
+	Index      int               // The column index (or -1 if not stable)
+	Name       string            // The column name
+	Label      string            // The field label in the result-set (may differ from the name)
+	Path       []string          // The field path of a flattened struct column (nil for other columns)
+	Typ        snellerColumnType // The column type
+	Nullable   bool              // The column supports 'null' values
+	Optional   bool              // The column supports 'missing' values
+	Floating   bool              // The column contains at least one floating point numeric value
+	Fractional bool              // The column contains at least one non-integral floating point value
+	Unsafe     bool              // The column contains at least one integer beyond the JavaScript safe range
+	Signed     bool              // The column contains at least one signed numeric value
+	Overflow   bool              // The column contains at least one integer beyond the int64 range
+	Ranged     bool              // The range of the integer values is known (see Min and Max)
+	Min        int64             // The smallest integer value (only valid if Ranged)
+	Max        uint64            // The largest non-negative integer value, or 0 (only valid if Ranged)
+	Count      int               // The number of rows containing a value for this column
+
+	Numbers      int  // The number of numeric values
+	NumericTexts int  // The number of text values containing a number
+	OtherValues  int  // The number of non-null values that are neither numbers nor numeric texts
+	NumericText  bool // The column mixes numbers and numeric texts and is read as numbers
+
+	Unit      string // The display unit of annotated duration values (see durationUnits)
+	UnitMixed bool   // The column contains durations with different units
+
+	vector *columnVector // The values, nil for columns that are not present in any row
+}
+
+// key returns the key of the column in the column lookup. Flattened struct columns are keyed by
+// their path, so that they don't collide with fields whose name contains a dot.
+func (c *snellerColumn) key() string {
+	if c.Path == nil {
+		return c.Name
+	}
+	return flattenedKey(c.Path)
+}
+
+// field returns the label of the top-level field of the column, i.e. the label of the struct field
+// for flattened struct columns.
+func (c *snellerColumn) field() string {
+	if c.Path == nil {
+		return c.Label
+	}
+	return c.Path[0]
+}
+
+// path returns the field path of the column, i.e. the path of the flattened struct column or the
+// field label for all other columns.
+func (c *snellerColumn) path() []string {
+	if c.Path == nil {
+		return []string{c.Label}
+	}
+	return c.Path
 }
 
 type snellerFinalStatus struct {
@@ -368,29 +1262,77 @@ type snellerFinalStatus struct {
 	Scanned   int64     `ion:"scanned"`
 	Error     string    `ion:"error"`
 	ResultSet ion.Datum `ion:"result_set"`
+	Elapsed   ion.Datum `ion:"elapsed"` // Not reported by all Sneller versions
+}
+
+// elapsed returns the reported query execution time in milliseconds. Returns false, if the final
+// status does not contain a numeric 'elapsed' field.
+func (s *snellerFinalStatus) elapsed() (float64, bool) {
+	if s.Elapsed.IsEmpty() {
+		return 0, false
+	}
+	switch s.Elapsed.Type() {
+	case ion.UintType:
+		value, err := s.Elapsed.Uint()
+		return float64(value), err == nil
+	case ion.IntType:
+		value, err := s.Elapsed.Int()
+		return float64(value), err == nil
+	case ion.FloatType:
+		value, err := s.Elapsed.Float()
+		return value, err == nil
+	}
+	return 0, false
 }
 
 type snellerQueryError struct {
 	Error string `ion:"error"`
 }
 
+// snellerExecutionError is a query error reported in the response, after the query has been
+// accepted by Sneller.
+type snellerExecutionError struct {
+	Message string
+}
+
+func (e *snellerExecutionError) Error() string {
+	return fmt.Sprintf("query execution failed: '%s'", e.Message)
+}
+
 // snellerSchema represents the derived schema of a Sneller query result-set.
 type snellerSchema struct {
-	RowCount    int                 // The total number of rows returned by the query
+	RowCount    int                 // The number of rows read from the result
+	Skipped     int                 // The number of rows skipped due to the row limit
 	Columns     []*snellerColumn    // The individual columns
 	FinalStatus *snellerFinalStatus // The final query status
+	Symbols     ion.Symtab          // The symbol table of the spooled column values
+	Partial     bool                // The schema of a partial result (see snapshot)
 }
 
-func deriveSchema(buf []byte) (*snellerSchema, error) {
+// deriveSchema derives the schema of a Sneller query result-set and collects the values of each
+// column. The columns are ordered according to the configured column order, if given, or the
+// 'result_set' of the final query status otherwise. If progress is not nil, it is called with the
+// schema after each row (see snapshot).
+func deriveSchema(reader *IonReader, sql string, options *snellerQuery, progress func(schema *snellerSchema) error) (*snellerSchema, error) {
 	schema := snellerSchema{
 		RowCount: 0,
 		Columns:  []*snellerColumn{},
 	}
 	lookup := map[string]*snellerColumn{}
+	depth := options.flattenDepth()
 
-	status, err := iterateRows(buf, func(reader *IonReader, index int) error {
+	status, err := iterateRows(reader, func(reader *IonReader, index int) error {
+		if options.maxRows > 0 && schema.RowCount >= options.maxRows {
+			// The remaining rows are only read to get the final status
+			schema.Skipped++
+			return nil
+		}
 		schema.RowCount += 1
-		return analyzeRow(reader, &schema, lookup)
+		err := analyzeRow(reader, &schema, lookup, index, nil, depth)
+		if err != nil || progress == nil {
+			return err
+		}
+		return progress(&schema)
 	})
 	if err != nil {
 		return nil, err
@@ -398,41 +1340,189 @@ func deriveSchema(buf []byte) (*snellerSchema, error) {
 
 	schema.FinalStatus = status
 
+	err = finishSchema(&schema, lookup, sql, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &schema, nil
+}
+
+// snapshot returns the schema of the rows analyzed so far, while more rows are appended to the
+// given schema. The snapshot shares the column values with the schema and has an empty final
+// status. Ragged columns are not merged and integer columns are not narrowed, as both depend on
+// the remaining rows.
+func (s *snellerSchema) snapshot(sql string, options *snellerQuery) (*snellerSchema, error) {
+	result := snellerSchema{
+		RowCount:    s.RowCount,
+		Skipped:     s.Skipped,
+		Columns:     make([]*snellerColumn, len(s.Columns)),
+		FinalStatus: &snellerFinalStatus{},
+		Partial:     true,
+	}
+	s.Symbols.CloneInto(&result.Symbols)
+
+	lookup := make(map[string]*snellerColumn, len(s.Columns))
+	for i, col := range s.Columns {
+		column := *col
+		column.Ranged = false
+		result.Columns[i] = &column
+		lookup[column.key()] = &column
+	}
+
+	err := finishSchema(&result, lookup, sql, options)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// finishSchema completes the schema of all rows of the given schema (see deriveSchema).
+func finishSchema(schema *snellerSchema, lookup map[string]*snellerColumn, sql string, options *snellerQuery) error {
+	status := schema.FinalStatus
+
+	if options.flattenDepth() > 0 && !schema.Partial {
+		err := mergeRaggedColumns(schema, lookup)
+		if err != nil {
+			return err
+		}
+	}
+	if options.flattenDepth() > 0 {
+		renameCollidingColumns(schema)
+	}
+
 	// Detect missing values
 	for _, col := range schema.Columns {
 		if col.Count != schema.RowCount {
 			col.Optional = true
 		}
+		promoteNumericText(col)
 	}
 
-	if status.ResultSet.IsEmpty() {
-		return &schema, nil
+	if options.PinTypes && !status.ResultSet.IsEmpty() {
+		err := pinColumnTypes(schema, lookup, status.ResultSet)
+		if err != nil {
+			return err
+		}
 	}
 
-	// Restore column order
-	index := 0
-	err = status.ResultSet.UnpackStruct(func(field ion.Field) error {
-		for _, col := range schema.Columns {
-			if col.Name == field.Label {
-				col.Index = index
-				break
+	if columnOrder := options.ColumnOrder; len(columnOrder) != 0 {
+		// Listed columns first, followed by all unlisted columns in discovery order
+		slices.SortStableFunc(schema.Columns, func(a, b *snellerColumn) bool {
+			ia := slices.Index(columnOrder, a.Name)
+			ib := slices.Index(columnOrder, b.Name)
+			return ia != -1 && (ib == -1 || ia < ib)
+		})
+	} else if !status.ResultSet.IsEmpty() {
+		// Restore column order (flattened columns follow the position of their parent column)
+		index := 0
+		err := status.ResultSet.UnpackStruct(func(field ion.Field) error {
+			for _, col := range schema.Columns {
+				if col.field() == field.Label {
+					col.Index = index
+				}
 			}
+			index++
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		index++
-		return nil
-	})
-	if err != nil {
-		return nil, err
+
+		slices.SortStableFunc(schema.Columns, func(a, b *snellerColumn) bool {
+			return a.Index < b.Index
+		})
+	} else if projection := selectColumns(sql); projection != nil {
+		// Follow the projection order of the query. Unlisted columns (e.g. expanded by '*') keep
+		// their discovery order at the position of the first '*' or after all listed columns.
+		star := slices.Index(projection, "*")
+		if star < 0 {
+			star = len(projection)
+		}
+		rank := func(col *snellerColumn) int {
+			for i, name := range projection {
+				if col.field() == name {
+					return i
+				}
+			}
+			return star
+		}
+		slices.SortStableFunc(schema.Columns, func(a, b *snellerColumn) bool {
+			return rank(a) < rank(b)
+		})
 	}
 
-	slices.SortFunc(schema.Columns, func(a, b *snellerColumn) bool {
-		return a.Index < b.Index
-	})
+	// Replace empty column names (e.g. produced by certain expressions) with synthetic ones
+	for i, col := range schema.Columns {
+		if strings.TrimSpace(col.Name) == "" {
+			col.Name = fmt.Sprintf("col_%d", i)
+		}
+	}
 
-	return &schema, nil
+	return nil
+}
+
+// resultSetMissing is the bit of the 'result_set' type sets that represents MISSING values. All
+// other bits represent the ION type with the same number.
+const resultSetMissing = 1 << 15
+
+// pinColumnTypes overrides the observed column types with the static types reported in the
+// 'result_set' of the final query status, which keeps the schema stable regardless of the
+// returned rows. Reported columns that are not present in any row are added. Columns whose type
+// set contains more than one type are left untouched.
+func pinColumnTypes(schema *snellerSchema, lookup map[string]*snellerColumn, resultSet ion.Datum) error {
+	return resultSet.UnpackStruct(func(field ion.Field) error {
+		bits, err := field.Datum.Uint()
+		if err != nil {
+			return nil
+		}
+
+		typ := snellerTypeNull
+		for t := ion.BoolType; t < ion.AnnotationType; t++ {
+			if bits&(1<<t) == 0 {
+				continue
+			}
+			st := snellerType(t)
+			if st == snellerTypeUnknown || (typ != snellerTypeNull && typ != st) {
+				return nil
+			}
+			typ = st
+		}
+
+		col, ok := lookup[field.Label]
+		if !ok {
+			for _, other := range schema.Columns {
+				if other.Path != nil && other.Path[0] == field.Label {
+					// Flattened struct column
+					return nil
+				}
+			}
+			col = &snellerColumn{
+				Index:    -1,
+				Name:     field.Label,
+				Label:    field.Label,
+				Optional: true,
+			}
+			lookup[field.Label] = col
+			schema.Columns = append(schema.Columns, col)
+		}
+
+		col.Typ = typ
+		// The range depends on the returned rows and would make the narrowed type unstable
+		col.Ranged = false
+		col.Nullable = col.Nullable || bits&(1<<ion.NullType) != 0
+		col.Optional = col.Optional || bits&resultSetMissing != 0
+		col.Floating = bits&(1<<ion.FloatType) != 0
+		col.Signed = bits&(1<<ion.IntType|1<<ion.FloatType) != 0
+
+		return nil
+	})
 }
 
-func analyzeRow(reader *IonReader, schema *snellerSchema, lookup map[string]*snellerColumn) error {
+// analyzeRow analyzes the fields of a single row and appends the values to the column vectors.
+// Struct values are flattened into separate columns named 'parent.child' up to the given depth.
+// The path is the field path of the struct being flattened, or nil for the top-level fields.
+func analyzeRow(reader *IonReader, schema *snellerSchema, lookup map[string]*snellerColumn, row int, path []string, depth int) error {
 	index := 0
 	for reader.Next() {
 		name, err := reader.FieldName()
@@ -440,21 +1530,47 @@ func analyzeRow(reader *IonReader, schema *snellerSchema, lookup map[string]*sne
 			return err
 		}
 
+		var fieldPath []string
+		key := name
+		if path != nil {
+			fieldPath = append(path[:len(path):len(path)], name)
+			key = flattenedKey(fieldPath)
+		}
+
 		ionType := reader.Type()
 		snellerType := snellerType(ionType)
 
-		col, ok := lookup[name]
+		if depth > 0 && ionType == ion.StructType {
+			if fieldPath == nil {
+				fieldPath = []string{name}
+			}
+			err := stepInFlattened(reader, func() error {
+				return analyzeRow(reader, schema, lookup, row, fieldPath, depth-1)
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		col, ok := lookup[key]
 		if !ok {
+			if fieldPath != nil {
+				name = strings.Join(fieldPath, ".")
+			}
 			col = &snellerColumn{
 				Index:    index,
 				Name:     name,
+				Label:    name,
+				Path:     fieldPath,
 				Typ:      snellerType,
 				Nullable: snellerType == snellerTypeNull,
 				Signed:   ionType == ion.IntType || ionType == ion.FloatType,
 				Optional: schema.RowCount != 1,
 				Count:    0,
+				vector:   &columnVector{},
 			}
-			lookup[name] = col
+			lookup[key] = col
 			schema.Columns = append(schema.Columns, col)
 		}
 
@@ -484,10 +1600,62 @@ func analyzeRow(reader *IonReader, schema *snellerSchema, lookup map[string]*sne
 			if ionType == ion.FloatType {
 				col.Floating = true
 				col.Signed = true
+				if !col.Fractional {
+					value, err := reader.ReadFloat()
+					if err != nil {
+						return err
+					}
+					col.Fractional = !isIntegral(value)
+				}
 			} else if ionType == ion.IntType {
+				// Negative integer (see grafanaType)
 				col.Signed = true
 			}
-			// TODO: Required bits
+			if ionType != ion.FloatType && !col.Unsafe {
+				col.Unsafe = !isSafeInteger(reader)
+			}
+			if ionType != ion.FloatType && !col.Floating {
+				fitsInt64, fitsUint64 := integerRange(reader)
+				col.Overflow = col.Overflow || !fitsInt64
+				// Integers beyond the uint64 range can only be returned as floating point numbers
+				col.Floating = !fitsUint64
+				if !col.Floating {
+					err := trackIntegerRange(reader, col)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			annotations, err := reader.Annotations()
+			if err != nil {
+				return err
+			}
+			for _, annotation := range annotations {
+				unit, ok := durationUnits[annotation]
+				if !ok || col.UnitMixed {
+					continue
+				}
+				if col.Unit != "" && col.Unit != unit {
+					col.Unit, col.UnitMixed = "", true
+					continue
+				}
+				col.Unit = unit
+			}
+		}
+
+		// Track numeric texts to promote mixed columns (see promoteNumericText)
+		switch {
+		case snellerType == snellerTypeNumber:
+			col.Numbers++
+		case snellerType == snellerTypeString && isNumericText(reader):
+			col.NumericTexts++
+		case snellerType != snellerTypeNull:
+			col.OtherValues++
+		}
+
+		err = col.vector.append(reader, row, &schema.Symbols)
+		if err != nil {
+			return err
 		}
 
 		index++
@@ -496,15 +1664,121 @@ func analyzeRow(reader *IonReader, schema *snellerSchema, lookup map[string]*sne
 	return reader.Error()
 }
 
-func iterateRows(buf []byte, readRowFn func(reader *IonReader, index int) error) (*snellerFinalStatus, error) {
-	reader := NewReader(bytes.NewReader(buf), 1024*1024*10) // 10 MiB
+// isNumericText returns true, if the current text value contains a number.
+func isNumericText(reader *IonReader) bool {
+	var text string
+	if reader.Type() == ion.StringType {
+		b, err := reader.readStringShared()
+		if err != nil || len(b) == 0 || !strings.ContainsRune("+-.0123456789", rune(b[0])) {
+			return false
+		}
+		text = string(b)
+	} else {
+		var err error
+		text, err = reader.ReadText()
+		if err != nil {
+			return false
+		}
+	}
+	_, err := strconv.ParseFloat(text, 64)
+	return err == nil
+}
+
+// promoteNumericText types columns that contain numbers in the majority of rows and numeric texts
+// in all other rows (e.g. produced by coercions) as floating point numbers, instead of degrading
+// them to JSON.
+func promoteNumericText(col *snellerColumn) {
+	if col.Typ == snellerTypeUnknown && col.NumericTexts != 0 && col.OtherValues == 0 &&
+		col.Numbers > col.NumericTexts {
+		col.Typ = snellerTypeNumber
+		col.Floating = true
+		col.NumericText = true
+	}
+}
+
+// durationUnits maps the annotations of numeric duration values (e.g. 'duration_ms::1500') to
+// the corresponding Grafana display units.
+var durationUnits = map[string]string{
+	"duration_ns": "ns",
+	"duration_us": "µs",
+	"duration_ms": "ms",
+	"duration_s":  "s",
+}
+
+// maxSafeInteger is the largest integer that can be represented exactly by JavaScript numbers.
+const maxSafeInteger = 1<<53 - 1
+
+// isSafeInteger returns true, if the current integer value can be represented exactly by
+// JavaScript numbers.
+func isSafeInteger(reader *IonReader) bool {
+	if reader.Type() == ion.UintType {
+		value, err := reader.ReadUint()
+		return err == nil && value <= maxSafeInteger
+	}
+	value, err := reader.ReadInt()
+	return err == nil && value >= -maxSafeInteger
+}
+
+// trackIntegerRange extends the range of the integer values of the column by the current value,
+// which must fit into an uint64 (or an int64, if it is negative).
+func trackIntegerRange(reader *IonReader, col *snellerColumn) error {
+	var min int64
+	var max uint64
+	if reader.Type() == ion.IntType {
+		value, err := reader.ReadInt()
+		if err != nil {
+			return err
+		}
+		min = value
+	} else {
+		value, err := reader.ReadUint()
+		if err != nil {
+			return err
+		}
+		max = value
+		min = math.MaxInt64
+		if value < math.MaxInt64 {
+			min = int64(value)
+		}
+	}
+
+	if !col.Ranged || min < col.Min {
+		col.Min = min
+	}
+	if !col.Ranged || max > col.Max {
+		col.Max = max
+	}
+	col.Ranged = true
+	return nil
+}
+
+// integerRange returns whether the current integer value fits into an int64 and an uint64.
+func integerRange(reader *IonReader) (fitsInt64 bool, fitsUint64 bool) {
+	_, err := reader.ReadInt()
+	fitsInt64 = !errors.Is(err, errIntegerOverflow)
+	if reader.Type() == ion.IntType {
+		return fitsInt64, fitsInt64
+	}
+	_, err = reader.ReadUint()
+	return fitsInt64, !errors.Is(err, errIntegerOverflow)
+}
+
+// isIntegral returns true, if the given floating point value is an integer in the int64 range.
+func isIntegral(value float64) bool {
+	return value == math.Trunc(value) && value >= math.MinInt64 && value < math.MaxInt64
+}
 
+func iterateRows(reader *IonReader, readRowFn func(reader *IonReader, index int) error) (*snellerFinalStatus, error) {
 	var finalStatus snellerFinalStatus
 	var queryError snellerQueryError
 	var status *snellerFinalStatus
 
 	index := 0
 	for reader.Next() {
+		if reader.Error() != nil {
+			// The value could not be decoded
+			break
+		}
 		if status != nil {
 			return nil, errors.New("unexpected data after ::final_status annotation")
 		}
@@ -541,12 +1815,12 @@ func iterateRows(buf []byte, readRowFn func(reader *IonReader, index int) error)
 
 		err = reader.StepIn()
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("row %d: %w", index, err)
 		}
 
 		err = readRowFn(reader, index)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("row %d: %w", index, err)
 		}
 
 		err = reader.StepOut()
@@ -555,52 +1829,189 @@ func iterateRows(buf []byte, readRowFn func(reader *IonReader, index int) error)
 		}
 		index++
 	}
+	if err := reader.Error(); err != nil {
+		return nil, fmt.Errorf("row %d: %w", index, err)
+	}
 	if status == nil {
+		if queryError.Error != "" {
+			return nil, &snellerExecutionError{Message: queryError.Error}
+		}
 		return nil, fmt.Errorf("missing final_status annotation (upstream query error)")
 	}
-	return status, reader.Error()
+	return status, nil
 }
 
 type fieldReadFunc = func(reader *IonReader, rowIndex int) error
 
 type fieldValues struct {
-	Name   string        // The field name
-	Values any           // The field values for each row (Go: *[]T)
-	ReadFn fieldReadFunc // The peek function
+	Name      string                   // The field name
+	Label     string                   // The field label in the result-set
+	Values    any                      // The field values for each row (Go: []T), set by FinishFn
+	ReadFn    fieldReadFunc            // The peek function
+	ConvertFn func(*columnVector) bool // Converts the values of a column vector, if set (see withVector)
+	FinishFn  func(rowCount int) any   // Returns the values, padded to the given number of rows
+	Warning   string                   // The first warning reported while reading the values
+	Warnings  int                      // The number of values that were replaced
+	Isolate   bool                     // Isolate read errors to this field instead of failing
+	Err       error                    // The read error, if isolated
+	ErrIndex  int                      // The index of the row that failed to read, if isolated
+}
+
+// fieldValuesChunkSize is the number of rows by which the value slices grow at least. Slices grow
+// by a quarter of their capacity beyond that, which bounds the overallocation compared to the
+// default doubling of 'append'.
+const fieldValuesChunkSize = 64 * 1024
+
+// finish sets the values of the field padded to the given number of rows.
+func (f *fieldValues) finish(rowCount int) {
+	f.Values = f.FinishFn(rowCount)
+}
+
+// warn records a value that was replaced.
+func (f *fieldValues) warn(warning *valueWarning) {
+	if f.Warnings == 0 {
+		f.Warning = warning.Message
+	}
+	f.Warnings++
+}
+
+// growValues returns the given values extended to n values. The capacity grows by at least
+// fieldValuesChunkSize values (up to the expected number of values, if the limit is given) or
+// doubles, while the number of values is unknown and below fieldValuesChunkSize.
+func growValues[T any](values []T, n int, limit int) []T {
+	if n <= cap(values) {
+		return values[:n]
+	}
+	c := cap(values) + maxInt(fieldValuesChunkSize, cap(values)/4)
+	if limit > 0 && limit < c {
+		c = limit
+	} else if limit <= 0 && cap(values) < fieldValuesChunkSize {
+		c = maxInt(2*cap(values), 8)
+	}
+	if c < n {
+		c = n
+	}
+	grown := make([]T, n, c)
+	copy(grown, values)
+	return grown
+}
+
+// valueWarning is returned by read functions, if a value can not be represented and is replaced
+// by a best-effort value. The value is stored anyway and the warning is reported as a frame
+// notice, instead of failing the query.
+type valueWarning struct {
+	Message string
+}
+
+func (w *valueWarning) Error() string {
+	return w.Message
 }
 
+// newFieldValues creates a new field values container. The values slice is allocated in chunks
+// as rows are read, instead of allocating the expected number of rows up front.
 func newFieldValues[T any](name string, rowCount int, fn func(r *IonReader) (T, error)) *fieldValues {
-	values := make([]T, rowCount)
-	readFn := func(r *IonReader, index int) error {
+	var values []T
+
+	result := &fieldValues{Name: name}
+	result.FinishFn = func(rowCount int) any {
+		if len(values) < rowCount {
+			values = growValues(values, rowCount, rowCount)
+		}
+		return values[:rowCount]
+	}
+	result.ReadFn = func(r *IonReader, index int) error {
 		value, err := fn(r)
 		if err != nil {
-			return err
+			var warning *valueWarning
+			if !errors.As(err, &warning) {
+				return err
+			}
+			result.warn(warning)
+		}
+		if index >= len(values) {
+			values = growValues(values, index+1, rowCount)
 		}
 		values[index] = value
 		return nil
 	}
 
-	return &fieldValues{Name: name, Values: values, ReadFn: readFn}
+	return result
 }
 
-func readRowValues(reader *IonReader, index int, fieldValues []*fieldValues) error {
-	for reader.Next() {
-		name, err := reader.FieldName()
-		if err != nil {
-			return err
+// readColumnValues reads the values of the given column and releases the column vector. Native
+// values are handed over, if the field supports the conversion, and read from the ION encoding
+// otherwise.
+func readColumnValues(column *snellerColumn, field *fieldValues, symbols *ion.Symtab) error {
+	if column.vector == nil {
+		return nil
+	}
+	defer func() {
+		column.vector = nil
+	}()
+
+	if column.vector.spool == nil && field.ConvertFn != nil && field.ConvertFn(column.vector) {
+		return nil
+	}
+
+	return column.vector.spooled().replay(symbols, 0, readFieldValue(field, 0))
+}
+
+// readColumnRange reads the values of the rows of the given column from the given row on. Unlike
+// readColumnValues, the column vector is kept, so that more rows can be appended to it.
+func readColumnRange(column *snellerColumn, field *fieldValues, symbols *ion.Symtab, from int) error {
+	if column.vector == nil {
+		return nil
+	}
+
+	if column.vector.spool != nil {
+		return column.vector.spool.replay(symbols, from, readFieldValue(field, from))
+	}
+
+	view := column.vector.view(from)
+	if field.ConvertFn != nil && field.ConvertFn(view) {
+		return nil
+	}
+
+	return view.spooled().replay(symbols, 0, readFieldValue(field, 0))
+}
+
+// readFieldValue returns a function that reads the value of the given row into the row of the
+// field, which is offset by the given row.
+func readFieldValue(field *fieldValues, offset int) func(reader *IonReader, index int) error {
+	return func(reader *IonReader, index int) error {
+		if field.Err != nil {
+			return nil
 		}
 
-		for _, field := range fieldValues {
-			if name != field.Name {
-				continue
+		level := reader.depth()
+		err := field.ReadFn(reader, index-offset)
+		if err != nil {
+			if !field.Isolate {
+				return fmt.Errorf("field '%s' at row %d: %w", field.Name, index, err)
 			}
-
-			err := field.ReadFn(reader, index)
-			if err != nil {
-				return err
+			// Skip the remainder of the failed value
+			for reader.depth() > level {
+				if err := reader.StepOut(); err != nil {
+					return err
+				}
 			}
+			field.Err, field.ErrIndex = err, index-offset
 		}
+		return nil
 	}
+}
 
-	return reader.Error()
+// stepInFlattened steps into the current struct value and calls fn to process its fields.
+func stepInFlattened(reader *IonReader, fn func() error) error {
+	err := reader.StepIn()
+	if err != nil {
+		return err
+	}
+
+	err = fn()
+	if err != nil {
+		return err
+	}
+
+	return reader.StepOut()
 }
@@ -0,0 +1,541 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SnellerInc/sneller/ion"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// BenchmarkLargeResult measures the allocations of a result with 1M rows.
+func BenchmarkLargeResult(b *testing.B) {
+	const rowCount = 1_000_000
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	rows := make([]ion.Datum, rowCount)
+	for i := range rows {
+		rows[i] = row("time", start.Add(time.Duration(i)*time.Second), "value", i, "host", fmt.Sprintf("host%d", i%10))
+	}
+	result := encodeResult(rows, nil)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		frame, err := frameFromSnellerResult("A", "SELECT * FROM logs", bytes.NewReader(result), "time", 0, &snellerQuery{}, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if frame.Rows() != rowCount {
+			b.Fatalf("expected %d rows, got %d", rowCount, frame.Rows())
+		}
+	}
+}
+
+func TestSymbolColumn(t *testing.T) {
+	result := encodeResult([]ion.Datum{
+		row("status", ion.Interned(nil, "ok")),
+		row("status", ion.Interned(nil, "error")),
+		row("status", ion.Interned(nil, "ok")),
+	}, nil)
+
+	frame, err := frameFromSnellerResult("A", "SELECT status FROM logs", bytes.NewReader(result), "", 0, &snellerQuery{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []string{"ok", "error", "ok"} {
+		if value, _ := frame.Fields[0].ConcreteAt(i); value != expected {
+			t.Errorf("row %d: expected '%s', got %v", i, expected, value)
+		}
+	}
+}
+
+// BenchmarkLowCardinalityColumn measures the memory of a low-cardinality text column, which is
+// encoded as symbols or strings.
+func BenchmarkLowCardinalityColumn(b *testing.B) {
+	for _, bench := range []struct {
+		name  string
+		value func(s string) ion.Datum
+	}{
+		{"Symbols", func(s string) ion.Datum { return ion.Interned(nil, s) }},
+		{"Strings", ion.String},
+	} {
+		rows := make([]ion.Datum, 100_000)
+		for i := range rows {
+			rows[i] = row("status", bench.value(fmt.Sprintf("status_%d", i%5)))
+		}
+		result := encodeResult(rows, nil)
+
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := frameFromSnellerResult("A", "SELECT status FROM logs", bytes.NewReader(result), "", 0, &snellerQuery{}, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestNullableStringColumn(t *testing.T) {
+	result := encodeResult([]ion.Datum{
+		row("id", 1, "name", ""),
+		row("id", 2, "name", nil),
+		row("id", 3),
+		row("id", 4, "name", "x"),
+	}, nil)
+
+	frame, err := frameFromSnellerResult("A", "SELECT * FROM logs", bytes.NewReader(result), "", 0, &snellerQuery{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	field, _ := frame.FieldByName("name")
+	if field == nil {
+		t.Fatal("missing field 'name'")
+	}
+	if field.Type() != data.FieldTypeNullableString {
+		t.Fatalf("expected type %s, got %s", data.FieldTypeNullableString, field.Type())
+	}
+	for i, expected := range []*string{ptr(""), nil, nil, ptr("x")} {
+		value := field.At(i).(*string)
+		if (value == nil) != (expected == nil) || (value != nil && *value != *expected) {
+			t.Errorf("row %d: expected %v, got %v", i, expected, value)
+		}
+	}
+}
+
+func TestEmptyColumnNames(t *testing.T) {
+	result := encodeResult([]ion.Datum{
+		row("", 1, "a", 2, " ", 3),
+		row("", 4, "a", 5, " ", 6),
+	}, nil)
+
+	frame, err := frameFromSnellerResult("A", "SELECT * FROM logs", bytes.NewReader(result), "", 0, &snellerQuery{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []struct {
+		name   string
+		values string
+	}{
+		{"col_0", "[1 4]"},
+		{"a", "[2 5]"},
+		{"col_2", "[3 6]"},
+	} {
+		field := frame.Fields[i]
+		if field.Name != expected.name {
+			t.Errorf("field %d: expected name '%s', got '%s'", i, expected.name, field.Name)
+		}
+		if values := fmt.Sprint(concreteValues(field)); values != expected.values {
+			t.Errorf("field %d: expected values %s, got %s", i, expected.values, values)
+		}
+	}
+}
+
+func TestBoundaryTimestamps(t *testing.T) {
+	// The fixtures contain a regular timestamp, a leap second, a timestamp in year 0 and one in
+	// year 10000. The nullable fixture contains an additional null value.
+	for _, test := range []struct {
+		fixture  string
+		expected []any
+	}{
+		{"testdata/timestamps.ion", []any{
+			time.Date(2019, 6, 15, 12, 30, 45, 0, time.UTC),
+			time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+			minTime,
+			maxTime,
+		}},
+		{"testdata/timestamps_nullable.ion", []any{
+			time.Date(2019, 6, 15, 12, 30, 45, 0, time.UTC),
+			time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+			nil,
+			nil,
+			nil,
+		}},
+	} {
+		t.Run(test.fixture, func(t *testing.T) {
+			f, err := os.Open(test.fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			frame, err := frameFromSnellerResult("A", "SELECT time FROM logs", f, "time", 0, &snellerQuery{}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			values := concreteValues(frame.Fields[0])
+			if len(values) != len(test.expected) {
+				t.Fatalf("expected %d values, got %d", len(test.expected), len(values))
+			}
+			for i, expected := range test.expected {
+				if expected == nil && values[i] != nil || expected != nil && !expected.(time.Time).Equal(values[i].(time.Time)) {
+					t.Errorf("row %d: expected %v, got %v", i, expected, values[i])
+				}
+			}
+
+			if len(frame.Meta.Notices) != 1 || !strings.Contains(frame.Meta.Notices[0].Text, "2 value(s) of field 'time' were replaced") {
+				t.Errorf("expected a notice about 2 replaced values, got %v", frame.Meta.Notices)
+			}
+		})
+	}
+}
+
+func TestMixedSignIntegers(t *testing.T) {
+	for _, test := range []struct {
+		values   []any
+		typ      data.FieldType
+		expected string
+	}{
+		{[]any{uint64(1), uint64(2), -3}, data.FieldTypeInt8, "[1 2 -3]"},
+		{[]any{-3, uint64(1), uint64(40000)}, data.FieldTypeInt32, "[-3 1 40000]"},
+		{[]any{uint64(1), uint64(math.MaxInt64), -1}, data.FieldTypeInt64, "[1 9223372036854775807 -1]"},
+		{[]any{uint64(1), uint64(2)}, data.FieldTypeUint8, "[1 2]"},
+	} {
+		var rows []ion.Datum
+		for _, value := range test.values {
+			rows = append(rows, row("value", value))
+		}
+		result := encodeResult(rows, nil)
+
+		frame, err := frameFromSnellerResult("A", "SELECT value FROM logs", bytes.NewReader(result), "", 0, &snellerQuery{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		field := frame.Fields[0]
+		if field.Type() != test.typ {
+			t.Errorf("%v: expected type %s, got %s", test.values, test.typ, field.Type())
+		}
+		if values := fmt.Sprint(concreteValues(field)); values != test.expected {
+			t.Errorf("%v: expected values %s, got %s", test.values, test.expected, values)
+		}
+	}
+}
+
+func TestFractionalTimestamps(t *testing.T) {
+	// 2023-01-01T12:30:45 with the given fraction exponent and coefficient
+	timestamp := func(exponent byte, coefficient ...byte) ion.Datum {
+		body := append([]byte{0x80, 0x0f, 0xe7, 0x81, 0x81, 0x8c, 0x9e, 0xad, 0xc0 | exponent}, coefficient...)
+		buf := []byte{0x60 | byte(len(body))}
+		if len(body) >= 14 {
+			buf = []byte{0x6e, 0x80 | byte(len(body))}
+		}
+		value, _, err := ion.ReadDatum(nil, append(buf, body...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+
+	for _, test := range []struct {
+		name     string
+		value    ion.Datum
+		expected int
+	}{
+		{"Milliseconds", timestamp(3, 0x7b), 123_000_000},
+		{"Microseconds", timestamp(6, 0x01, 0xe2, 0x40), 123_456_000},
+		{"Nanoseconds", timestamp(9, 0x07, 0x5b, 0xcd, 0x15), 123_456_789},
+		{"Picoseconds", timestamp(12, 0x1c, 0xbe, 0x99, 0x1a, 0x14), 123_456_789},
+	} {
+		result := encodeResult([]ion.Datum{row("time", test.value)}, nil)
+
+		frame, err := frameFromSnellerResult("A", "SELECT time FROM logs", bytes.NewReader(result), "time", 0, &snellerQuery{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := time.Date(2023, 1, 1, 12, 30, 45, test.expected, time.UTC)
+		value, _ := frame.Fields[0].ConcreteAt(0)
+		if actual, ok := value.(time.Time); !ok || !actual.Equal(expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, expected, value)
+		}
+	}
+}
+
+func TestCorruptedResult(t *testing.T) {
+	result := encodeResult([]ion.Datum{
+		row("host", "a", "status", 200),
+		row("host", "b", "status", 500),
+		row("host", "c", "status", 200),
+	}, nil)
+
+	// The second row starts after the first one, i.e. 5 bytes after its value 'a'. The type of
+	// its first value is replaced by the reserved type 15.
+	second := bytes.Index(result, []byte{0x81, 'a'}) + 5
+	invalidType := append([]byte(nil), result...)
+	invalidType[second+2] = 0xf1
+
+	for name, input := range map[string][]byte{
+		"Truncated":   result[:second+4],
+		"InvalidType": invalidType,
+	} {
+		frame, err := frameFromSnellerResult("A", "SELECT * FROM logs", bytes.NewReader(input), "", 0, &snellerQuery{}, nil)
+		if err == nil {
+			t.Errorf("%s: expected an error, got a frame with %d rows", name, frame.Rows())
+		}
+	}
+}
+
+func TestMissingFinalStatus(t *testing.T) {
+	// Reproduces the inputs of a panic in deriveSchema, which dereferenced the missing final
+	// status of incomplete results with type pinning enabled
+	queryError := ion.Annotation(&ion.Symtab{}, "query_error", row("error", "out of memory"))
+	for name, input := range map[string][]byte{
+		"Empty":      nil,
+		"RowsOnly":   encodeRows(row("host", "a", "status", 200)),
+		"QueryError": encodeRows(row("host", "a", "status", 200), queryError),
+	} {
+		for _, options := range []*snellerQuery{
+			{},
+			{PinTypes: true},
+			{PinTypes: true, FlattenObjects: true},
+		} {
+			schema, err := deriveSchema(NewReader(bytes.NewReader(input), 1024), "SELECT * FROM logs", options, nil)
+			if err == nil {
+				t.Errorf("%s: expected an error, got a schema with status %v", name, schema.FinalStatus)
+			}
+
+			frame, err := frameFromSnellerResult("A", "SELECT * FROM logs", bytes.NewReader(input), "", 0, options, nil)
+			if err == nil {
+				t.Errorf("%s: expected an error, got a frame with %d rows", name, frame.Rows())
+			}
+			if name == "QueryError" && (err == nil || !strings.Contains(err.Error(), "out of memory")) {
+				t.Errorf("%s: expected the query error, got %v", name, err)
+			}
+		}
+	}
+}
+
+// encodeRawValues encodes a result with a single column, whose values are given as raw ION.
+func encodeRawValues(name string, values ...[]byte) []byte {
+	var symbols ion.Symtab
+	var body ion.Buffer
+	sym := symbols.Intern(name)
+	for _, value := range values {
+		body.BeginStruct(-1)
+		body.BeginField(sym)
+		body.UnsafeAppend(value)
+		body.EndStruct()
+	}
+	ion.Annotation(&symbols, "final_status", ion.NewStruct(&symbols, nil).Datum()).Encode(&body, &symbols)
+
+	var result ion.Buffer
+	symbols.Marshal(&result, true)
+	result.UnsafeAppend(body.Bytes())
+	return result.Bytes()
+}
+
+func TestIntegerOverflow(t *testing.T) {
+	maxUint64 := []byte{0x28, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	maxUint64Plus1 := []byte{0x29, 0x01, 0, 0, 0, 0, 0, 0, 0, 0}
+	one := []byte{0x21, 0x01}
+	minusOne := []byte{0x31, 0x01}
+
+	for _, test := range []struct {
+		name     string
+		values   [][]byte
+		typ      data.FieldType
+		expected string
+	}{
+		{"MaxUint64", [][]byte{maxUint64, one}, data.FieldTypeUint64, "[18446744073709551615 1]"},
+		{"MaxUint64AndNegative", [][]byte{maxUint64, minusOne}, data.FieldTypeFloat64, "[1.8446744073709552e+19 -1]"},
+		{"MaxUint64+1", [][]byte{maxUint64Plus1, one}, data.FieldTypeFloat64, "[1.8446744073709552e+19 1]"},
+	} {
+		result := encodeRawValues("value", test.values...)
+		frame, err := frameFromSnellerResult("A", "SELECT value FROM logs", bytes.NewReader(result), "", 0, &snellerQuery{}, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		field := frame.Fields[0]
+		if field.Type() != test.typ {
+			t.Errorf("%s: expected type %s, got %s", test.name, test.typ, field.Type())
+		}
+		if values := fmt.Sprint(concreteValues(field)); values != test.expected {
+			t.Errorf("%s: expected values %s, got %s", test.name, test.expected, values)
+		}
+	}
+}
+
+func TestDataAfterFinalStatus(t *testing.T) {
+	result := encodeResult([]ion.Datum{row("host", "a")}, nil)
+
+	// A symbol table append after the final status
+	var symbols ion.Symtab
+	symbols.Intern("host")
+	start := symbols.MaxID()
+	symbols.Intern("extra")
+	var appended ion.Buffer
+	symbols.MarshalPart(&appended, ion.Symbol(start))
+
+	for _, test := range []struct {
+		name    string
+		trailer []byte
+		valid   bool
+	}{
+		{"NopPad", []byte{0x00, 0x03, 0x00, 0x00, 0x00}, true},
+		{"EmptyChunk", encodeRows(), true},
+		{"SymtabAppend", appended.Bytes(), true},
+		{"Row", encodeRows(row("host", "b")), false},
+	} {
+		input := append(append([]byte(nil), result...), test.trailer...)
+		_, err := frameFromSnellerResult("A", "SELECT host FROM logs", bytes.NewReader(input), "", 0, &snellerQuery{}, nil)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+		if !test.valid && (err == nil || !strings.Contains(err.Error(), "unexpected data after ::final_status")) {
+			t.Errorf("%s: expected an error about unexpected data, got %v", test.name, err)
+		}
+	}
+}
+
+func TestColumnVectorConversions(t *testing.T) {
+	for _, test := range []struct {
+		values   []any
+		typ      data.FieldType
+		expected string
+	}{
+		{[]any{uint64(1), uint64(math.MaxUint64)}, data.FieldTypeUint64, "[1 18446744073709551615]"},
+		{[]any{-1, 1.5}, data.FieldTypeFloat64, "[-1 1.5]"},
+		{[]any{1.5, uint64(2)}, data.FieldTypeFloat64, "[1.5 2]"},
+		{[]any{uint64(1 << 60), 0.5}, data.FieldTypeFloat64, "[1.152921504606847e+18 0.5]"},
+		{[]any{-1, uint64(math.MaxUint64)}, data.FieldTypeFloat64, "[-1 1.8446744073709552e+19]"},
+		{[]any{nil, true, false}, data.FieldTypeNullableBool, "[<nil> true false]"},
+		{[]any{nil, nil}, data.FieldTypeNullableJSON, "[null null]"},
+	} {
+		var rows []ion.Datum
+		for _, value := range test.values {
+			rows = append(rows, row("value", value))
+		}
+		result := encodeResult(rows, nil)
+
+		frame, err := frameFromSnellerResult("A", "SELECT value FROM logs", bytes.NewReader(result), "", 0, &snellerQuery{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		field := frame.Fields[0]
+		if field.Type() != test.typ {
+			t.Errorf("%v: expected type %s, got %s", test.values, test.typ, field.Type())
+		}
+		values := concreteValues(field)
+		for i, value := range values {
+			if raw, ok := value.(json.RawMessage); ok {
+				values[i] = string(raw)
+			}
+		}
+		if actual := fmt.Sprint(values); actual != test.expected {
+			t.Errorf("%v: expected values %s, got %s", test.values, test.expected, actual)
+		}
+	}
+}
+
+func TestLateColumn(t *testing.T) {
+	result := encodeResult([]ion.Datum{
+		row("id", 1),
+		row("id", 2),
+		row("id", 3, "name", "x", "count", nil),
+		row("id", 4, "count", uint64(5)),
+	}, nil)
+
+	frame, err := frameFromSnellerResult("A", "SELECT * FROM logs", bytes.NewReader(result), "", 0, &snellerQuery{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"name":  "[<nil> <nil> x <nil>]",
+		"count": "[<nil> <nil> <nil> 5]",
+	} {
+		field, _ := frame.FieldByName(name)
+		if field == nil {
+			t.Fatalf("missing field '%s'", name)
+		}
+		if !field.Nullable() {
+			t.Errorf("%s: expected nullable field, got %s", name, field.Type())
+		}
+		if values := fmt.Sprint(concreteValues(field)); values != expected {
+			t.Errorf("%s: expected values %s, got %s", name, expected, values)
+		}
+	}
+}
+
+func TestMixedColumnAfterNativeValues(t *testing.T) {
+	// 2023-01-01T12:30:45.123456789Z
+	timestamp, _, err := ion.ReadDatum(nil, []byte{0x6d, 0x80, 0x0f, 0xe7, 0x81, 0x81, 0x8c, 0x9e, 0xad, 0xc9, 0x07, 0x5b, 0xcd, 0x15})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := encodeResult([]ion.Datum{
+		row("value", timestamp),
+		row("value", nil),
+		row("id", 3),
+		row("value", "x"),
+	}, nil)
+
+	frame, err := frameFromSnellerResult("A", "SELECT value FROM logs", bytes.NewReader(result), "", 0, &snellerQuery{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	field, _ := frame.FieldByName("value")
+	if field == nil {
+		t.Fatal("missing field 'value'")
+	}
+	var values []string
+	for _, value := range concreteValues(field) {
+		if raw, ok := value.(json.RawMessage); ok {
+			values = append(values, string(raw))
+		} else {
+			values = append(values, fmt.Sprint(value))
+		}
+	}
+	expected := `["2023-01-01T12:30:45.123456789Z" null <nil> "x"]`
+	if actual := fmt.Sprint(values); actual != expected {
+		t.Errorf("expected values %s, got %s", expected, actual)
+	}
+}
+
+func TestSelectColumns(t *testing.T) {
+	for _, test := range []struct {
+		sql      string
+		expected string
+	}{
+		{"SELECT a, b FROM t", `["a" "b"]`},
+		{"select a as x, b As y from t", `["x" "y"]`},
+		{"SELECT\n\ta,\n\tb\nFROM t", `["a" "b"]`},
+		{"SELECT DISTINCT a, b FROM t", `["a" "b"]`},
+		{`SELECT a AS x, COUNT(*) AS "count", b.c, "d"."e f" FROM t`, `["x" "count" "c" "e f"]`},
+		{"SELECT COALESCE(a, (b + c), d) AS v, e FROM t", `["v" "e"]`},
+		{"SELECT CAST(a AS STRING), a + 1, b FROM t", `["" "" "b"]`},
+		{"SELECT 'a, b FROM c' AS s, x FROM t", `["s" "x"]`},
+		{`SELECT 'it\'s, (x' AS s, y FROM t`, `["s" "y"]`},
+		{`SELECT 'C:\\' AS s, y FROM t`, `["s" "y"]`},
+		{`SELECT "weird, name", "from" FROM t`, `["weird, name" "from"]`},
+		{"SELECT `{a: 1, b: 2}` AS ion, c FROM t", `["ion" "c"]`},
+		{"SELECT fromage, a FROM t", `["fromage" "a"]`},
+		{"SELECT *, a FROM t", `["*" "a"]`},
+		{"SELECT t.* FROM t", `["*"]`},
+		{"SELECT * FROM (SELECT a, b AS c FROM t) WHERE a > 1", `["a" "c"]`},
+		{"SELECT * FROM (SELECT * FROM (SELECT a FROM t))", `["a"]`},
+		{"SELECT a, (SELECT MAX(b) FROM u) AS m FROM t", `["a" "m"]`},
+		{"SELECT 1", `[""]`},
+	} {
+		columns := selectColumns(test.sql)
+		if columns == nil {
+			t.Errorf("%s: expected columns", test.sql)
+			continue
+		}
+		if actual := fmt.Sprintf("%q", columns); actual != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.sql, test.expected, actual)
+		}
+	}
+
+	for _, sql := range []string{"", "SHOW TABLES", "WITH x AS (SELECT 1) SELECT * FROM x", "SELECTION"} {
+		if columns := selectColumns(sql); columns != nil {
+			t.Errorf("%s: expected no columns, got %v", sql, columns)
+		}
+	}
+}
@@ -2,9 +2,13 @@ package plugin
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"strconv"
+	"time"
 
 	"github.com/SnellerInc/sneller/date"
 	"github.com/SnellerInc/sneller/ion"
@@ -15,10 +19,14 @@ type IonReader struct {
 	// Symbols is the current symbol table.
 	// Calls to IonReader.Next will update the symbol table as symbol table annotations are
 	// encountered in the source data stream.
-	Symbols ion.Symtab
-	ctx     *ionContext
-	buf     []byte
-	stack   []*ionContext
+	Symbols  ion.Symtab
+	ctx      *ionContext
+	buf      []byte
+	stack    []*ionContext
+	symtabs  *SymtabCache
+	cacheKey string
+	catalog  *SymbolCatalog
+	started  bool
 }
 
 type ionContext struct {
@@ -70,11 +78,31 @@ func NewReader(r io.Reader, max int) *IonReader {
 	return &IonReader{ctx: &ctx} // TODO: , buf: make([]byte, 0, max)
 }
 
+// newBufferedReader constructs a reader that reads values from the given buffer. The buffer must
+// not contain symbol tables. Symbols are resolved using a copy of the given symbol table.
+func newBufferedReader(buf []byte, symbols *ion.Symtab) *IonReader {
+	r := &IonReader{
+		ctx: &ionContext{
+			src: &bufferReader{buf: buf},
+			typ: ion.InvalidType,
+		},
+		started: true,
+	}
+	symbols.CloneInto(&r.Symbols)
+	return r
+}
+
 // Next moves the internal iterator to the next value. Error should be checked, if this function
 // return false to determine if an error occurred or the end of the iterator is reached.
 func (r *IonReader) Next() bool {
 	if r.ctx.size != 0 {
-		r.ctx.src.Discard(r.ctx.size)
+		n, _ := r.ctx.src.Discard(r.ctx.size)
+		if n < r.ctx.size {
+			// The previous value is truncated
+			r.ctx.size = 0
+			r.ctx.err = io.ErrUnexpectedEOF
+			goto handleError
+		}
 	}
 
 	if r.inStruct() {
@@ -99,32 +127,54 @@ func (r *IonReader) Next() bool {
 
 	r.ctx.annotations = nil
 
+	if !r.started {
+		r.started = true
+		r.skipPrefix()
+	}
+
 	for {
+		if len(r.stack) == 0 {
+			r.ctx.err = r.skipBVM()
+			if r.ctx.err != nil {
+				goto handleError
+			}
+		}
+
 		r.ctx.typ, r.ctx.size, r.ctx.err = ionPeek(r.ctx.src)
 		if r.ctx.err != nil {
 			goto handleError
 		}
 
+		if len(r.stack) == 0 && r.isNopPad() {
+			// Padding between top-level values (e.g. after the final status) is not a value
+			r.ctx.src.Discard(r.ctx.size)
+			continue
+		}
+
 		if r.ctx.typ != ion.AnnotationType {
 			break
 		}
 
 		buf, err := r.ctx.src.Peek(r.ctx.size)
 		if err != nil {
+			if errors.Is(err, io.EOF) {
+				// The annotation is truncated
+				err = io.ErrUnexpectedEOF
+			}
 			r.ctx.err = err
 			goto handleError
 		}
 
 		var rest []byte
 		if r.isSymtab(buf) {
-			rest, r.ctx.err = r.Symbols.Unmarshal(buf)
+			rest, r.ctx.err = r.unmarshalSymtab(buf)
 			if r.ctx.err != nil {
 				goto handleError
 			}
 		} else {
 			var sym ion.Symbol
 			sym, rest, _, r.ctx.err = ion.ReadAnnotation(buf)
-			if err != nil {
+			if r.ctx.err != nil {
 				goto handleError
 			}
 			// TODO: Sneller ION library only returns the first label at the moment...
@@ -145,6 +195,19 @@ handleError:
 	return true
 }
 
+// UseSymtabCache configures the reader to warm-start from symbol tables stored in the given
+// cache under the given key. Symbol tables parsed by the reader are stored in the cache as well.
+func (r *IonReader) UseSymtabCache(cache *SymtabCache, key string) {
+	r.symtabs = cache
+	r.cacheKey = key
+}
+
+// UseCatalog configures the reader to resolve shared symbol table imports using the given
+// catalog.
+func (r *IonReader) UseCatalog(catalog *SymbolCatalog) {
+	r.catalog = catalog
+}
+
 // Error returns any error occurred in the Next function.
 func (r *IonReader) Error() error {
 	return r.ctx.err
@@ -168,8 +231,8 @@ func (r *IonReader) StepIn() error {
 	}
 
 	body, _ := ion.Contents(r.buf)
-	if len(body) == 0 {
-		return io.EOF
+	if body == nil {
+		return fmt.Errorf("invalid %s value", r.ctx.typ)
 	}
 	r.discard()
 
@@ -194,6 +257,20 @@ func (r *IonReader) StepOut() error {
 	return nil
 }
 
+// raw returns the encoded bytes of the current value.
+func (r *IonReader) raw() ([]byte, error) {
+	err := r.peek()
+	if err != nil {
+		return nil, err
+	}
+	return r.buf, nil
+}
+
+// depth returns the number of nested structs and lists the reader has stepped into.
+func (r *IonReader) depth() int {
+	return len(r.stack)
+}
+
 // FieldName returns the name of the current field, when inside a struct.
 func (r *IonReader) FieldName() (string, error) {
 	if r.ctx.label == nil {
@@ -260,6 +337,11 @@ func (r *IonReader) ReadNullableBool() (*bool, error) {
 	return &value, nil
 }
 
+// errIntegerOverflow is returned when reading an integer that does not fit into the result type.
+var errIntegerOverflow = errors.New("integer out of range")
+
+// ReadUint reads an unsigned integer value. Fails with errIntegerOverflow, if the value does not
+// fit into an uint64.
 func (r *IonReader) ReadUint() (uint64, error) {
 	var value uint64
 	err := r.checkType(ion.UintType)
@@ -270,6 +352,10 @@ func (r *IonReader) ReadUint() (uint64, error) {
 	if err != nil {
 		return value, err
 	}
+	if body, _ := ion.Contents(r.buf); len(body) > 8 {
+		r.discard()
+		return value, fmt.Errorf("%w: %d bytes exceed uint64", errIntegerOverflow, len(body))
+	}
 	value, _, err = ion.ReadUint(r.buf)
 	r.discard()
 	return value, err
@@ -287,6 +373,8 @@ func (r *IonReader) ReadNullableUint() (*uint64, error) {
 	return &value, nil
 }
 
+// ReadInt reads a signed or unsigned integer value. Fails with errIntegerOverflow, if the value
+// does not fit into an int64.
 func (r *IonReader) ReadInt() (int64, error) {
 	var value int64
 	err := r.checkTypes("integer", ion.UintType, ion.IntType)
@@ -297,11 +385,52 @@ func (r *IonReader) ReadInt() (int64, error) {
 	if err != nil {
 		return value, err
 	}
+	body, _ := ion.Contents(r.buf)
+	limit := uint64(math.MaxInt64)
+	if r.ctx.typ == ion.IntType {
+		limit++
+	}
+	if len(body) > 8 || ionIntMagnitude(body) > limit {
+		r.discard()
+		return value, fmt.Errorf("%w: %s exceeds int64", errIntegerOverflow, formatIonInt(r.ctx.typ, body))
+	}
 	value, _, err = ion.ReadInt(r.buf)
 	r.discard()
 	return value, err
 }
 
+// ionIntMagnitude returns the magnitude of the given integer body, which must not exceed 8 bytes.
+func ionIntMagnitude(body []byte) uint64 {
+	var magnitude uint64
+	for _, b := range body {
+		magnitude = magnitude<<8 | uint64(b)
+	}
+	return magnitude
+}
+
+// ionIntFloat returns the given integer body of any size as a (possibly rounded) float64.
+func ionIntFloat(typ ion.Type, body []byte) float64 {
+	var value float64
+	for _, b := range body {
+		value = value*256 + float64(b)
+	}
+	if typ == ion.IntType {
+		value = -value
+	}
+	return value
+}
+
+// formatIonInt formats the given integer body for error messages.
+func formatIonInt(typ ion.Type, body []byte) string {
+	if len(body) <= 8 {
+		if typ == ion.IntType {
+			return "-" + strconv.FormatUint(ionIntMagnitude(body), 10)
+		}
+		return strconv.FormatUint(ionIntMagnitude(body), 10)
+	}
+	return strconv.FormatFloat(ionIntFloat(typ, body), 'g', -1, 64)
+}
+
 func (r *IonReader) ReadNullableInt() (*int64, error) {
 	if r.ctx.typ == ion.NullType {
 		r.discard()
@@ -341,6 +470,33 @@ func (r *IonReader) ReadNullableFloat() (*float64, error) {
 	return &value, nil
 }
 
+func (r *IonReader) ReadDecimal() (Decimal, error) {
+	var value Decimal
+	err := r.checkType(ion.DecimalType)
+	if err != nil {
+		return value, err
+	}
+	err = r.peek()
+	if err != nil {
+		return value, err
+	}
+	value, err = readDecimal(r.buf)
+	r.discard()
+	return value, err
+}
+
+func (r *IonReader) ReadNullableDecimal() (*Decimal, error) {
+	if r.ctx.typ == ion.NullType {
+		r.discard()
+		return nil, nil
+	}
+	value, err := r.ReadDecimal()
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
 func (r *IonReader) ReadTimestamp() (date.Time, error) {
 	var value date.Time
 	err := r.checkType(ion.TimestampType)
@@ -352,6 +508,13 @@ func (r *IonReader) ReadTimestamp() (date.Time, error) {
 		return value, err
 	}
 	value, _, err = ion.ReadTime(r.buf)
+	if err == nil {
+		// The Sneller ION library only supports fractional seconds with a precision of exactly
+		// microseconds or nanoseconds and drops all other fractions
+		if nsec, ok := timestampNanos(r.buf); ok && nsec != value.Nanosecond() {
+			value = value.Add(time.Duration(nsec - value.Nanosecond()))
+		}
+	}
 	r.discard()
 	return value, err
 }
@@ -410,6 +573,22 @@ func (r *IonReader) ReadString() (string, error) {
 	return value, err
 }
 
+// readStringShared reads a string value without copying it. The returned bytes are only valid
+// until the reader moves to the next value.
+func (r *IonReader) readStringShared() ([]byte, error) {
+	err := r.checkType(ion.StringType)
+	if err != nil {
+		return nil, err
+	}
+	err = r.peek()
+	if err != nil {
+		return nil, err
+	}
+	value, _, err := ion.ReadStringShared(r.buf)
+	r.discard()
+	return value, err
+}
+
 func (r *IonReader) ReadNullableString() (*string, error) {
 	if r.ctx.typ == ion.NullType {
 		r.discard()
@@ -422,6 +601,7 @@ func (r *IonReader) ReadNullableString() (*string, error) {
 	return &value, nil
 }
 
+// ReadBytes reads a blob value. Empty blobs are returned as empty, non-nil slices.
 func (r *IonReader) ReadBytes() ([]byte, error) {
 	var value []byte
 	err := r.checkType(ion.BlobType)
@@ -434,42 +614,58 @@ func (r *IonReader) ReadBytes() ([]byte, error) {
 	}
 	value, _, err = ion.ReadBytes(r.buf)
 	r.discard()
-	return value, err
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
 }
 
+// ReadNullableBytes reads a nullable blob value. Unlike the other nullable values, blobs are not
+// returned as pointers, as null values are returned as nil slices, which are distinct from the
+// empty slices returned for empty blobs.
 func (r *IonReader) ReadNullableBytes() ([]byte, error) {
 	if r.ctx.typ == ion.NullType {
 		r.discard()
 		return nil, nil
 	}
-	return r.ReadBytes()
+	value, err := r.ReadBytes()
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
 }
 
 // ReadNumber reads any numeric value and returns it as a float64. Fails, if the current value
-// is not of type ion.UintType, ion.IntType or ion.FloatType.
+// is not of type ion.UintType, ion.IntType, ion.FloatType or ion.DecimalType.
 func (r *IonReader) ReadNumber() (float64, error) {
 	switch r.ctx.typ {
-	case ion.UintType:
-		temp, err := r.ReadUint()
+	case ion.UintType, ion.IntType:
+		// Integers of any size are supported, but large values are rounded
+		err := r.peek()
 		if err != nil {
 			return 0, err
 		}
-		return float64(temp), nil
-	case ion.IntType:
-		temp, err := r.ReadInt()
-		if err != nil {
-			return 0, err
+		body, _ := ion.Contents(r.buf)
+		r.discard()
+		if body == nil {
+			return 0, errors.New("invalid integer value")
 		}
-		return float64(temp), nil
+		return ionIntFloat(r.ctx.typ, body), nil
 	case ion.FloatType:
 		return r.ReadFloat()
+	case ion.DecimalType:
+		temp, err := r.ReadDecimal()
+		if err != nil {
+			return 0, err
+		}
+		return temp.Float64(), nil
 	}
 
-	return 0, r.checkTypes("numeric", ion.UintType, ion.IntType, ion.FloatType)
+	return 0, r.checkTypes("numeric", ion.UintType, ion.IntType, ion.FloatType, ion.DecimalType)
 }
 
 // ReadNullableNumber reads any numeric value and returns it as a *float64. Fails, if the current
-// value is not of type ion.NullType, ion.UintType, ion.IntType or ion.FloatType.
+// value is not of type ion.NullType, ion.UintType, ion.IntType, ion.FloatType or ion.DecimalType.
 func (r *IonReader) ReadNullableNumber() (*float64, error) {
 	if r.ctx.typ == ion.NullType {
 		r.discard()
@@ -537,6 +733,8 @@ func (r *IonReader) ReadValue() (any, error) {
 		value, err = r.ReadInt()
 	case ion.FloatType:
 		value, err = r.ReadFloat()
+	case ion.DecimalType:
+		value, err = r.ReadDecimal()
 	case ion.TimestampType:
 		temp, err := r.ReadTimestamp()
 		if err == nil {
@@ -652,6 +850,10 @@ func (r *IonReader) LookupSymbol(sym ion.Symbol) (string, error) {
 }
 
 func (r *IonReader) peek() error {
+	if r.ctx.err != nil {
+		// The current value could not be decoded
+		return r.ctx.err
+	}
 	if r.ctx.size == 0 {
 		// Return gracefully to allow subsequent reads of the same value
 		return nil
@@ -660,6 +862,10 @@ func (r *IonReader) peek() error {
 	var err error
 	r.buf, err = r.ctx.src.Peek(r.ctx.size)
 	if err != nil {
+		if errors.Is(err, io.EOF) {
+			// The value is truncated
+			return io.ErrUnexpectedEOF
+		}
 		return err
 	}
 
@@ -696,13 +902,136 @@ func (r *IonReader) inStruct() bool {
 }
 
 func (r *IonReader) isSymtab(buf []byte) bool {
-	if ion.IsBVM(buf) {
-		return true
-	}
 	lbl, _, _, _ := ion.ReadAnnotation(buf)
 	return lbl == ion.SystemSymSymbolTable
 }
 
+// unmarshalSymtab updates the current symbol table from the symbol table annotation in buf.
+// Only symbol tables that directly follow a BVM are looked up in (and stored to) the symbol
+// table cache, as incremental symbol table appends depend on the previous state.
+func (r *IonReader) unmarshalSymtab(buf []byte) ([]byte, error) {
+	// Incremental appends extend the current symbol table in place. This is the common case for
+	// results with many dynamic keys, so skip the import resolution and cache lookup altogether.
+	if r.Symbols.MaxID() > ion.MinimumID("") && isSymtabAppend(buf) {
+		return r.Symbols.Unmarshal(buf)
+	}
+
+	// Symbol tables containing nothing but the system symbols have just been reset
+	cacheable := r.symtabs != nil && r.Symbols.MaxID() == ion.MinimumID("")
+	if cacheable && r.symtabs.load(r.cacheKey, buf, &r.Symbols) {
+		return buf[len(buf):], nil
+	}
+
+	imports, err := readSymtabImports(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var rest []byte
+	if imports != nil {
+		rest, err = r.unmarshalSharedSymtab(buf, imports)
+	} else {
+		rest, err = r.Symbols.Unmarshal(buf)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cacheable {
+		r.symtabs.store(r.cacheKey, buf[:len(buf)-len(rest)], &r.Symbols)
+	}
+
+	return rest, nil
+}
+
+// unmarshalSharedSymtab replaces the current symbol table with the symbol table annotation in
+// buf, which imports the given shared symbol tables. The Sneller ION library does not support
+// shared symbol tables, so the imported symbols are resolved from the catalog and prepended to
+// the local symbols.
+func (r *IonReader) unmarshalSharedSymtab(buf []byte, imports []symtabImport) ([]byte, error) {
+	symbols, err := resolveSymtabImports(r.catalog, imports)
+	if err != nil {
+		return nil, err
+	}
+
+	var local ion.Symtab
+	rest, err := local.Unmarshal(buf)
+	if err != nil {
+		return nil, err
+	}
+	for id := ion.MinimumID(""); id < local.MaxID(); id++ {
+		symbols = append(symbols, local.Get(ion.Symbol(id)))
+	}
+
+	var resolved ion.Buffer
+	resolved.BeginAnnotation(1)
+	resolved.BeginField(ion.SystemSymSymbolTable)
+	resolved.BeginStruct(-1)
+	resolved.BeginField(ion.SystemSymSymbols)
+	resolved.BeginList(-1)
+	for _, symbol := range symbols {
+		resolved.WriteString(symbol)
+	}
+	resolved.EndList()
+	resolved.EndStruct()
+	resolved.EndAnnotation()
+
+	r.Symbols.Reset()
+	_, err = r.Symbols.Unmarshal(resolved.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return rest, nil
+}
+
+// maxPrefixLength is the maximum number of bytes skipped by skipPrefix.
+const maxPrefixLength = 64
+
+// skipPrefix discards a UTF-8 byte order mark and any whitespace at the start of the stream, as
+// long as they are followed by a BVM. Such prefixes are occasionally added by misbehaving
+// proxies.
+func (r *IonReader) skipPrefix() {
+	buf, _ := r.ctx.src.Peek(maxPrefixLength)
+	n := 0
+	if bytes.HasPrefix(buf, []byte{0xef, 0xbb, 0xbf}) {
+		n = 3
+	}
+	for n < len(buf) && (buf[n] == ' ' || buf[n] == '\t' || buf[n] == '\r' || buf[n] == '\n') {
+		n++
+	}
+	if n != 0 && ion.IsBVM(buf[n:]) {
+		r.ctx.src.Discard(n)
+	}
+}
+
+// skipBVM discards any number of consecutive binary version markers at the current position of
+// the top-level stream. A BVM resets the symbol table to the ION system symbols, regardless of
+// whether it is followed by a new symbol table or a plain value.
+func (r *IonReader) skipBVM() error {
+	for {
+		buf, err := r.ctx.src.Peek(4)
+		if !ion.IsBVM(buf) {
+			if len(buf) == 0 {
+				return err
+			}
+			return nil
+		}
+		r.Symbols.Reset()
+		r.ctx.src.Discard(4)
+	}
+}
+
+// isNopPad returns true, if the current value is a NOP pad, which is a null value with a length
+// other than that of 'null'.
+func (r *IonReader) isNopPad() bool {
+	if r.ctx.typ != ion.NullType {
+		return false
+	}
+	buf, _ := r.ctx.src.Peek(1)
+	return len(buf) > 0 && buf[0]&0xf0 == 0 && buf[0] != 0x0f
+}
+
 func ionPeek(r *bufferReader) (ion.Type, int, error) {
 	p, err := r.Peek(10)
 	if len(p) == 0 {
@@ -711,11 +1040,71 @@ func ionPeek(r *bufferReader) (ion.Type, int, error) {
 		}
 		return 0, 0, err
 	}
-	// drop BVM
-	prefix := 0
-	if ion.IsBVM(p) {
-		p = p[4:]
-		prefix = 4
+	typ, size := ion.TypeOf(p), ion.SizeOf(p)
+	if size <= 0 {
+		return 0, 0, fmt.Errorf("invalid %s value", typ)
+	}
+	if p[0]&0x0f == 0x0f && typ != ion.AnnotationType {
+		// Typed nulls (e.g. 'null.struct') are reported as plain nulls, so they are not read as
+		// empty containers or zero values
+		typ = ion.NullType
+	}
+	return typ, size, nil
+}
+
+// timestampNanos returns the fractional seconds of the given binary timestamp value in
+// nanoseconds. Fractions beyond nanosecond precision are truncated.
+func timestampNanos(buf []byte) (int, bool) {
+	body, _ := ion.Contents(buf)
+	if body == nil {
+		return 0, false
+	}
+
+	// Skip the offset, year, month, day, hour, minute and second fields, which are all
+	// variable-length integers terminated by a byte with the high bit set
+	for i := 0; i < 7; i++ {
+		n := 0
+		for n < len(body) && body[n]&0x80 == 0 {
+			n++
+		}
+		if n == len(body) {
+			return 0, false
+		}
+		body = body[n+1:]
+	}
+	if len(body) == 0 {
+		return 0, true
+	}
+
+	// Fraction exponent (VarInt)
+	exp, body, ok := readVarInt(body)
+	if !ok {
+		return 0, false
+	}
+
+	// Fraction coefficient (Int)
+	if len(body) > 8 || exp > 0 {
+		return 0, false
+	}
+	var coef uint64
+	for i, b := range body {
+		if i == 0 {
+			if b&0x80 != 0 {
+				return 0, false
+			}
+			b &= 0x7f
+		}
+		coef = coef<<8 | uint64(b)
+	}
+
+	for ; exp < -9; exp++ {
+		coef /= 10
+	}
+	for ; exp > -9; exp-- {
+		coef *= 10
+	}
+	if coef >= uint64(time.Second) {
+		return 0, false
 	}
-	return ion.TypeOf(p), ion.SizeOf(p) + prefix, nil
+	return int(coef), true
 }
@@ -0,0 +1,249 @@
+package plugin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/SnellerInc/sneller/ion"
+)
+
+// encodeDynamicKeys encodes rows that each add a new field name to the symbol table. The symbol
+// table is either extended with incremental appends or written again in full after a BVM. The
+// result ends with an empty final status.
+func encodeDynamicKeys(rowCount int, appends bool) []byte {
+	var symbols ion.Symtab
+	var result, body ion.Buffer
+	for i := 0; i < rowCount; i++ {
+		start := symbols.MaxID()
+		body.Reset()
+		row("value", i, fmt.Sprintf("key_%d", i), i).Encode(&body, &symbols)
+		if appends && i > 0 {
+			symbols.MarshalPart(&result, ion.Symbol(start))
+		} else {
+			symbols.Marshal(&result, true)
+		}
+		result.UnsafeAppend(body.Bytes())
+	}
+
+	start := symbols.MaxID()
+	body.Reset()
+	ion.Annotation(&symbols, "final_status", ion.NewStruct(&symbols, nil).Datum()).Encode(&body, &symbols)
+	symbols.MarshalPart(&result, ion.Symbol(start))
+	result.UnsafeAppend(body.Bytes())
+	return result.Bytes()
+}
+
+// readFieldNames reads the field names of all rows of the given result.
+func readFieldNames(result []byte) ([][]string, error) {
+	var names [][]string
+	reader := NewReader(bytes.NewReader(result), 1024*1024)
+	_, err := iterateRows(reader, func(reader *IonReader, _ int) error {
+		var row []string
+		for reader.Next() {
+			name, err := reader.FieldName()
+			if err != nil {
+				return err
+			}
+			row = append(row, name)
+		}
+		names = append(names, row)
+		return reader.Error()
+	})
+	return names, err
+}
+
+func TestReaderSymtabAppends(t *testing.T) {
+	names, err := readFieldNames(encodeDynamicKeys(100, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 100 {
+		t.Fatalf("expected 100 rows, got %d", len(names))
+	}
+	for i, row := range names {
+		expected := []string{"value", fmt.Sprintf("key_%d", i)}
+		if fmt.Sprint(row) != fmt.Sprint(expected) {
+			t.Errorf("row %d: expected fields %v, got %v", i, expected, row)
+		}
+	}
+}
+
+// BenchmarkSymtabAppends compares a stream with incremental symbol table appends to a stream,
+// which resets and writes the complete symbol table for every new symbol.
+func BenchmarkSymtabAppends(b *testing.B) {
+	for _, bench := range []struct {
+		name    string
+		appends bool
+	}{
+		{"Appends", true},
+		{"Resets", false},
+	} {
+		result := encodeDynamicKeys(2000, bench.appends)
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := readFieldNames(result)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestReaderBVMResets(t *testing.T) {
+	// Each chunk starts with a BVM and a new symbol table, which assigns the symbols in a
+	// different order. Chunks and the final status are separated by NOP pads.
+	var result []byte
+	result = append(result, encodeRows(row("a", 1, "b", "x"))...)
+	result = append(result, 0x00)
+	result = append(result, encodeRows(row("b", "y", "a", 2), row("c", true))...)
+	result = append(result, 0x02, 0x00, 0x00)
+	result = append(result, encodeResult(nil, nil)...)
+
+	names, err := readFieldNames(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "[[a b] [b a] [c]]"; fmt.Sprint(names) != expected {
+		t.Errorf("expected fields %s, got %v", expected, names)
+	}
+
+	frame, err := frameFromSnellerResult("A", "SELECT * FROM logs", bytes.NewReader(result), "", 0, &snellerQuery{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"a": "[1 2 <nil>]",
+		"b": "[x y <nil>]",
+		"c": "[<nil> <nil> true]",
+	} {
+		field, _ := frame.FieldByName(name)
+		if field == nil {
+			t.Fatalf("missing field '%s'", name)
+		}
+		if values := fmt.Sprint(concreteValues(field)); values != expected {
+			t.Errorf("%s: expected values %s, got %s", name, expected, values)
+		}
+	}
+}
+
+func TestReaderPrefix(t *testing.T) {
+	// The fixture starts with a UTF-8 BOM and a line break, followed by two rows
+	fixture, err := os.ReadFile("testdata/bom_prefix.ion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := encodeResult([]ion.Datum{row("host", "a", "status", 200)}, nil)
+
+	for name, input := range map[string][]byte{
+		"BOM":        fixture,
+		"Whitespace": append([]byte(" \t\n"), result...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			names, err := readFieldNames(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) == 0 || fmt.Sprint(names[0]) != "[host status]" {
+				t.Errorf("expected fields [host status], got %v", names)
+			}
+		})
+	}
+}
+
+func TestReaderInvalidPrefix(t *testing.T) {
+	// Only prefixes followed by a BVM are skipped
+	result := append([]byte("garbage"), encodeResult(nil, nil)...)
+	if _, err := readFieldNames(result); err == nil {
+		t.Error("expected an error for an invalid prefix")
+	}
+}
+
+func TestReaderSharedSymtabChunks(t *testing.T) {
+	// The second chunk reuses the symbol table of the first one without a BVM and appends the
+	// symbols of its new field
+	var symbols ion.Symtab
+	var result, chunk ion.Buffer
+	row("host", "a", "status", 200).Encode(&chunk, &symbols)
+	symbols.Marshal(&result, true)
+	result.UnsafeAppend(chunk.Bytes())
+
+	start := symbols.MaxID()
+	chunk.Reset()
+	row("host", "b", "status", 500).Encode(&chunk, &symbols)
+	row("host", "c", "region", "us").Encode(&chunk, &symbols)
+	ion.Annotation(&symbols, "final_status", ion.NewStruct(&symbols, nil).Datum()).Encode(&chunk, &symbols)
+	symbols.MarshalPart(&result, ion.Symbol(start))
+	result.UnsafeAppend(chunk.Bytes())
+
+	names, err := readFieldNames(result.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "[[host status] [host status] [host region]]"; fmt.Sprint(names) != expected {
+		t.Errorf("expected fields %s, got %v", expected, names)
+	}
+
+	schema, err := deriveSchema(NewReader(bytes.NewReader(result.Bytes()), 1024), "SELECT * FROM logs", &snellerQuery{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema.RowCount != 3 {
+		t.Errorf("expected 3 rows, got %d", schema.RowCount)
+	}
+	var columns []string
+	for _, col := range schema.Columns {
+		columns = append(columns, fmt.Sprintf("%s:%d", col.Name, col.Count))
+	}
+	if expected := "[host:3 status:2 region:1]"; fmt.Sprint(columns) != expected {
+		t.Errorf("expected columns %s, got %v", expected, columns)
+	}
+}
+
+func TestReadIntBoundaries(t *testing.T) {
+	const overflow = "overflow"
+	for _, test := range []struct {
+		name   string
+		raw    []byte
+		int    string
+		uint   string
+		number float64
+	}{
+		{"MaxInt64", []byte{0x28, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, "9223372036854775807", "9223372036854775807", math.MaxInt64},
+		{"MaxInt64+1", []byte{0x28, 0x80, 0, 0, 0, 0, 0, 0, 0}, overflow, "9223372036854775808", math.MaxInt64 + 1},
+		{"MinInt64", []byte{0x38, 0x80, 0, 0, 0, 0, 0, 0, 0}, "-9223372036854775808", "", math.MinInt64},
+		{"MinInt64-1", []byte{0x38, 0x80, 0, 0, 0, 0, 0, 0, 1}, overflow, "", math.MinInt64 - 1},
+		{"MaxUint64", []byte{0x28, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, overflow, "18446744073709551615", math.MaxUint64},
+		{"MaxUint64+1", []byte{0x29, 0x01, 0, 0, 0, 0, 0, 0, 0, 0}, overflow, overflow, math.MaxUint64 + 1},
+	} {
+		read := func(fn func(r *IonReader) (any, error)) string {
+			r := NewReader(bytes.NewReader(append([]byte{0xe0, 0x01, 0x00, 0xea}, test.raw...)), 1024)
+			if !r.Next() {
+				t.Fatalf("%s: %v", test.name, r.Error())
+			}
+			value, err := fn(r)
+			if errors.Is(err, errIntegerOverflow) {
+				return overflow
+			}
+			if err != nil {
+				return ""
+			}
+			return fmt.Sprint(value)
+		}
+
+		if actual := read(func(r *IonReader) (any, error) { return r.ReadInt() }); actual != test.int {
+			t.Errorf("%s: expected ReadInt %s, got %s", test.name, test.int, actual)
+		}
+		if actual := read(func(r *IonReader) (any, error) { return r.ReadUint() }); actual != test.uint {
+			t.Errorf("%s: expected ReadUint %s, got %s", test.name, test.uint, actual)
+		}
+		if actual := read(func(r *IonReader) (any, error) { return r.ReadNumber() }); actual != fmt.Sprint(test.number) {
+			t.Errorf("%s: expected ReadNumber %v, got %s", test.name, test.number, actual)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package plugin
+
+import (
+	"github.com/SnellerInc/sneller/ion"
+)
+
+// columnSpool buffers the values of a single column that can not be held by a columnVector
+// (e.g. structs, lists or values of mixed types). The values can only be converted to Grafana
+// field values once the column type is known, so they are buffered in a compact form until then.
+//
+// The values are stored as self-contained ION values. Symbols are converted to strings and the
+// field names of nested structs refer to a symbol table that is shared by all column spools of a
+// result, as the symbol table of the response may change between rows.
+type columnSpool struct {
+	buf   ion.Buffer
+	rows  []int32   // The row index of each value, nil while the values match the row indices
+	count int       // The number of values
+	mark  spoolMark // The end of the values replayed last
+}
+
+// spoolMark is a position in a columnSpool. All values before the position belong to rows before
+// the row of the mark.
+type spoolMark struct {
+	row    int // The first row after the position
+	index  int // The index of the value at the position
+	offset int // The offset of the value at the position
+}
+
+// append appends the current value of the reader, which belongs to the row with the given index.
+// Nested field names are added to the given symbol table.
+func (s *columnSpool) append(reader *IonReader, row int, symbols *ion.Symtab) error {
+	s.track(row)
+	return spoolValue(reader, &s.buf, symbols)
+}
+
+// appendDatum appends the given value, which belongs to the row with the given index.
+func (s *columnSpool) appendDatum(value ion.Datum, row int, symbols *ion.Symtab) {
+	s.track(row)
+	value.Encode(&s.buf, symbols)
+}
+
+// track records the row index of the next value.
+func (s *columnSpool) track(row int) {
+	if s.rows == nil && row != s.count {
+		// The column is missing in some rows (or duplicated within a row)
+		s.rows = make([]int32, s.count, s.count+1)
+		for i := range s.rows {
+			s.rows[i] = int32(i)
+		}
+	}
+	if s.rows != nil {
+		s.rows = append(s.rows, int32(row))
+	}
+	s.count++
+}
+
+// replay calls fn for each buffered value of the rows from the given row on, with a reader
+// positioned at the value and the index of the row containing the value. Replaying the rows that
+// were appended after the previous replay resumes at the end of the previous replay.
+func (s *columnSpool) replay(symbols *ion.Symtab, from int, fn func(reader *IonReader, index int) error) error {
+	var start spoolMark
+	if from > 0 && from >= s.mark.row {
+		start = s.mark
+	}
+
+	buf := s.buf.Bytes()
+	reader := newBufferedReader(buf[start.offset:], symbols)
+	for i := start.index; reader.Next(); i++ {
+		index := s.row(i)
+		if index < from {
+			continue
+		}
+		err := fn(reader, index)
+		if err != nil {
+			return err
+		}
+	}
+	if err := reader.Error(); err != nil {
+		return err
+	}
+
+	if s.count != 0 {
+		s.mark = spoolMark{row: s.row(s.count-1) + 1, index: s.count, offset: len(buf)}
+	}
+	return nil
+}
+
+// row returns the index of the row containing the value with the given index.
+func (s *columnSpool) row(i int) int {
+	if s.rows != nil {
+		return int(s.rows[i])
+	}
+	return i
+}
+
+// spoolValue copies the current value of the reader to dst. Scalar values are copied as is.
+func spoolValue(reader *IonReader, dst *ion.Buffer, symbols *ion.Symtab) error {
+	switch reader.Type() {
+	case ion.SymbolType:
+		text, err := reader.ReadText()
+		if err != nil {
+			return err
+		}
+		dst.WriteString(text)
+		return nil
+	case ion.StructType:
+		err := reader.StepIn()
+		if err != nil {
+			return err
+		}
+		dst.BeginStruct(-1)
+		for reader.Next() {
+			name, err := reader.FieldName()
+			if err != nil {
+				return err
+			}
+			dst.BeginField(symbols.Intern(name))
+			err = spoolValue(reader, dst, symbols)
+			if err != nil {
+				return err
+			}
+		}
+		dst.EndStruct()
+		if err := reader.Error(); err != nil {
+			return err
+		}
+		return reader.StepOut()
+	case ion.ListType:
+		err := reader.StepIn()
+		if err != nil {
+			return err
+		}
+		dst.BeginList(-1)
+		for reader.Next() {
+			err = spoolValue(reader, dst, symbols)
+			if err != nil {
+				return err
+			}
+		}
+		dst.EndList()
+		if err := reader.Error(); err != nil {
+			return err
+		}
+		return reader.StepOut()
+	}
+
+	buf, err := reader.raw()
+	if err != nil {
+		return err
+	}
+	dst.UnsafeAppend(buf)
+	return nil
+}
@@ -0,0 +1,246 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"golang.org/x/exp/slices"
+)
+
+// streamPathPrefix is the prefix of the channel paths of streamed queries. The remaining path is
+// a hash of the query, so that only subscribers of the same query share a stream.
+const streamPathPrefix = "query/"
+
+// streamInterval is the minimum interval between two partial results of a streamed query. It is
+// a variable, so that tests can send a partial result after each row.
+var streamInterval = time.Second
+
+func (d *Datasource) SubscribeStream(_ context.Context, req *backend.SubscribeStreamRequest) (*backend.SubscribeStreamResponse, error) {
+	if !strings.HasPrefix(req.Path, streamPathPrefix) {
+		return &backend.SubscribeStreamResponse{
+			Status: backend.SubscribeStreamStatusNotFound,
+		}, nil
+	}
+	return &backend.SubscribeStreamResponse{
+		Status: backend.SubscribeStreamStatusOK,
+	}, nil
+}
+
+func (d *Datasource) PublishStream(context.Context, *backend.PublishStreamRequest) (*backend.PublishStreamResponse, error) {
+	return &backend.PublishStreamResponse{
+		Status: backend.PublishStreamStatusPermissionDenied,
+	}, nil
+}
+
+// RunStream executes the query of a stream subscription and sends the partial results while the
+// rows are received. The complete result is sent last and kept until all subscribers are gone,
+// so that the query is not executed again.
+func (d *Datasource) RunStream(ctx context.Context, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
+	var request snellerStreamRequest
+	err := json.Unmarshal(req.Data, &request)
+	if err != nil {
+		return fmt.Errorf("json unmarshal: %w", err)
+	}
+
+	err = d.streamQuery(ctx, request, func(frame *data.Frame, include data.FrameInclude) error {
+		return sender.SendFrame(frame, include)
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		frame := data.NewFrame(request.RefID)
+		frame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityError,
+			Text:     err.Error(),
+		})
+		err := sender.SendFrame(frame, data.IncludeAll)
+		if err != nil {
+			return err
+		}
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+// streamQuery executes the query of the given stream request and sends the partial results.
+func (d *Datasource) streamQuery(ctx context.Context, request snellerStreamRequest, send func(frame *data.Frame, include data.FrameInclude) error) error {
+	query := backend.DataQuery{
+		RefID:         request.RefID,
+		QueryType:     request.QueryType,
+		MaxDataPoints: request.MaxDataPoints,
+		Interval:      time.Duration(request.IntervalMs) * time.Millisecond,
+		TimeRange: backend.TimeRange{
+			From: time.UnixMilli(request.From).UTC(),
+			To:   time.UnixMilli(request.To).UTC(),
+		},
+		JSON: request.Query,
+	}
+
+	input, macros, database, sql, err := d.prepareQuery(query)
+	if err != nil {
+		return err
+	}
+
+	// Cancel the query when the datasource instance gets disposed
+	ctx, done := d.inflight.track(ctx)
+	defer done()
+
+	release, err := d.acquireQuerySlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	start := time.Now()
+	resp, err := d.executeQuery(ctx, database, sql)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.DefaultLogger.Error("failed to close response body", "err", err)
+		}
+	}()
+
+	return streamSnellerResult(query.RefID, sql, resp.Body, macros.timeCandidate, macros.timeUnit, input, d.symtabs, func(frame *data.Frame, partial bool) (*data.Frame, error) {
+		// The wide frames of long time series contain other rows than the received ones
+		if partial && isLongFrame(query, frame) {
+			return nil, nil
+		}
+		frames, err := queryFrames(query, input, macros, frame, time.Since(start), true)
+		if err != nil {
+			return nil, err
+		}
+		// Streams consist of a single frame, so long time series are returned as a wide frame and
+		// the stats frame is not sent
+		return frames[0], nil
+	}, send)
+}
+
+// streamSnellerResult reads the result in a single pass and sends the rows received so far at
+// most every streamInterval. As long as the fields do not change, each partial frame only
+// contains the rows received since the previous frame and is sent without the schema, so that it
+// is appended on the client. Otherwise all rows received so far are sent with the new schema,
+// which replaces the previous rows. The complete frame is the same as the one returned by
+// frameFromSnellerResult and is sent last, with only the rows that were not sent yet, if possible.
+//
+// Each frame is passed to the given convert function before it is sent, which returns nil, if the
+// partial frames can not be appended to each other (e.g. long time series). Only the complete
+// frame is sent then.
+func streamSnellerResult(refID, sql string, input io.Reader, timeField string, timeUnit time.Duration, options *snellerQuery, symtabs *SymtabCache,
+	convert func(frame *data.Frame, partial bool) (*data.Frame, error), send func(frame *data.Frame, include data.FrameInclude) error) error {
+	reader := NewReader(input, 1024*1024*10) // 10 MiB
+	if symtabs != nil {
+		reader.UseSymtabCache(symtabs, symtabCacheKey(sql))
+	}
+
+	build := func(schema *snellerSchema, from int) (*data.Frame, error) {
+		frame, err := frameFromSchema(refID, sql, schema, from, timeField, timeUnit, options)
+		if err != nil {
+			return nil, err
+		}
+		return convert(frame, schema.Partial)
+	}
+
+	streamable := options.streamable()
+	sentRows := 0      // The rows of the result sent so far
+	sentFrameRows := 0 // The rows of the frames sent so far, which differ for unpivoted results
+	var sentFields []string
+	sent := time.Now()
+
+	schema, err := deriveSchema(reader, sql, options, func(schema *snellerSchema) error {
+		if !streamable || time.Since(sent) < streamInterval {
+			return nil
+		}
+		sent = time.Now()
+
+		snapshot, err := schema.snapshot(sql, options)
+		if err != nil {
+			return err
+		}
+		frame, err := build(snapshot, sentRows)
+		if err != nil {
+			return err
+		}
+		if frame == nil {
+			streamable = false
+			return nil
+		}
+
+		include := data.IncludeDataOnly
+		if fields := frameFields(frame); !slices.Equal(fields, sentFields) {
+			// The client replaces the previous rows by the frame with the new schema
+			if sentRows != 0 {
+				frame, err = build(snapshot, 0)
+				if err != nil {
+					return err
+				}
+				if frame == nil {
+					streamable = false
+					return nil
+				}
+				sentFrameRows = 0
+			}
+			include = data.IncludeAll
+			sentFields = fields
+		}
+
+		sentRows = snapshot.RowCount
+		sentFrameRows += frame.Rows()
+		return send(frame, include)
+	})
+	if err != nil {
+		return err
+	}
+
+	frame, err := build(schema, 0)
+	if err != nil {
+		return err
+	}
+	if sentRows != 0 && slices.Equal(frameFields(frame), sentFields) {
+		frame = sliceFrame(frame, sentFrameRows)
+	}
+	return send(frame, data.IncludeAll)
+}
+
+// frameFields returns the names and types of the fields of the given frame. Frames are only
+// appended to each other on the client, if their fields are the same.
+func frameFields(frame *data.Frame) []string {
+	fields := make([]string, len(frame.Fields))
+	for i, field := range frame.Fields {
+		fields[i] = field.Name + ":" + field.Type().String()
+	}
+	return fields
+}
+
+// sliceFrame returns a copy of the given frame with the rows from the given row on. The meta data
+// of the frame and the configs and labels of the fields are kept.
+func sliceFrame(frame *data.Frame, from int) *data.Frame {
+	fields := make([]*data.Field, len(frame.Fields))
+	for i, field := range frame.Fields {
+		length := field.Len() - from
+		if length < 0 {
+			length = 0
+		}
+		slice := data.NewFieldFromFieldType(field.Type(), length)
+		slice.Name, slice.Labels, slice.Config = field.Name, field.Labels, field.Config
+		for j := 0; j < length; j++ {
+			slice.Set(j, field.At(from+j))
+		}
+		fields[i] = slice
+	}
+
+	result := data.NewFrame(frame.Name, fields...)
+	result.RefID = frame.RefID
+	result.Meta = frame.Meta
+	return result
+}
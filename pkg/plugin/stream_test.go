@@ -0,0 +1,195 @@
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SnellerInc/sneller/ion"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"golang.org/x/exp/slices"
+)
+
+// streamedFrame is a frame sent by streamSnellerResult.
+type streamedFrame struct {
+	frame   *data.Frame
+	include data.FrameInclude
+}
+
+// streamResult streams the given result with a partial frame after each row and returns the sent
+// frames. A nil convert function passes the frames as they are.
+func streamResult(t *testing.T, result []byte, options *snellerQuery, convert func(frame *data.Frame, partial bool) (*data.Frame, error)) []streamedFrame {
+	t.Helper()
+	interval := streamInterval
+	streamInterval = 0
+	defer func() { streamInterval = interval }()
+
+	if convert == nil {
+		convert = func(frame *data.Frame, _ bool) (*data.Frame, error) { return frame, nil }
+	}
+	var frames []streamedFrame
+	err := streamSnellerResult("A", "SELECT * FROM t", bytes.NewReader(result), "", time.Millisecond, options, nil, convert,
+		func(frame *data.Frame, include data.FrameInclude) error {
+			frames = append(frames, streamedFrame{frame: frame, include: include})
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frames
+}
+
+// describeFrames returns the kind and the number of rows of the given frames, e.g. 'all:2 data:1'
+// for a frame with schema and two rows followed by a frame without schema and one row.
+func describeFrames(frames []streamedFrame) string {
+	var result []string
+	for _, f := range frames {
+		kind := "all"
+		if f.include == data.IncludeDataOnly {
+			kind = "data"
+		}
+		result = append(result, fmt.Sprintf("%s:%d", kind, f.frame.Rows()))
+	}
+	return strings.Join(result, " ")
+}
+
+// assertStreamed applies the given frames like the client, i.e. frames with changed fields replace
+// the previous rows and all other frames are appended, and asserts that the result is the same as
+// the frame of the complete result.
+func assertStreamed(t *testing.T, frames []streamedFrame, result []byte, options *snellerQuery) {
+	t.Helper()
+	expected, err := frameFromSnellerResult("A", "SELECT * FROM t", bytes.NewReader(result), "", time.Millisecond, options, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields []string
+	var values [][]any
+	for _, f := range frames {
+		if f.include == data.IncludeAll && !slices.Equal(frameFields(f.frame), fields) {
+			fields = frameFields(f.frame)
+			values = make([][]any, len(fields))
+		}
+		for i, field := range f.frame.Fields {
+			values[i] = append(values[i], concreteValues(field)...)
+		}
+	}
+
+	if expectedFields := frameFields(expected); !slices.Equal(fields, expectedFields) {
+		t.Fatalf("expected fields %v, got %v", expectedFields, fields)
+	}
+	for i, field := range expected.Fields {
+		if expected, actual := fmt.Sprint(concreteValues(field)), fmt.Sprint(values[i]); actual != expected {
+			t.Errorf("field %s: expected values %s, got %s", field.Name, expected, actual)
+		}
+	}
+
+	final := frames[len(frames)-1]
+	if final.include != data.IncludeAll {
+		t.Error("expected the complete frame with schema")
+	}
+	if expected, actual := fmt.Sprint(expected.Meta), fmt.Sprint(final.frame.Meta); actual != expected {
+		t.Errorf("expected meta data %s, got %s", expected, actual)
+	}
+}
+
+func TestStreamNewRows(t *testing.T) {
+	result := encodeResult([]ion.Datum{
+		row("name", "a", "value", 1.5),
+		row("name", "b", "value", 2.5),
+		row("name", "c", "value", 3.5),
+		row("name", "d", "value", 4.5),
+	}, nil)
+	options := &snellerQuery{}
+
+	// All rows were sent already, so the complete frame only adds the meta data
+	frames := streamResult(t, result, options, nil)
+	if actual, expected := describeFrames(frames), "all:1 data:1 data:1 data:1 all:0"; actual != expected {
+		t.Errorf("expected frames %s, got %s", expected, actual)
+	}
+	assertStreamed(t, frames, result, options)
+}
+
+func TestStreamChangedFields(t *testing.T) {
+	result := encodeResult([]ion.Datum{
+		row("name", "a", "count", 1),
+		row("name", "b", "count", 2),
+		row("name", "c", "count", 3, "extra", "x"),
+		row("name", "d", "count", 4),
+		row("name", "e", "count", nil),
+	}, nil)
+	options := &snellerQuery{}
+
+	// The new field and the null value, which makes the fields nullable, replace the previous rows.
+	// The integers of the complete frame are narrowed, so that all rows are sent again.
+	frames := streamResult(t, result, options, nil)
+	if actual, expected := describeFrames(frames), "all:1 data:1 all:3 data:1 all:5 all:5"; actual != expected {
+		t.Errorf("expected frames %s, got %s", expected, actual)
+	}
+	assertStreamed(t, frames, result, options)
+}
+
+func TestStreamMixedColumn(t *testing.T) {
+	// The mixed values are spooled as JSON, which is replayed from the last sent row
+	result := encodeResult([]ion.Datum{
+		row("name", "a", "value", row("x", 1)),
+		row("name", "b", "value", "text"),
+		row("name", "c", "value", 2.5),
+		row("name", "d", "value", row("y", "z")),
+	}, nil)
+	options := &snellerQuery{}
+
+	frames := streamResult(t, result, options, nil)
+	if actual, expected := describeFrames(frames), "all:1 data:1 data:1 data:1 all:0"; actual != expected {
+		t.Errorf("expected frames %s, got %s", expected, actual)
+	}
+	assertStreamed(t, frames, result, options)
+}
+
+func TestStreamUnpivotedRows(t *testing.T) {
+	result := encodeResult([]ion.Datum{
+		row("host", "a", "metrics", row("cpu", 1.5, "mem", 2.5)),
+		row("host", "b", "metrics", row("cpu", 3.5)),
+		row("host", "c", "metrics", row("cpu", 5.5, "mem", 6.5)),
+	}, nil)
+	options := &snellerQuery{Unpivot: "metrics"}
+
+	// The partial frames contain the key/value rows of the new rows
+	frames := streamResult(t, result, options, nil)
+	if actual, expected := describeFrames(frames), "all:2 data:1 data:2 all:0"; actual != expected {
+		t.Errorf("expected frames %s, got %s", expected, actual)
+	}
+	assertStreamed(t, frames, result, options)
+}
+
+func TestStreamWithoutPartialFrames(t *testing.T) {
+	result := encodeResult([]ion.Datum{
+		row("name", "a", "value", 1.5),
+		row("name", "b", "value", 2.5),
+	}, nil)
+
+	t.Run("convert", func(t *testing.T) {
+		options := &snellerQuery{}
+		frames := streamResult(t, result, options, func(frame *data.Frame, partial bool) (*data.Frame, error) {
+			if partial {
+				return nil, nil
+			}
+			return frame, nil
+		})
+		if actual, expected := describeFrames(frames), "all:2"; actual != expected {
+			t.Errorf("expected frames %s, got %s", expected, actual)
+		}
+		assertStreamed(t, frames, result, options)
+	})
+
+	t.Run("options", func(t *testing.T) {
+		options := &snellerQuery{DropEmptyColumns: true}
+		frames := streamResult(t, result, options, nil)
+		if actual, expected := describeFrames(frames), "all:2"; actual != expected {
+			t.Errorf("expected frames %s, got %s", expected, actual)
+		}
+		assertStreamed(t, frames, result, options)
+	})
+}
@@ -0,0 +1,63 @@
+package plugin
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/SnellerInc/sneller/ion"
+	"golang.org/x/exp/slices"
+)
+
+// symtabCacheMaxEntries is the maximum number of symbol tables kept by a SymtabCache.
+const symtabCacheMaxEntries = 256
+
+// SymtabCache is a concurrency-safe cache of parsed symbol tables that can be shared between
+// multiple readers. Sneller starts every result stream with a fresh symbol table, which is often
+// identical for repeated queries against the same table. Readers can use the cache to warm-start
+// by cloning a previously parsed symbol table instead of unmarshalling it again. If the cache is
+// full, the least recently used symbol table is evicted.
+type SymtabCache struct {
+	mu      sync.Mutex // Guards the cached symbol tables, which are modified by cloning
+	entries *lookupCache
+}
+
+type symtabCacheEntry struct {
+	raw    []byte     // The raw symbol table annotation
+	symtab ion.Symtab // The parsed symbol table
+}
+
+// NewSymtabCache creates a new, empty symbol table cache.
+func NewSymtabCache() *SymtabCache {
+	return &SymtabCache{
+		entries: newLookupCache(symtabCacheMaxEntries),
+	}
+}
+
+// load clones the cached symbol table for the given key into dst, if the cached raw symbol
+// table annotation matches raw.
+func (c *SymtabCache) load(key string, raw []byte, dst *ion.Symtab) bool {
+	cached, ok := c.entries.Get(key)
+	if !ok {
+		return false
+	}
+	entry := cached.(*symtabCacheEntry)
+	if !bytes.Equal(entry.raw, raw) {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.symtab.CloneInto(dst)
+	return true
+}
+
+// store stores a copy of the given symbol table and its raw annotation for the given key.
+func (c *SymtabCache) store(key string, raw []byte, src *ion.Symtab) {
+	entry := &symtabCacheEntry{
+		raw: slices.Clone(raw),
+	}
+	src.CloneInto(&entry.symtab)
+
+	c.entries.Set(key, entry, 0)
+}
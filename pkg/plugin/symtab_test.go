@@ -0,0 +1,90 @@
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/SnellerInc/sneller/ion"
+)
+
+func TestSymtabCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	var symbols ion.Symtab
+	symbols.Intern("value")
+	raw := func(key string) []byte { return []byte(key) }
+
+	cache := NewSymtabCache()
+	for i := 0; i < symtabCacheMaxEntries; i++ {
+		key := fmt.Sprintf("table%d", i)
+		cache.store(key, raw(key), &symbols)
+	}
+
+	// Use the oldest entry, so that the second oldest one is evicted next
+	var dst ion.Symtab
+	if !cache.load("table0", raw("table0"), &dst) {
+		t.Fatal("table0: expected a cached symbol table")
+	}
+	if _, ok := dst.Symbolize("value"); !ok {
+		t.Error("table0: expected the cached symbol 'value'")
+	}
+
+	cache.store("new", raw("new"), &symbols)
+	for key, expected := range map[string]bool{"table0": true, "table1": false, "table2": true, "new": true} {
+		if cached := cache.load(key, raw(key), &dst); cached != expected {
+			t.Errorf("%s: expected cached %v, got %v", key, expected, cached)
+		}
+	}
+}
+
+func TestSymtabCacheRequiresSameSymtab(t *testing.T) {
+	var symbols ion.Symtab
+	symbols.Intern("value")
+
+	cache := NewSymtabCache()
+	cache.store("table", []byte("a"), &symbols)
+
+	var dst ion.Symtab
+	if cache.load("table", []byte("b"), &dst) {
+		t.Error("expected a cache miss for a different symbol table")
+	}
+}
+
+// BenchmarkConcurrentQueries measures 10 concurrent identical queries with wide rows, which
+// share the same symbol table.
+func BenchmarkConcurrentQueries(b *testing.B) {
+	var rows []ion.Datum
+	for i := 0; i < 10; i++ {
+		var fields []any
+		for j := 0; j < 500; j++ {
+			fields = append(fields, fmt.Sprintf("column_%d", j), i*j)
+		}
+		rows = append(rows, row(fields...))
+	}
+	result := encodeResult(rows, nil)
+
+	run := func(b *testing.B, symtabs *SymtabCache) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var wg sync.WaitGroup
+			for j := 0; j < 10; j++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := frameFromSnellerResult("A", "SELECT * FROM logs", bytes.NewReader(result), "", 0, &snellerQuery{}, symtabs)
+					if err != nil {
+						b.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+		}
+	}
+
+	b.Run("NoCache", func(b *testing.B) {
+		run(b, nil)
+	})
+	b.Run("SymtabCache", func(b *testing.B) {
+		run(b, NewSymtabCache())
+	})
+}
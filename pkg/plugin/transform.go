@@ -0,0 +1,957 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// aggregateFrame collapses the rows of the given frame by the values of the groupBy fields and
+// applies the given aggregation functions ('sum', 'avg', 'min', 'max' or 'count') to the
+// remaining fields. Fields that are neither grouped nor aggregated are dropped. Groups are
+// returned in the order of their first occurrence.
+func aggregateFrame(frame *data.Frame, groupBy []string, aggregations map[string]string) (*data.Frame, error) {
+	keyFields := make([]*data.Field, len(groupBy))
+	for i, name := range groupBy {
+		field, _ := frame.FieldByName(name)
+		if field == nil {
+			return nil, fmt.Errorf("group by: unknown field '%s'", name)
+		}
+		keyFields[i] = field
+	}
+
+	// All aggregations are validated before the rows are grouped
+	names := maps.Keys(aggregations)
+	slices.Sort(names)
+	functions := make(map[string]string, len(aggregations))
+	for _, name := range names {
+		field, _ := frame.FieldByName(name)
+		if field == nil {
+			return nil, fmt.Errorf("aggregations: unknown field '%s'", name)
+		}
+		fn := strings.ToLower(aggregations[name])
+		switch fn {
+		case "count":
+		case "sum", "avg", "min", "max":
+			if !field.Type().Numeric() {
+				return nil, fmt.Errorf("aggregation '%s' requires a numeric field: '%s' is of type %s", fn, name, field.Type())
+			}
+		default:
+			return nil, fmt.Errorf("unsupported aggregation '%s' for field '%s'", aggregations[name], name)
+		}
+		functions[name] = fn
+	}
+
+	// Assign each row to a group
+
+	groupIndex := map[string]int{}
+	var groupRows []int     // The first row of each group
+	var rowGroups []int     // The group of each row
+	var key strings.Builder // Reused key buffer
+
+	for row := 0; row < frame.Rows(); row++ {
+		key.Reset()
+		for _, field := range keyFields {
+			value, ok := field.ConcreteAt(row)
+			if ok {
+				fmt.Fprintf(&key, "%v\x00", value)
+			} else {
+				key.WriteString("\x01\x00")
+			}
+		}
+
+		group, ok := groupIndex[key.String()]
+		if !ok {
+			group = len(groupRows)
+			groupIndex[key.String()] = group
+			groupRows = append(groupRows, row)
+		}
+		rowGroups = append(rowGroups, group)
+	}
+
+	// Copy the group keys
+
+	var fields []*data.Field
+	for _, field := range keyFields {
+		result := data.NewFieldFromFieldType(field.Type(), len(groupRows))
+		result.Name = field.Name
+		result.Labels = field.Labels
+		result.Config = field.Config
+		for group, row := range groupRows {
+			result.Set(group, field.CopyAt(row))
+		}
+		fields = append(fields, result)
+	}
+
+	// Aggregate the values (keeping the original field order)
+
+	for _, field := range frame.Fields {
+		fn, ok := functions[field.Name]
+		if !ok {
+			continue
+		}
+
+		result, err := aggregateField(field, fn, rowGroups, len(groupRows))
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, result)
+	}
+
+	result := data.NewFrame(frame.Name, fields...)
+	result.RefID = frame.RefID
+	result.Meta = frame.Meta
+
+	return result, nil
+}
+
+// aggregateField applies the given aggregation function to the values of each group. Null
+// values are ignored. The function and the field type are validated by aggregateFrame.
+func aggregateField(field *data.Field, fn string, rowGroups []int, groupCount int) (*data.Field, error) {
+	if fn == "count" {
+		counts := make([]int64, groupCount)
+		for row, group := range rowGroups {
+			if _, ok := field.ConcreteAt(row); ok {
+				counts[group]++
+			}
+		}
+		return data.NewField(field.Name, field.Labels, counts), nil
+	}
+
+	results := make([]*float64, groupCount)
+	counts := make([]int, groupCount)
+
+	for row, group := range rowGroups {
+		value, err := field.NullableFloatAt(row)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			continue
+		}
+
+		counts[group]++
+		if results[group] == nil {
+			v := *value
+			results[group] = &v
+			continue
+		}
+
+		current := results[group]
+		switch fn {
+		case "sum", "avg":
+			*current += *value
+		case "min":
+			if *value < *current {
+				*current = *value
+			}
+		case "max":
+			if *value > *current {
+				*current = *value
+			}
+		}
+	}
+
+	if fn == "avg" {
+		for group, value := range results {
+			if value != nil {
+				*value /= float64(counts[group])
+			}
+		}
+	}
+
+	result := data.NewField(field.Name, field.Labels, results)
+	result.Config = field.Config
+
+	return result, nil
+}
+
+// truncateStrings returns a copy of the given string field with all values longer than max
+// characters truncated and suffixed with an ellipsis.
+func truncateStrings(field *data.Field, max int) *data.Field {
+	truncate := func(s string) string {
+		if len(s) <= max {
+			return s
+		}
+		runes := []rune(s)
+		if len(runes) <= max {
+			return s
+		}
+		return string(runes[:max]) + "…"
+	}
+
+	result := data.NewFieldFromFieldType(field.Type(), field.Len())
+	result.Name = field.Name
+	result.Labels = field.Labels
+	result.Config = field.Config
+
+	for i := 0; i < field.Len(); i++ {
+		switch value := field.At(i).(type) {
+		case string:
+			result.Set(i, truncate(value))
+		case *string:
+			if value != nil {
+				truncated := truncate(*value)
+				value = &truncated
+			}
+			result.Set(i, value)
+		}
+	}
+
+	return result
+}
+
+// logsFrame converts the given frame into a minimal log lines frame consisting of a 'timestamp'
+// and a 'body' field. If timeField or messageField are empty, the first time field and the first
+// remaining string field are used. If labels is true, the values of all remaining fields are
+// stored as a 'labels' field. Otherwise, they are dropped.
+func logsFrame(frame *data.Frame, timeField, messageField string, labels bool) (*data.Frame, error) {
+	var timestamps, messages *data.Field
+	for _, field := range frame.Fields {
+		if timestamps == nil && (field.Name == timeField || (timeField == "" && field.Type().Time())) {
+			timestamps = field
+		}
+	}
+	if timestamps == nil || !timestamps.Type().Time() {
+		return nil, fmt.Errorf("logs: missing time field '%s'", timeField)
+	}
+	for _, field := range frame.Fields {
+		if field == timestamps {
+			continue
+		}
+		if messages == nil && (field.Name == messageField || (messageField == "" && field.Type().NonNullableType() == data.FieldTypeString)) {
+			messages = field
+		}
+	}
+	if messages == nil {
+		return nil, fmt.Errorf("logs: missing message field '%s'", messageField)
+	}
+
+	rows := frame.Rows()
+
+	timestampField := data.NewFieldFromFieldType(timestamps.Type(), rows)
+	timestampField.Name = "timestamp"
+	bodyField := data.NewFieldFromFieldType(data.FieldTypeString, rows)
+	bodyField.Name = "body"
+
+	for i := 0; i < rows; i++ {
+		timestampField.Set(i, timestamps.CopyAt(i))
+		if value, ok := messages.ConcreteAt(i); ok {
+			bodyField.Set(i, fmt.Sprint(value))
+		}
+	}
+
+	fields := []*data.Field{timestampField, bodyField}
+
+	if labels {
+		values := make([]json.RawMessage, rows)
+		for i := 0; i < rows; i++ {
+			row := map[string]string{}
+			for _, field := range frame.Fields {
+				if field == timestamps || field == messages {
+					continue
+				}
+				if value, ok := field.ConcreteAt(i); ok {
+					switch v := value.(type) {
+					case json.RawMessage:
+						row[field.Name] = string(v)
+					default:
+						row[field.Name] = fmt.Sprint(v)
+					}
+				}
+			}
+			b, err := json.Marshal(row)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = b
+		}
+		fields = append(fields, data.NewField("labels", nil, values))
+	}
+
+	result := data.NewFrame(frame.Name, fields...)
+	result.RefID = frame.RefID
+	meta := *frame.Meta
+	meta.Type = data.FrameTypeLogLines
+	meta.PreferredVisualization = data.VisTypeLogs
+	result.Meta = &meta
+
+	return result, nil
+}
+
+// logsQueryFrame converts the given frame into a log lines frame for the 'logs' query type. In
+// contrast to logsFrame, all fields are kept. The time field (timeField or the first time field)
+// is moved to the front, followed by the first string field as the log line body. A field named
+// 'level' or 'severity' is moved after the body and named 'level', which Grafana uses to color
+// the log lines.
+func logsQueryFrame(frame *data.Frame, timeField string) (*data.Frame, error) {
+	var timestamps, body, level *data.Field
+	for _, field := range frame.Fields {
+		if timestamps == nil && field.Type().Time() && (timeField == "" || field.Name == timeField) {
+			timestamps = field
+		}
+		name := strings.ToLower(field.Name)
+		if level == nil && (name == "level" || name == "severity") {
+			level = field
+		}
+	}
+	if timestamps == nil {
+		return nil, errors.New("logs: the result does not contain a time field")
+	}
+	for _, field := range frame.Fields {
+		if field != timestamps && field != level && field.Type().NonNullableType() == data.FieldTypeString {
+			body = field
+			break
+		}
+	}
+	if body == nil {
+		return nil, errors.New("logs: the result does not contain a string field")
+	}
+
+	fields := []*data.Field{timestamps, body}
+	if level != nil {
+		level.Name = "level"
+		fields = append(fields, level)
+	}
+	for _, field := range frame.Fields {
+		if field != timestamps && field != body && field != level {
+			fields = append(fields, field)
+		}
+	}
+
+	result := data.NewFrame(frame.Name, fields...)
+	result.RefID = frame.RefID
+	meta := *frame.Meta
+	meta.Type = data.FrameTypeLogLines
+	meta.PreferredVisualization = data.VisTypeLogs
+	result.Meta = &meta
+
+	return result, nil
+}
+
+// unpivotFrame converts the struct values of the given JSON column into key/value rows. Each
+// field of a struct value produces a separate row containing the values of all other columns, the
+// field name as keyName and the field value as valueName. Rows without struct values are dropped.
+// If all field values are numeric, the value column is numeric as well.
+func unpivotFrame(frame *data.Frame, column, keyName, valueName string) (*data.Frame, error) {
+	source, _ := frame.FieldByName(column)
+	if source == nil {
+		return nil, fmt.Errorf("unpivot: unknown field '%s'", column)
+	}
+	if source.Type().NonNullableType() != data.FieldTypeJSON {
+		return nil, fmt.Errorf("unpivot: field '%s' does not contain struct values", column)
+	}
+
+	var fields []*data.Field
+	for _, field := range frame.Fields {
+		if field == source {
+			continue
+		}
+		result := data.NewFieldFromFieldType(field.Type(), 0)
+		result.Name = field.Name
+		result.Labels = field.Labels
+		result.Config = field.Config
+		fields = append(fields, result)
+	}
+
+	var keys []string
+	var values []json.RawMessage
+	numeric := true
+
+	for row := 0; row < frame.Rows(); row++ {
+		value, ok := source.ConcreteAt(row)
+		if !ok {
+			continue
+		}
+
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(value.(json.RawMessage), &object); err != nil || object == nil {
+			continue
+		}
+
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			i := 0
+			for _, field := range frame.Fields {
+				if field == source {
+					continue
+				}
+				fields[i].Append(field.CopyAt(row))
+				i++
+			}
+
+			var number float64
+			if string(object[name]) != "null" && json.Unmarshal(object[name], &number) != nil {
+				numeric = false
+			}
+			keys = append(keys, name)
+			values = append(values, object[name])
+		}
+	}
+
+	fields = append(fields, data.NewField(keyName, nil, keys))
+
+	if numeric {
+		numbers := make([]*float64, len(values))
+		for i, value := range values {
+			var number *float64
+			_ = json.Unmarshal(value, &number)
+			numbers[i] = number
+		}
+		fields = append(fields, data.NewField(valueName, nil, numbers))
+	} else {
+		fields = append(fields, data.NewField(valueName, nil, values))
+	}
+
+	result := data.NewFrame(frame.Name, fields...)
+	result.RefID = frame.RefID
+	result.Meta = frame.Meta
+
+	return result, nil
+}
+
+// timeToEpoch converts the given time field to an int64 field containing Unix millisecond
+// timestamps. The 'dateTimeAsIso' unit lets panels still display the values as time.
+func timeToEpoch(field *data.Field) *data.Field {
+	var result *data.Field
+	if field.Type() == data.FieldTypeTime {
+		epochs := make([]int64, field.Len())
+		for i := range epochs {
+			epochs[i] = field.At(i).(time.Time).UnixMilli()
+		}
+		result = data.NewField(field.Name, field.Labels, epochs)
+	} else {
+		epochs := make([]*int64, field.Len())
+		for i := range epochs {
+			if t := field.At(i).(*time.Time); t != nil {
+				epoch := t.UnixMilli()
+				epochs[i] = &epoch
+			}
+		}
+		result = data.NewField(field.Name, field.Labels, epochs)
+	}
+
+	return result.SetConfig(&data.FieldConfig{Unit: "dateTimeAsIso"})
+}
+
+// indentJSON returns a copy of the given JSON field with indented values.
+func indentJSON(field *data.Field) (*data.Field, error) {
+	result := data.NewFieldFromFieldType(field.Type(), field.Len())
+	result.Name = field.Name
+	result.Labels = field.Labels
+	result.Config = field.Config
+
+	for i := 0; i < field.Len(); i++ {
+		value, ok := field.ConcreteAt(i)
+		if !ok {
+			continue
+		}
+
+		var buf bytes.Buffer
+		err := json.Indent(&buf, value.(json.RawMessage), "", "  ")
+		if err != nil {
+			return nil, err
+		}
+
+		indented := json.RawMessage(buf.Bytes())
+		if field.Type().Nullable() {
+			result.Set(i, &indented)
+		} else {
+			result.Set(i, indented)
+		}
+	}
+
+	return result, nil
+}
+
+// regexJSONPathSegment matches a single segment of a JSON path, e.g. 'name' or 'items[0]'.
+var regexJSONPathSegment = regexp.MustCompile(`^([^.\[\]]*)((?:\[\d+])*)$`)
+
+// extractJSONField extracts the nested value at the given path from the JSON values of a frame
+// field and returns it as a new field with the given name. The path starts with the name of the
+// field, followed by dot separated struct field names and '[n]' list indexes, e.g.
+// 'payload.items[0].id'. The type of the new field is derived from the extracted values.
+func extractJSONField(frame *data.Frame, name, path string) (*data.Field, error) {
+	var source *data.Field
+	for _, field := range frame.Fields {
+		if (path == field.Name || strings.HasPrefix(path, field.Name+".") || strings.HasPrefix(path, field.Name+"[")) &&
+			(source == nil || len(field.Name) > len(source.Name)) {
+			source = field
+		}
+	}
+	if source == nil || source.Type().NonNullableType() != data.FieldTypeJSON {
+		return nil, fmt.Errorf("extract: no JSON field matches path '%s'", path)
+	}
+
+	// Parse the remaining path
+	var steps []any // string: struct field, int: list index
+	rest := strings.TrimPrefix(path, source.Name)
+	if strings.HasPrefix(rest, "[") {
+		rest = "." + rest
+	}
+	if rest != "" {
+		for _, segment := range strings.Split(rest[1:], ".") {
+			match := regexJSONPathSegment.FindStringSubmatch(segment)
+			if match == nil {
+				return nil, fmt.Errorf("extract: invalid path '%s'", path)
+			}
+			if match[1] != "" {
+				steps = append(steps, match[1])
+			}
+			for _, index := range strings.Split(strings.Trim(match[2], "[]"), "][") {
+				if index == "" {
+					continue
+				}
+				i, err := strconv.Atoi(index)
+				if err != nil {
+					return nil, fmt.Errorf("extract: invalid path '%s'", path)
+				}
+				steps = append(steps, i)
+			}
+		}
+	}
+
+	// Extract values
+	values := make([]any, source.Len())
+	for i := range values {
+		value, ok := source.ConcreteAt(i)
+		if !ok {
+			continue
+		}
+		var current any
+		if json.Unmarshal(value.(json.RawMessage), &current) != nil {
+			continue
+		}
+		for _, step := range steps {
+			switch s := step.(type) {
+			case string:
+				object, _ := current.(map[string]any)
+				current = object[s]
+			case int:
+				list, _ := current.([]any)
+				if s < len(list) {
+					current = list[s]
+				} else {
+					current = nil
+				}
+			}
+		}
+		values[i] = current
+	}
+
+	return fieldFromValues(name, values)
+}
+
+// fieldFromValues builds a nullable field from the given decoded JSON values. Numbers, booleans
+// and strings produce typed fields, if all values share the same type. Otherwise a JSON field is
+// returned.
+func fieldFromValues(name string, values []any) (*data.Field, error) {
+	var kind string
+	for _, value := range values {
+		var k string
+		switch value.(type) {
+		case nil:
+			continue
+		case float64:
+			k = "number"
+		case bool:
+			k = "bool"
+		case string:
+			k = "string"
+		default:
+			k = "json"
+		}
+		if kind != "" && kind != k {
+			kind = "json"
+			break
+		}
+		kind = k
+	}
+
+	switch kind {
+	case "number":
+		return data.NewField(name, nil, sliceSelect(values, func(v any) *float64 {
+			if f, ok := v.(float64); ok {
+				return &f
+			}
+			return nil
+		})), nil
+	case "bool":
+		return data.NewField(name, nil, sliceSelect(values, func(v any) *bool {
+			if b, ok := v.(bool); ok {
+				return &b
+			}
+			return nil
+		})), nil
+	case "string":
+		return data.NewField(name, nil, sliceSelect(values, func(v any) *string {
+			if s, ok := v.(string); ok {
+				return &s
+			}
+			return nil
+		})), nil
+	}
+
+	result := make([]*json.RawMessage, len(values))
+	for i, value := range values {
+		if value == nil {
+			continue
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = (*json.RawMessage)(&b)
+	}
+	return data.NewField(name, nil, result), nil
+}
+
+// nullFrom returns a nullable copy of the given field, in which all values starting at the given
+// index are null.
+func nullFrom(field *data.Field, index int) *data.Field {
+	result := data.NewFieldFromFieldType(field.Type().NullableType(), field.Len())
+	result.Name = field.Name
+	result.Labels = field.Labels
+	result.Config = field.Config
+
+	for i := 0; i < index && i < field.Len(); i++ {
+		if value, ok := field.ConcreteAt(i); ok {
+			result.SetConcrete(i, value)
+		}
+	}
+
+	return result
+}
+
+// counterDeltas replaces the values of the given monotonically increasing counter field by the
+// difference to the previous value of the same series. Series are identified by the values of
+// the string and boolean fields of the frame, which allows to process long frames as well. A
+// decreasing value is treated as a counter reset, in which case the delta is the value itself.
+// The first value of each series is null. Rows are expected to be ordered by time.
+func counterDeltas(frame *data.Frame, name string) error {
+	idx := -1
+	for i, field := range frame.Fields {
+		if field.Name == name {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return fmt.Errorf("counter: unknown field '%s'", name)
+	}
+	field := frame.Fields[idx]
+	if !field.Type().Numeric() {
+		return fmt.Errorf("counter: field '%s' is of type %s, expected a numeric field", name, field.Type())
+	}
+
+	var factors []*data.Field
+	for _, f := range frame.Fields {
+		switch f.Type().NonNullableType() {
+		case data.FieldTypeString, data.FieldTypeBool:
+			factors = append(factors, f)
+		}
+	}
+
+	deltas := make([]*float64, field.Len())
+	previous := map[string]float64{}
+	var key strings.Builder
+	for row := range deltas {
+		value, err := field.NullableFloatAt(row)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			continue
+		}
+
+		key.Reset()
+		for _, factor := range factors {
+			if v, ok := factor.ConcreteAt(row); ok {
+				fmt.Fprintf(&key, "%v", v)
+			}
+			key.WriteByte(0)
+		}
+
+		if prev, ok := previous[key.String()]; ok {
+			delta := *value - prev
+			if delta < 0 {
+				// Counter reset
+				delta = *value
+			}
+			deltas[row] = &delta
+		}
+		previous[key.String()] = *value
+	}
+
+	result := data.NewField(field.Name, field.Labels, deltas)
+	result.Config = field.Config
+	frame.Fields[idx] = result
+
+	return nil
+}
+
+// promoteTimeField moves the time field with the given name in front of all other time fields of
+// the frame. Grafana uses the first time field as the time index of time series, which would
+// ignore the field marked by $__time if the result contains multiple time fields.
+func promoteTimeField(frame *data.Frame, name string) {
+	first := -1
+	for i, field := range frame.Fields {
+		if !field.Type().Time() {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		if field.Name == name {
+			if i != first {
+				frame.Fields = slices.Insert(slices.Delete(frame.Fields, i, i+1), first, field)
+			}
+			return
+		}
+	}
+}
+
+// sortByTime sorts the rows of the given frame by the given time field in ascending order, if they
+// are not sorted yet. Rows with equal times keep their order. Converting long frames to wide
+// frames requires sorted rows, but results grouped by multiple label columns are often ordered by
+// the labels first (e.g. 'ORDER BY region, service, time').
+func sortByTime(frame *data.Frame, timeIndex int) error {
+	field := frame.Fields[timeIndex]
+	times := make([]time.Time, field.Len())
+	sorted := true
+	for row := range times {
+		value, ok := field.ConcreteAt(row)
+		if !ok {
+			return fmt.Errorf("time field '%s' contains null values", field.Name)
+		}
+		times[row] = value.(time.Time)
+		if row > 0 && times[row].Before(times[row-1]) {
+			sorted = false
+		}
+	}
+	if sorted {
+		return nil
+	}
+
+	rows := make([]int, len(times))
+	for i := range rows {
+		rows[i] = i
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return times[rows[i]].Before(times[rows[j]])
+	})
+
+	for i, field := range frame.Fields {
+		frame.Fields[i] = selectRows(field, rows)
+	}
+
+	return nil
+}
+
+// selectRows returns a field with the values of the given rows of the given field. The values of
+// the common field types are copied as typed slices, as the boxed values of field.At allocate for
+// each row. Nullable values share their pointers with the given field.
+func selectRows(field *data.Field, rows []int) *data.Field {
+	var values any
+	switch field.Type() {
+	case data.FieldTypeTime:
+		values = copyRows[time.Time](field, rows)
+	case data.FieldTypeNullableTime:
+		values = copyRows[*time.Time](field, rows)
+	case data.FieldTypeFloat64:
+		values = copyRows[float64](field, rows)
+	case data.FieldTypeNullableFloat64:
+		values = copyRows[*float64](field, rows)
+	case data.FieldTypeFloat32:
+		values = copyRows[float32](field, rows)
+	case data.FieldTypeNullableFloat32:
+		values = copyRows[*float32](field, rows)
+	case data.FieldTypeInt64:
+		values = copyRows[int64](field, rows)
+	case data.FieldTypeNullableInt64:
+		values = copyRows[*int64](field, rows)
+	case data.FieldTypeInt32:
+		values = copyRows[int32](field, rows)
+	case data.FieldTypeNullableInt32:
+		values = copyRows[*int32](field, rows)
+	case data.FieldTypeInt16:
+		values = copyRows[int16](field, rows)
+	case data.FieldTypeNullableInt16:
+		values = copyRows[*int16](field, rows)
+	case data.FieldTypeInt8:
+		values = copyRows[int8](field, rows)
+	case data.FieldTypeNullableInt8:
+		values = copyRows[*int8](field, rows)
+	case data.FieldTypeUint64:
+		values = copyRows[uint64](field, rows)
+	case data.FieldTypeNullableUint64:
+		values = copyRows[*uint64](field, rows)
+	case data.FieldTypeUint32:
+		values = copyRows[uint32](field, rows)
+	case data.FieldTypeNullableUint32:
+		values = copyRows[*uint32](field, rows)
+	case data.FieldTypeUint16:
+		values = copyRows[uint16](field, rows)
+	case data.FieldTypeNullableUint16:
+		values = copyRows[*uint16](field, rows)
+	case data.FieldTypeUint8:
+		values = copyRows[uint8](field, rows)
+	case data.FieldTypeNullableUint8:
+		values = copyRows[*uint8](field, rows)
+	case data.FieldTypeString:
+		values = copyRows[string](field, rows)
+	case data.FieldTypeNullableString:
+		values = copyRows[*string](field, rows)
+	case data.FieldTypeBool:
+		values = copyRows[bool](field, rows)
+	case data.FieldTypeNullableBool:
+		values = copyRows[*bool](field, rows)
+	}
+
+	var result *data.Field
+	if values != nil {
+		result = data.NewField(field.Name, field.Labels, values)
+	} else {
+		result = data.NewFieldFromFieldType(field.Type(), len(rows))
+		result.Name = field.Name
+		result.Labels = field.Labels
+		for j, row := range rows {
+			result.Set(j, field.At(row))
+		}
+	}
+	result.Config = field.Config
+	return result
+}
+
+// copyRows returns the values of the given rows of a field with values of type T. The values are
+// read through field.PointerAt, which does not allocate.
+func copyRows[T any](field *data.Field, rows []int) []T {
+	values := make([]T, len(rows))
+	for i, row := range rows {
+		values[i] = *field.PointerAt(row).(*T)
+	}
+	return values
+}
+
+// splitLongFrame splits a long time series frame into one frame per series. Each combination of
+// the string and boolean fields is a series, whose numeric fields are labeled with the values of
+// these fields (e.g. '{region="us", service="api"}'). The rows must be sorted by time. Returns
+// false, if the frame contains other fields, which requires the generic data.LongToWide instead.
+func splitLongFrame(frame *data.Frame, schema data.TimeSeriesSchema) (data.Frames, bool) {
+	for _, index := range schema.ValueIndices {
+		if !frame.Fields[index].Type().Numeric() {
+			return nil, false
+		}
+	}
+
+	factors := make([][]string, len(schema.FactorIndices))
+	for i, index := range schema.FactorIndices {
+		factors[i] = factorValues(frame.Fields[index])
+	}
+
+	// Group the rows by series in order of appearance
+	var series [][]int
+	var labels []data.Labels
+	seriesByKey := map[string]int{}
+	var key []byte
+	for row := 0; row < frame.Rows(); row++ {
+		key = key[:0]
+		for _, values := range factors {
+			key = append(key, values[row]...)
+			key = append(key, 0)
+		}
+
+		i, ok := seriesByKey[string(key)]
+		if !ok {
+			i = len(series)
+			seriesByKey[string(key)] = i
+			series = append(series, nil)
+			seriesLabels := make(data.Labels, len(schema.FactorIndices))
+			for j, index := range schema.FactorIndices {
+				seriesLabels[frame.Fields[index].Name] = factors[j][row]
+			}
+			labels = append(labels, seriesLabels)
+		}
+		series[i] = append(series[i], row)
+	}
+
+	indices := append([]int{schema.TimeIndex}, schema.ValueIndices...)
+	frames := make(data.Frames, len(series))
+	for i, rows := range series {
+		result := data.NewFrame(frame.Name)
+		for _, index := range indices {
+			copied := selectRows(frame.Fields[index], rows)
+			if index != schema.TimeIndex {
+				copied.Labels = labels[i]
+			}
+			result.Fields = append(result.Fields, copied)
+		}
+		result.Meta = &data.FrameMeta{}
+		if i == 0 {
+			// Notices and statistics are reported once
+			*result.Meta = *frame.Meta
+		}
+		result.Meta.Type = data.FrameTypeTimeSeriesMulti
+		result.Meta.PreferredVisualization = data.VisTypeGraph
+		frames[i] = result
+	}
+
+	return frames, true
+}
+
+// factorValues returns the label values of all rows of the given string or boolean field (see
+// factorValue). The values are read through field.PointerAt, which does not allocate.
+func factorValues(field *data.Field) []string {
+	values := make([]string, field.Len())
+	for row := range values {
+		switch value := field.PointerAt(row).(type) {
+		case *string:
+			values[row] = *value
+		case **string:
+			if *value != nil {
+				values[row] = **value
+			}
+		case *bool:
+			values[row] = strconv.FormatBool(*value)
+		case **bool:
+			if *value != nil {
+				values[row] = strconv.FormatBool(**value)
+			}
+		default:
+			values[row] = factorValue(field, row)
+		}
+	}
+	return values
+}
+
+// factorValue returns the label value of the given string or boolean field at the given row.
+// Null values are returned as empty strings.
+func factorValue(field *data.Field, row int) string {
+	value, ok := field.ConcreteAt(row)
+	if !ok {
+		return ""
+	}
+	switch value := value.(type) {
+	case string:
+		return value
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		return fmt.Sprint(value)
+	}
+}
@@ -0,0 +1,288 @@
+package plugin
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// longFrame returns a long time series frame with the given number of rows, which alternate
+// between the given number of hosts.
+func longFrame(rowCount, hosts int) *data.Frame {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	times := make([]time.Time, rowCount)
+	names := make([]string, rowCount)
+	values := make([]float64, rowCount)
+	for i := range times {
+		times[i] = start.Add(time.Duration(i/hosts) * time.Second)
+		names[i] = fmt.Sprintf("host%d", i%hosts)
+		values[i] = float64(i)
+	}
+	frame := data.NewFrame("A",
+		data.NewField("time", nil, times),
+		data.NewField("host", nil, names),
+		data.NewField("value", nil, values),
+	)
+	frame.Meta = &data.FrameMeta{}
+	return frame
+}
+
+func TestSplitLongFrame(t *testing.T) {
+	frame := longFrame(6, 2)
+	frames, ok := splitLongFrame(frame, frame.TimeSeriesSchema())
+	if !ok {
+		t.Fatal("expected a split long frame")
+	}
+	if len(frames) != 2 {
+		t.Fatalf("expected 2 frames, got %d", len(frames))
+	}
+
+	for i, expected := range [][]float64{{0, 2, 4}, {1, 3, 5}} {
+		f := frames[i]
+		if f.Meta.Type != data.FrameTypeTimeSeriesMulti {
+			t.Errorf("frame %d: expected type %s, got %s", i, data.FrameTypeTimeSeriesMulti, f.Meta.Type)
+		}
+		if len(f.Fields) != 2 {
+			t.Fatalf("frame %d: expected 2 fields, got %d", i, len(f.Fields))
+		}
+		if host := f.Fields[1].Labels["host"]; host != fmt.Sprintf("host%d", i) {
+			t.Errorf("frame %d: expected label host%d, got %s", i, i, host)
+		}
+		for j, value := range expected {
+			if actual := f.Fields[1].At(j); actual != value {
+				t.Errorf("frame %d, row %d: expected %v, got %v", i, j, value, actual)
+			}
+		}
+	}
+}
+
+func TestSplitLongFrameUnsupportedValues(t *testing.T) {
+	frame := longFrame(4, 2)
+	frame.Fields[2] = data.NewField("message", nil, []string{"a", "b", "c", "d"})
+
+	schema := data.TimeSeriesSchema{
+		Type:          data.TimeSeriesTypeLong,
+		TimeIndex:     0,
+		ValueIndices:  []int{2},
+		FactorIndices: []int{1},
+	}
+	if _, ok := splitLongFrame(frame, schema); ok {
+		t.Error("expected the generic conversion for text values")
+	}
+}
+
+// BenchmarkLongFrame compares splitLongFrame to the generic data.LongToWide conversion.
+func BenchmarkLongFrame(b *testing.B) {
+	b.Run("SplitLongFrame", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			frame := longFrame(100_000, 10)
+			b.StartTimer()
+			if _, ok := splitLongFrame(frame, frame.TimeSeriesSchema()); !ok {
+				b.Fatal("expected a split long frame")
+			}
+		}
+	})
+	b.Run("LongToWide", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			frame := longFrame(100_000, 10)
+			b.StartTimer()
+			if _, err := data.LongToWide(frame, &data.FillMissing{Mode: data.FillModeNull}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestSplitLongFrameCompositeLabels(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	frame := data.NewFrame("A",
+		data.NewField("time", nil, []time.Time{start, start, start, start.Add(time.Minute), start.Add(time.Minute)}),
+		data.NewField("region", nil, []string{"us", "us", "eu", "us", "us"}),
+		data.NewField("service", nil, []string{"api", "web", "api", "api", "web"}),
+		data.NewField("requests", nil, []int64{1, 2, 3, 4, 5}),
+	)
+	frame.Meta = &data.FrameMeta{}
+
+	frames, ok := splitLongFrame(frame, frame.TimeSeriesSchema())
+	if !ok {
+		t.Fatal("expected a split long frame")
+	}
+
+	expected := []struct {
+		labels string
+		values string
+	}{
+		{`region=us, service=api`, "[1 4]"},
+		{`region=us, service=web`, "[2 5]"},
+		{`region=eu, service=api`, "[3]"},
+	}
+	if len(frames) != len(expected) {
+		t.Fatalf("expected %d frames, got %d", len(expected), len(frames))
+	}
+	for i, e := range expected {
+		field := frames[i].Fields[1]
+		if labels := field.Labels.String(); labels != e.labels {
+			t.Errorf("frame %d: expected labels %s, got %s", i, e.labels, labels)
+		}
+		if values := fmt.Sprint(concreteValues(field)); values != e.values {
+			t.Errorf("frame %d: expected values %s, got %s", i, e.values, values)
+		}
+	}
+}
+
+func TestSplitLongFrameNullLabels(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	times := []time.Time{start, start, start, start.Add(time.Minute), start.Add(time.Minute), start.Add(time.Minute)}
+	frame := data.NewFrame("A",
+		data.NewField("time", nil, times),
+		data.NewField("region", nil, []*string{ptr("us"), nil, ptr("us"), ptr("us"), nil, nil}),
+		data.NewField("service", nil, []string{"api", "api", "web", "api", "api", "web"}),
+		data.NewField("healthy", nil, []*bool{ptr(true), ptr(false), nil, ptr(true), ptr(false), ptr(false)}),
+		data.NewField("requests", nil, []int64{1, 2, 3, 4, 5, 6}),
+		data.NewField("latency", nil, []*float64{ptr(0.5), nil, ptr(1.5), ptr(2.5), ptr(3.5), nil}),
+	)
+	frame.Meta = &data.FrameMeta{}
+
+	schema := frame.TimeSeriesSchema()
+	if schema.Type != data.TimeSeriesTypeLong {
+		t.Fatalf("expected a long frame, got %s", schema.Type)
+	}
+	frames, ok := splitLongFrame(frame, schema)
+	if !ok {
+		t.Fatal("expected a split long frame")
+	}
+
+	// Null labels are empty strings
+	expected := []struct {
+		labels  string
+		times   string
+		values  string
+		latency string
+	}{
+		{"healthy=true, region=us, service=api", "[0 60000]", "[1 4]", "[0.5 2.5]"},
+		{"healthy=false, region=, service=api", "[0 60000]", "[2 5]", "[<nil> 3.5]"},
+		{"healthy=, region=us, service=web", "[0]", "[3]", "[1.5]"},
+		{"healthy=false, region=, service=web", "[60000]", "[6]", "[<nil>]"},
+	}
+	if len(frames) != len(expected) {
+		t.Fatalf("expected %d frames, got %d", len(expected), len(frames))
+	}
+	for i, e := range expected {
+		f := frames[i]
+		if len(f.Fields) != 3 {
+			t.Fatalf("frame %d: expected 3 fields, got %d", i, len(f.Fields))
+		}
+		var offsets []int64
+		for _, value := range concreteValues(f.Fields[0]) {
+			offsets = append(offsets, value.(time.Time).Sub(start).Milliseconds())
+		}
+		if actual := fmt.Sprint(offsets); actual != e.times {
+			t.Errorf("frame %d: expected times %s, got %s", i, e.times, actual)
+		}
+		for j, values := range []string{e.values, e.latency} {
+			field := f.Fields[j+1]
+			if field.Type() != frame.Fields[j+4].Type() {
+				t.Errorf("frame %d: expected type %s, got %s", i, frame.Fields[j+4].Type(), field.Type())
+			}
+			if labels := field.Labels.String(); labels != e.labels {
+				t.Errorf("frame %d: expected labels %s, got %s", i, e.labels, labels)
+			}
+			if actual := fmt.Sprint(concreteValues(field)); actual != values {
+				t.Errorf("frame %d: expected values %s, got %s", i, values, actual)
+			}
+		}
+	}
+}
+
+// aggregationFrame returns a frame with a nullable host and value field, whose 'c' group only
+// contains null values.
+func aggregationFrame() *data.Frame {
+	hosts := []*string{ptr("a"), ptr("b"), ptr("a"), nil, ptr("c"), ptr("a"), nil}
+	values := []*float64{ptr(1.0), ptr(10.0), ptr(3.0), ptr(7.0), nil, nil, ptr(5.0)}
+	frame := data.NewFrame("A",
+		data.NewField("host", nil, hosts),
+		data.NewField("name", nil, []string{"x", "y", "z", "x", "y", "z", "x"}),
+		data.NewField("value", nil, values),
+	)
+	frame.Meta = &data.FrameMeta{}
+	return frame
+}
+
+func TestAggregateFrame(t *testing.T) {
+	for _, test := range []struct {
+		fn       string
+		expected string
+	}{
+		{"sum", "[4 10 12 <nil>]"},
+		{"avg", "[2 10 6 <nil>]"},
+		{"min", "[1 10 5 <nil>]"},
+		{"max", "[3 10 7 <nil>]"},
+		{"count", "[2 1 2 0]"},
+		{"SUM", "[4 10 12 <nil>]"},
+	} {
+		frame, err := aggregateFrame(aggregationFrame(), []string{"host"}, map[string]string{"value": test.fn})
+		if err != nil {
+			t.Errorf("%s: %s", test.fn, err)
+			continue
+		}
+
+		// The name field is neither grouped nor aggregated and dropped
+		if len(frame.Fields) != 2 {
+			t.Fatalf("%s: expected 2 fields, got %d", test.fn, len(frame.Fields))
+		}
+		// Null keys form a group, groups are in the order of their first row
+		if hosts := fmt.Sprint(concreteValues(frame.Fields[0])); hosts != "[a b <nil> c]" {
+			t.Errorf("%s: expected hosts [a b <nil> c], got %s", test.fn, hosts)
+		}
+		if values := fmt.Sprint(concreteValues(frame.Fields[1])); values != test.expected {
+			t.Errorf("%s: expected values %s, got %s", test.fn, test.expected, values)
+		}
+	}
+}
+
+func TestAggregateFrameMultipleKeys(t *testing.T) {
+	frame, err := aggregateFrame(aggregationFrame(), []string{"name", "host"}, map[string]string{"value": "sum", "host": "count"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"[x y z x y]",
+		"[a b a <nil> c]",
+		"[1 1 2 0 1]",
+		"[1 10 3 12 <nil>]",
+	}
+	if len(frame.Fields) != len(expected) {
+		t.Fatalf("expected %d fields, got %d", len(expected), len(frame.Fields))
+	}
+	for i, field := range frame.Fields {
+		if values := fmt.Sprint(concreteValues(field)); values != expected[i] {
+			t.Errorf("field %d (%s): expected %s, got %s", i, field.Name, expected[i], values)
+		}
+	}
+}
+
+func TestAggregateFrameErrors(t *testing.T) {
+	for _, test := range []struct {
+		groupBy      []string
+		aggregations map[string]string
+		expected     string
+	}{
+		{[]string{"missing"}, nil, "group by: unknown field 'missing'"},
+		{[]string{"host"}, map[string]string{"missing": "sum"}, "aggregations: unknown field 'missing'"},
+		{[]string{"host"}, map[string]string{"value": "median"}, "unsupported aggregation 'median' for field 'value'"},
+		{[]string{"host"}, map[string]string{"value": "sum", "name": "median"}, "unsupported aggregation 'median' for field 'name'"},
+		{[]string{"host"}, map[string]string{"name": "avg"}, "aggregation 'avg' requires a numeric field: 'name' is of type []string"},
+	} {
+		_, err := aggregateFrame(aggregationFrame(), test.groupBy, test.aggregations)
+		if err == nil || err.Error() != test.expected {
+			t.Errorf("%v %v: expected error %q, got %v", test.groupBy, test.aggregations, test.expected, err)
+		}
+	}
+}
@@ -1,14 +1,230 @@
 package plugin
 
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
 type snellerJSONData struct {
+	Region   string `json:"Region"`
 	Endpoint string `json:"Endpoint"`
+
+	// SymbolTableCache enables caching the symbol tables of query results, so that results with
+	// the same symbol table as a previous result don't have to parse it again (see SymtabCache).
+	// Defaults to false.
+	SymbolTableCache bool `json:"SymbolTableCache"`
+
+	// QueryMethod is the HTTP method used to execute queries, either 'GET' or 'POST'. Defaults to
+	// 'POST', if not set.
+	QueryMethod string `json:"QueryMethod"`
+
+	// QueryPath is the URL path used to execute queries, for Sneller-compatible backends that
+	// expose the query execution at a different path. Defaults to '/executeQuery', if not set.
+	QueryPath string `json:"QueryPath"`
+
+	// QueryParam is the name of the URL parameter containing the query, if the QueryMethod is
+	// 'GET'. Defaults to 'query', if not set.
+	QueryParam string `json:"QueryParam"`
+
+	// MaxScanBytes is the maximum number of bytes a query may scan. Queries exceeding the limit
+	// according to the scan estimate are rejected before they are executed. Defaults to 0, which
+	// disables the limit.
+	MaxScanBytes int64 `json:"MaxScanBytes"`
+
+	// AuthScheme is the authentication scheme of all requests, either 'bearer', 'basic' or
+	// 'custom'. Defaults to 'bearer', if not set.
+	AuthScheme string `json:"AuthScheme"`
+
+	// AuthHeader is the name of the header containing the token, if the AuthScheme is 'custom'.
+	// Required for the 'custom' scheme, ignored otherwise.
+	AuthHeader string `json:"AuthHeader"`
+
+	// DefaultDatabase is the database of queries that don't select a database. Defaults to no
+	// database, in which case the tables must be qualified in the query (e.g. 'db.table').
+	DefaultDatabase string `json:"DefaultDatabase"`
+
+	// PathPrefix is prepended to the paths of all requests, e.g. if Sneller is exposed at a
+	// sub-path of a reverse proxy ('/api/sneller').
+	PathPrefix string `json:"PathPrefix"`
+
+	// Timeout is the HTTP request timeout in seconds. Kept raw to report malformed values.
+	Timeout json.RawMessage `json:"Timeout"`
+
+	// MaxRetries is the number of times transient request failures are retried. Defaults to
+	// 3, if not set.
+	MaxRetries *int `json:"MaxRetries"`
+
+	// CacheTTL is the number of seconds database, table and column lookups are cached for.
+	// Defaults to 60 seconds, if not set. Zero disables caching.
+	CacheTTL *float64 `json:"CacheTTL"`
+
+	// MaxCacheEntries is the maximum number of cached lookups. The least recently used lookups
+	// are evicted first. Defaults to 1000, if not set.
+	MaxCacheEntries *int `json:"MaxCacheEntries"`
+
+	// MaxRows is the maximum number of rows returned by a query. Defaults to 1000000, if not
+	// set. Zero disables the limit.
+	MaxRows *int `json:"MaxRows"`
+
+	// MaxConcurrentQueries is the maximum number of queries executed at the same time. Defaults
+	// to 10, if not set. Zero disables the limit.
+	MaxConcurrentQueries *int `json:"MaxConcurrentQueries"`
+
+	QueryTemplates map[string]snellerQueryTemplate `json:"QueryTemplates"`
+	DefaultLimits  map[string]int64                `json:"DefaultLimits"`
+}
+
+// snellerDefaultLimits are the default row limits of queries without a LIMIT clause by panel
+// type. They can be overridden using the 'DefaultLimits' setting.
+var snellerDefaultLimits = map[string]int64{
+	"table": 10000,
+	"logs":  1000,
+}
+
+// snellerQueryTemplate is a named query that can be executed with parameters. Parameters are
+// referenced as '{{name}}' in the SQL text.
+type snellerQueryTemplate struct {
+	Database string `json:"Database"`
+	SQL      string `json:"SQL"`
+}
+
+// snellerTemplateRequest is the request body of the 'templates/{name}' resource.
+type snellerTemplateRequest struct {
+	Params map[string]any `json:"params"`
+	From   int64          `json:"from"` // Unix milliseconds, defaults to one hour ago
+	To     int64          `json:"to"`   // Unix milliseconds, defaults to now
+}
+
+// snellerStreamRequest is the data of a 'query/{hash}' stream subscription, which executes the
+// query and streams the partial results.
+type snellerStreamRequest struct {
+	RefID         string          `json:"refId"`
+	QueryType     string          `json:"queryType"`
+	Query         json.RawMessage `json:"query"`
+	From          int64           `json:"from"` // Unix milliseconds
+	To            int64           `json:"to"`   // Unix milliseconds
+	IntervalMs    int64           `json:"intervalMs"`
+	MaxDataPoints int64           `json:"maxDataPoints"`
 }
 
 type snellerQuery struct {
-	Database *string `json:"Database"`
-	SQL      string  `json:"SQL"`
+	Database         *string                     `json:"Database"`
+	SQL              string                      `json:"SQL"`
+	ColumnOrder      []string                    `json:"ColumnOrder"`
+	BoolColumns      []string                    `json:"BoolColumns"`
+	Units            map[string]snellerFieldUnit `json:"Units"`
+	FlattenTopLevel  bool                        `json:"FlattenTopLevel"`
+	FlattenObjects   bool                        `json:"FlattenObjects"`
+	GroupBy          []string                    `json:"GroupBy"`
+	Aggregations     map[string]string           `json:"Aggregations"`
+	Format           string                      `json:"Format"`
+	StatsFrame       bool                        `json:"StatsFrame"`
+	IntegralFloats   bool                        `json:"IntegralFloats"`
+	Variables        map[string]snellerVariable  `json:"Variables"`
+	PinTypes         bool                        `json:"PinTypes"`
+	NoRetry          bool                        `json:"NoRetry"`
+	MaxStringLength  int                         `json:"MaxStringLength"`
+	FullStrings      bool                        `json:"FullStrings"`
+	MessageField     string                      `json:"MessageField"`
+	LogLabels        bool                        `json:"LogLabels"`
+	Since            *time.Time                  `json:"Since"`
+	Unpivot          string                      `json:"Unpivot"`
+	UnpivotKey       string                      `json:"UnpivotKey"`
+	UnpivotValue     string                      `json:"UnpivotValue"`
+	TimeAsEpoch      bool                        `json:"TimeAsEpoch"`
+	SafeIntegers     bool                        `json:"SafeIntegers"`
+	JSONFormat       string                      `json:"JSONFormat"`
+	Extract          map[string]string           `json:"Extract"`
+	PartialColumns   bool                        `json:"PartialColumns"`
+	PanelType        string                      `json:"PanelType"`
+	TimeFieldName    string                      `json:"TimeFieldName"`
+	CounterColumns   []string                    `json:"CounterColumns"`
+	DropEmptyColumns bool                        `json:"DropEmptyColumns"`
+	DecimalStrings   bool                        `json:"DecimalStrings"`
+	AdhocFilters     []snellerAdhocFilter        `json:"AdhocFilters"`
+
+	// maxRows is the maximum number of rows read from the result, set by the datasource
+	maxRows int
+
+	// defaultLimit is the LIMIT added to the query according to the panel type, or 0 if the query
+	// is not limited by the datasource
+	defaultLimit int64
+}
+
+// snellerVariable describes the current state of a dashboard template variable. Variables are
+// interpolated by the frontend, but some macros require additional information.
+type snellerVariable struct {
+	All    bool     `json:"All"`
+	Values []string `json:"Values"`
+}
+
+// snellerAdhocFilter is a dashboard ad hoc filter, which is applied to all queries of the
+// dashboard.
+type snellerAdhocFilter struct {
+	Key      string `json:"Key"`
+	Operator string `json:"Operator"`
+	Value    string `json:"Value"`
+}
+
+const (
+	snellerFormatTable = "table" // Typed columns derived from the result-set (default)
+	snellerFormatRaw   = "raw"   // Untyped JSON columns without any type inference
+	snellerFormatLogs  = "logs"  // Log lines consisting of a timestamp and a message body
+)
+
+const (
+	snellerJSONCompact  = "compact"  // Compact JSON values (default)
+	snellerJSONIndented = "indented" // Indented JSON values for better readability
+)
+
+const (
+	snellerAuthBearer = "bearer" // 'Authorization: Bearer <token>' (default)
+	snellerAuthBasic  = "basic"  // 'Authorization: Basic ...' using the username and password
+	snellerAuthCustom = "custom" // The plain token in a custom header
+)
+
+// snellerQueryTypeLogs is the query type of log queries, which return a log lines frame.
+const snellerQueryTypeLogs = "logs"
+
+// flattenDepth returns the maximum depth up to which struct columns are flattened.
+func (q *snellerQuery) flattenDepth() int {
+	if q.Format == snellerFormatRaw {
+		return 0
+	}
+	if q.FlattenObjects {
+		return maxFlattenDepth
+	}
+	if q.FlattenTopLevel {
+		return 1
+	}
+	return 0
+}
+
+// streamable returns true, if the rows of a streamed result can be sent in parts, because each row
+// of the frame only depends on a single row of the result. Grouped, aggregated and counter
+// columns depend on all rows, as do the dropped empty columns and the read errors of partial
+// columns, which null the remaining rows.
+func (q *snellerQuery) streamable() bool {
+	return len(q.GroupBy) == 0 && len(q.Aggregations) == 0 && len(q.CounterColumns) == 0 &&
+		!q.DropEmptyColumns && !q.PartialColumns
+}
+
+type snellerFieldUnit struct {
+	Unit        string  `json:"Unit"`
+	Scale       float64 `json:"Scale"`
+	DisplayName string  `json:"DisplayName"`
+	Decimals    *uint16 `json:"Decimals"`
 }
 
 type snellerDatabase struct {
 	Name string `json:"name"`
 }
+
+type snellerColumnInfo struct {
+	Name      string         `json:"name"`
+	FieldType data.FieldType `json:"fieldType"`
+	Type      string         `json:"type"`     // The Sneller type (e.g. 'string' or 'number')
+	Nullable  bool           `json:"nullable"` // The column contains null or missing values
+}
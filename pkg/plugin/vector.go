@@ -0,0 +1,610 @@
+package plugin
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/SnellerInc/sneller/ion"
+)
+
+// vectorKind is the native representation of the values of a columnVector.
+type vectorKind int
+
+const (
+	vectorEmpty  vectorKind = iota // Only null values (or none at all)
+	vectorBool                     // Go: []bool
+	vectorInt                      // Go: []int64
+	vectorUint                     // Go: []uint64, contains at least one value beyond the int64 range
+	vectorFloat                    // Go: []float64
+	vectorString                   // Go: []string
+	vectorTime                     // Go: []time.Time
+)
+
+// columnVector holds the values of a single column while the query result is streamed. Scalar
+// values are appended to a slice of their native Go type, indexed by row, which is handed over
+// to the Grafana field once the column type is known, instead of buffering and converting the
+// values a second time. Rows before the first value of a column (and rows missing the column)
+// are back-filled with zero values and marked as missing.
+//
+// Values that have no native representation (e.g. structs, lists or decimals) and values that
+// conflict with the type of the previous values demote the vector to a columnSpool, which
+// buffers the ION encoding of the values instead.
+type columnVector struct {
+	kind     vectorKind
+	rows     int    // The number of rows, including rows with missing or null values
+	offset   int    // The index of the first row in the bitsets (see view)
+	signed   bool   // At least one negative integer was appended
+	missing  bitset // The rows without a value
+	nulls    bitset // The rows with a null value
+	bools    []bool
+	ints     []int64
+	uints    []uint64
+	floats   []float64
+	strings  []string
+	times    []time.Time
+	interned map[string]string // Deduplicates the values of low-cardinality string columns
+
+	spool *columnSpool // The buffered values, if the vector has been demoted
+}
+
+// bitset is a growable set of row indices.
+type bitset []uint64
+
+func (b *bitset) set(i int) {
+	for len(*b) <= i/64 {
+		*b = append(*b, 0)
+	}
+	(*b)[i/64] |= 1 << (i % 64)
+}
+
+func (b bitset) clear(i int) {
+	if i/64 < len(b) {
+		b[i/64] &^= 1 << (i % 64)
+	}
+}
+
+func (b bitset) get(i int) bool {
+	return i/64 < len(b) && b[i/64]&(1<<(i%64)) != 0
+}
+
+// valid returns true, if the given row contains a non-null value.
+func (v *columnVector) valid(row int) bool {
+	return !v.missing.get(v.offset+row) && !v.nulls.get(v.offset+row)
+}
+
+// view returns the values of the rows from the given row on. The view shares the values with v,
+// but is not affected by the values appended to v afterwards. Values must not be appended to the
+// view.
+func (v *columnVector) view(from int) *columnVector {
+	from = minInt(from, v.rows)
+	view := *v
+	view.rows -= from
+	view.offset += from
+	view.bools = tail(v.bools, from)
+	view.ints = tail(v.ints, from)
+	view.uints = tail(v.uints, from)
+	view.floats = tail(v.floats, from)
+	view.strings = tail(v.strings, from)
+	view.times = tail(v.times, from)
+	view.interned = nil
+	return &view
+}
+
+// tail returns the values from the given index on, or nil, if there are none.
+func tail[T any](values []T, from int) []T {
+	if from >= len(values) {
+		return nil
+	}
+	return values[from:len(values):len(values)]
+}
+
+// append appends the current value of the reader, which belongs to the row with the given index.
+// Nested field names are added to the given symbol table, if the vector is demoted.
+func (v *columnVector) append(reader *IonReader, row int, symbols *ion.Symtab) error {
+	if v.spool == nil {
+		ok, err := v.appendNative(reader, row)
+		if ok || err != nil {
+			return err
+		}
+		v.demote()
+	}
+	return v.spool.append(reader, row, symbols)
+}
+
+// appendNative appends the current value of the reader to the native values. Returns false, if
+// the value can not be represented natively.
+func (v *columnVector) appendNative(reader *IonReader, row int) (bool, error) {
+	switch reader.Type() {
+	case ion.NullType:
+		err := reader.ReadNull()
+		if err != nil {
+			return false, err
+		}
+		v.resize(row)
+		v.nulls.set(row)
+		return true, nil
+	case ion.BoolType:
+		if !v.convert(vectorBool) {
+			return false, nil
+		}
+		value, err := reader.ReadBool()
+		if err != nil {
+			return false, err
+		}
+		v.resize(row)
+		v.bools[row] = value
+	case ion.UintType:
+		value, err := reader.ReadUint()
+		if errors.Is(err, errIntegerOverflow) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		kind := vectorInt
+		if value > math.MaxInt64 {
+			kind = vectorUint
+		}
+		if !v.convert(kind) {
+			return false, nil
+		}
+		v.resize(row)
+		switch v.kind {
+		case vectorInt:
+			v.ints[row] = int64(value)
+		case vectorUint:
+			v.uints[row] = value
+		case vectorFloat:
+			if value > maxSafeInteger {
+				return false, nil
+			}
+			v.floats[row] = float64(value)
+		}
+	case ion.IntType:
+		value, err := reader.ReadInt()
+		if errors.Is(err, errIntegerOverflow) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		v.signed = true
+		if !v.convert(vectorInt) {
+			return false, nil
+		}
+		v.resize(row)
+		switch v.kind {
+		case vectorInt:
+			v.ints[row] = value
+		case vectorFloat:
+			if value < -maxSafeInteger {
+				return false, nil
+			}
+			v.floats[row] = float64(value)
+		}
+	case ion.FloatType:
+		if !v.convert(vectorFloat) {
+			return false, nil
+		}
+		value, err := reader.ReadFloat()
+		if err != nil {
+			return false, err
+		}
+		v.resize(row)
+		v.floats[row] = value
+	case ion.StringType:
+		if !v.convert(vectorString) {
+			return false, nil
+		}
+		b, err := reader.readStringShared()
+		if err != nil {
+			return false, err
+		}
+		value, ok := v.interned[string(b)]
+		if !ok {
+			value = string(b)
+			if v.interned == nil {
+				v.interned = map[string]string{}
+			}
+			if len(v.interned) < stringInternerMaxEntries {
+				v.interned[value] = value
+			}
+		}
+		v.resize(row)
+		v.strings[row] = value
+	case ion.SymbolType:
+		if !v.convert(vectorString) {
+			return false, nil
+		}
+		// Symbols already share the string of the symbol table
+		value, err := reader.ReadText()
+		if err != nil {
+			return false, err
+		}
+		v.resize(row)
+		v.strings[row] = value
+	case ion.TimestampType:
+		if !v.convert(vectorTime) {
+			return false, nil
+		}
+		value, err := readTime(reader)
+		if err != nil {
+			// Malformed and out-of-range timestamps are handled by the field readers
+			var warning *valueWarning
+			if errors.As(err, &warning) {
+				return false, nil
+			}
+			return false, err
+		}
+		v.resize(row)
+		v.times[row] = value
+	default:
+		return false, nil
+	}
+
+	v.nulls.clear(row)
+	return true, nil
+}
+
+// convert converts the vector to a kind that can hold a value of the given kind. Integers are
+// converted to unsigned integers, if they are not negative, and to floating point numbers, if
+// they can be represented exactly. Returns false, if the vector can not be converted.
+func (v *columnVector) convert(kind vectorKind) bool {
+	switch {
+	case v.kind == kind:
+		return true
+	case v.kind == vectorEmpty:
+		v.kind = kind
+		v.resize(v.rows - 1)
+		return true
+	case v.kind == vectorUint && kind == vectorInt:
+		// Negative integers next to integers beyond the int64 range are neither int64 nor uint64
+		return !v.signed
+	case v.kind == vectorFloat && (kind == vectorInt || kind == vectorUint):
+		// The integer is checked by the caller
+		return true
+	case v.kind == vectorInt && kind == vectorUint:
+		if v.signed {
+			return false
+		}
+		v.uints = growValues(v.uints, v.rows, 0)
+		for i, value := range v.ints {
+			v.uints[i] = uint64(value)
+		}
+		v.ints = nil
+		v.kind = vectorUint
+		return true
+	case v.kind == vectorInt && kind == vectorFloat:
+		for _, value := range v.ints {
+			if value < -maxSafeInteger || value > maxSafeInteger {
+				return false
+			}
+		}
+		v.floats = growValues(v.floats, v.rows, 0)
+		for i, value := range v.ints {
+			v.floats[i] = float64(value)
+		}
+		v.ints = nil
+		v.kind = vectorFloat
+		return true
+	}
+	return false
+}
+
+// resize extends the vector up to the given row. Skipped rows are marked as missing.
+func (v *columnVector) resize(row int) {
+	if row >= v.rows {
+		for i := v.rows; i < row; i++ {
+			v.missing.set(i)
+		}
+		v.rows = row + 1
+	}
+
+	switch v.kind {
+	case vectorBool:
+		v.bools = growValues(v.bools, v.rows, 0)
+	case vectorInt:
+		v.ints = growValues(v.ints, v.rows, 0)
+	case vectorUint:
+		v.uints = growValues(v.uints, v.rows, 0)
+	case vectorFloat:
+		v.floats = growValues(v.floats, v.rows, 0)
+	case vectorString:
+		v.strings = growValues(v.strings, v.rows, 0)
+	case vectorTime:
+		v.times = growValues(v.times, v.rows, 0)
+	}
+}
+
+// demote moves the native values to a columnSpool and releases them.
+func (v *columnVector) demote() {
+	spool := &columnSpool{}
+	for row := 0; row < v.rows; row++ {
+		if v.missing.get(v.offset + row) {
+			continue
+		}
+		spool.track(row)
+		if v.nulls.get(v.offset + row) {
+			spool.buf.WriteNull()
+			continue
+		}
+		switch v.kind {
+		case vectorBool:
+			spool.buf.WriteBool(v.bools[row])
+		case vectorInt:
+			spool.buf.WriteInt(v.ints[row])
+		case vectorUint:
+			spool.buf.WriteUint(v.uints[row])
+		case vectorFloat:
+			spool.buf.WriteFloat64(v.floats[row])
+		case vectorString:
+			spool.buf.WriteString(v.strings[row])
+		case vectorTime:
+			writeTime(&spool.buf, v.times[row])
+		}
+	}
+	*v = columnVector{spool: spool}
+}
+
+// spooled returns the buffered values of the vector, demoting the vector if required.
+func (v *columnVector) spooled() *columnSpool {
+	if v.spool == nil {
+		v.demote()
+	}
+	return v.spool
+}
+
+// writeTime appends the given timestamp with nanosecond precision (ion.Buffer.WriteTime truncates
+// the fraction to microseconds).
+func writeTime(dst *ion.Buffer, t time.Time) {
+	t = t.UTC()
+	year, nanos := t.Year(), t.Nanosecond()
+	dst.UnsafeAppend([]byte{
+		byte(ion.TimestampType<<4) | 13,
+		0x80, // UTC offset
+		byte(year >> 7),
+		byte(year&0x7f) | 0x80,
+		byte(t.Month()) | 0x80,
+		byte(t.Day()) | 0x80,
+		byte(t.Hour()) | 0x80,
+		byte(t.Minute()) | 0x80,
+		byte(t.Second()) | 0x80,
+		0xc9, // Fraction exponent -9
+		byte(nanos >> 24),
+		byte(nanos >> 16),
+		byte(nanos >> 8),
+		byte(nanos),
+	})
+}
+
+// ---
+
+// vectorConvertFunc converts the native values of a column vector to the values of a field.
+// Returns false, if the values can not be converted, in which case they are read from the ION
+// encoding by the read function of the field instead.
+type vectorConvertFunc[T any] func(v *columnVector, field *fieldValues) ([]T, bool)
+
+// withVector allows the values of the given field to be converted from a column vector by fn.
+func withVector[T any](field *fieldValues, fn vectorConvertFunc[T]) *fieldValues {
+	field.ConvertFn = func(v *columnVector) bool {
+		values, ok := fn(v, field)
+		if !ok {
+			return false
+		}
+		field.FinishFn = func(rowCount int) any {
+			return growValues(values, rowCount, rowCount)
+		}
+		return true
+	}
+	return field
+}
+
+// vectorNullable returns a convert function for nullable values, which point to the values
+// converted by fn. Missing and null values are nil.
+func vectorNullable[T any](fn vectorConvertFunc[T]) vectorConvertFunc[*T] {
+	return func(v *columnVector, field *fieldValues) ([]*T, bool) {
+		result := make([]*T, v.rows)
+		if v.kind == vectorEmpty {
+			return result, true
+		}
+		values, ok := fn(v, field)
+		if !ok {
+			return nil, false
+		}
+		for i := range result {
+			if v.valid(i) {
+				result[i] = &values[i]
+			}
+		}
+		return result, true
+	}
+}
+
+func vectorBools(v *columnVector, _ *fieldValues) ([]bool, bool) {
+	return v.bools, v.kind == vectorBool
+}
+
+func vectorStrings(v *columnVector, _ *fieldValues) ([]string, bool) {
+	return v.strings, v.kind == vectorString
+}
+
+func vectorTimes(v *columnVector, _ *fieldValues) ([]time.Time, bool) {
+	return v.times, v.kind == vectorTime
+}
+
+func vectorInt64s(v *columnVector, _ *fieldValues) ([]int64, bool) {
+	return v.ints, v.kind == vectorInt
+}
+
+func vectorUint64s(v *columnVector, _ *fieldValues) ([]uint64, bool) {
+	if v.kind == vectorUint {
+		return v.uints, true
+	}
+	return vectorNumbers[uint64](v, false)
+}
+
+func vectorFloat64s(v *columnVector, _ *fieldValues) ([]float64, bool) {
+	if v.kind == vectorFloat {
+		return v.floats, true
+	}
+	return vectorNumbers[float64](v, true)
+}
+
+// vectorNarrowInts converts integers into a narrower type. The range of the column is checked by
+// narrowIntegerType, so the conversion does not truncate the values.
+func vectorNarrowInts[T int8 | int16 | int32](v *columnVector, _ *fieldValues) ([]T, bool) {
+	if v.kind != vectorInt {
+		return nil, false
+	}
+	return vectorNumbers[T](v, true)
+}
+
+// vectorNarrowUints converts non-negative integers into a narrower type. The range of the column
+// is checked by narrowIntegerType, so the conversion does not truncate the values.
+func vectorNarrowUints[T uint8 | uint16 | uint32](v *columnVector, _ *fieldValues) ([]T, bool) {
+	return vectorNumbers[T](v, false)
+}
+
+// vectorNumbers converts integer values to the given type. Negative values are only converted, if
+// signed is set.
+func vectorNumbers[T int8 | int16 | int32 | uint8 | uint16 | uint32 | uint64 | float64](v *columnVector, signed bool) ([]T, bool) {
+	if v.signed && !signed {
+		return nil, false
+	}
+	result := make([]T, v.rows)
+	switch v.kind {
+	case vectorInt:
+		for i, value := range v.ints {
+			result[i] = T(value)
+		}
+	case vectorUint:
+		for i, value := range v.uints {
+			result[i] = T(value)
+		}
+	default:
+		return nil, false
+	}
+	return result, true
+}
+
+// vectorInt64sFromNumbers converts numeric values to integers. Floating point values are
+// truncated (see readInt64FromNumber).
+func vectorInt64sFromNumbers(v *columnVector, _ *fieldValues) ([]int64, bool) {
+	switch v.kind {
+	case vectorInt:
+		return v.ints, true
+	case vectorFloat:
+		result := make([]int64, v.rows)
+		for i, value := range v.floats {
+			result[i] = int64(value)
+		}
+		return result, true
+	}
+	return nil, false
+}
+
+// vectorBoolsFromNumbers converts numeric values to booleans (see readBoolFromNumberNullable).
+func vectorBoolsFromNumbers(v *columnVector, _ *fieldValues) ([]*bool, bool) {
+	values, ok := vectorFloat64s(v, nil)
+	if !ok && v.kind != vectorEmpty {
+		return nil, false
+	}
+	bools := [2]bool{false, true}
+	result := make([]*bool, v.rows)
+	for i, value := range values {
+		if v.valid(i) && (value == 0 || value == 1) {
+			result[i] = &bools[int(value)]
+		}
+	}
+	return result, true
+}
+
+// vectorIntegerStrings converts integer values to decimal strings (see
+// readIntegerAsStringNullable).
+func vectorIntegerStrings(v *columnVector, _ *fieldValues) ([]*string, bool) {
+	result := make([]*string, v.rows)
+	for i := range result {
+		if !v.valid(i) {
+			continue
+		}
+		var value string
+		switch v.kind {
+		case vectorInt:
+			value = strconv.FormatInt(v.ints[i], 10)
+		case vectorUint:
+			value = strconv.FormatUint(v.uints[i], 10)
+		default:
+			return nil, false
+		}
+		result[i] = &value
+	}
+	return result, true
+}
+
+// vectorTimesFromInt64 returns a convert function for Unix timestamps in the given unit (see
+// readTimeFromInt64).
+func vectorTimesFromInt64(unit time.Duration) vectorConvertFunc[time.Time] {
+	return func(v *columnVector, _ *fieldValues) ([]time.Time, bool) {
+		if v.kind != vectorInt {
+			return nil, false
+		}
+		result := make([]time.Time, v.rows)
+		for i, value := range v.ints {
+			switch unit {
+			case time.Second:
+				result[i] = time.Unix(value, 0)
+			case time.Microsecond:
+				result[i] = time.UnixMicro(value)
+			case time.Nanosecond:
+				result[i] = time.Unix(0, value)
+			default:
+				result[i] = time.UnixMilli(value)
+			}
+		}
+		return result, true
+	}
+}
+
+// vectorTimesFromStrings converts string timestamps (see readTimeFromString).
+func vectorTimesFromStrings(v *columnVector, field *fieldValues) ([]time.Time, bool) {
+	if v.kind != vectorString {
+		return nil, false
+	}
+	result := make([]time.Time, v.rows)
+	for i, text := range v.strings {
+		if !v.valid(i) {
+			continue
+		}
+		value, warning := parseTime(text)
+		if warning != nil {
+			field.warn(warning)
+		}
+		result[i] = value
+	}
+	return result, true
+}
+
+// vectorTimesFromStringsNullable converts nullable string timestamps. Strings that can not be
+// parsed are replaced by nil (see readTimeFromStringNullable).
+func vectorTimesFromStringsNullable(v *columnVector, field *fieldValues) ([]*time.Time, bool) {
+	if v.kind != vectorString && v.kind != vectorEmpty {
+		return nil, false
+	}
+	result := make([]*time.Time, v.rows)
+	values := make([]time.Time, len(v.strings))
+	for i, text := range v.strings {
+		if !v.valid(i) {
+			continue
+		}
+		value, warning := parseTime(text)
+		if warning != nil {
+			field.warn(warning)
+			continue
+		}
+		values[i] = value
+		result[i] = &values[i]
+	}
+	return result, true
+}
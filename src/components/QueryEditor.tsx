@@ -2,7 +2,7 @@ import React, { useRef } from 'react';
 import {InlineField, AsyncSelect, ActionMeta, monacoTypes, Monaco} from '@grafana/ui';
 import { QueryEditorProps, SelectableValue } from '@grafana/data';
 import { DataSource } from '../datasource';
-import { SnellerDataSourceOptions, SnellerQuery } from '../types';
+import { SnellerColumnInfo, SnellerDataSourceOptions, SnellerQuery } from '../types';
 import { getStandardSQLCompletionProvider, LanguageDefinition, SQLEditor, SQLMonarchLanguage } from '@grafana/experimental';
 import { language, conf } from "../sneller_sql";
 import { TableIdentifier } from "@grafana/experimental/dist/sql-editor/types";
@@ -54,10 +54,13 @@ export function QueryEditor({ datasource, query, onChange, onRunQuery }: Props)
         }
         try {
             const response = await datasource.getResource(
-                'columns/' + encodeURIComponent(databaseRef.current!) + '/' + encodeURIComponent(table.table)
-            ) as string[];
+                'columns/' + encodeURIComponent(databaseRef.current!) + '/' + encodeURIComponent(table.table),
+                { fieldTypes: true }
+            ) as SnellerColumnInfo[];
             return (response.map((x) => ({
-                name: x,
+                name: x.name,
+                type: x.type,
+                description: x.nullable ? `${x.type} (nullable)` : x.type,
             })));
         } catch {
             return []
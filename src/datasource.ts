@@ -1,24 +1,136 @@
-import { CoreApp, DataSourceInstanceSettings, ScopedVars } from '@grafana/data';
-import { DataSourceWithBackend, getTemplateSrv } from '@grafana/runtime';
+import {
+  CoreApp,
+  DataQueryRequest,
+  DataQueryResponse,
+  DataSourceInstanceSettings,
+  LiveChannelScope,
+  MetricFindValue,
+  ScopedVars,
+} from '@grafana/data';
+import { DataSourceWithBackend, getGrafanaLiveSrv, getTemplateSrv, StreamingFrameAction } from '@grafana/runtime';
+import { merge, Observable } from 'rxjs';
 
-import { DEFAULT_QUERY, SnellerDataSourceOptions, SnellerQuery } from './types';
+import { DEFAULT_QUERY, SnellerAdhocFilter, SnellerDataSourceOptions, SnellerQuery, SnellerVariable } from './types';
 import { SnellerVariableSupport } from "./variables";
 
 export class DataSource extends DataSourceWithBackend<SnellerQuery, SnellerDataSourceOptions> {
+  defaultDatabase?: string;
+
   constructor(instanceSettings: DataSourceInstanceSettings<SnellerDataSourceOptions>) {
     super(instanceSettings);
     this.variables = new SnellerVariableSupport()
+    this.defaultDatabase = instanceSettings.jsonData.defaultDatabase;
   }
 
   getDefaultQuery(_: CoreApp): Partial<SnellerQuery> {
     return DEFAULT_QUERY
   }
 
+  /**
+   * Executes queries with the `stream` option through a Grafana Live channel, which receives the
+   * partial results while the query is running. All other queries are executed as usual.
+   */
+  query(request: DataQueryRequest<SnellerQuery>): Observable<DataQueryResponse> {
+    const streamed = request.targets.filter((t) => t.stream && !t.hide);
+    if (streamed.length === 0) {
+      return super.query(request);
+    }
+
+    const observables = streamed.map((target) => {
+      const data = {
+        refId: target.refId,
+        queryType: target.queryType,
+        query: this.applyTemplateVariables(target, request.scopedVars),
+        from: request.range.from.valueOf(),
+        to: request.range.to.valueOf(),
+        intervalMs: request.intervalMs,
+        maxDataPoints: request.maxDataPoints,
+      };
+      return getGrafanaLiveSrv().getDataStream({
+        addr: {
+          scope: LiveChannelScope.DataSource,
+          namespace: this.uid,
+          path: `query/${hash(JSON.stringify(data))}`,
+          data: data,
+        },
+        // Partial results only contain the new rows, which are appended to the previous ones
+        buffer: {
+          maxLength: Infinity,
+          action: StreamingFrameAction.Append,
+        },
+      });
+    });
+
+    const remaining = request.targets.filter((t) => !streamed.includes(t));
+    if (remaining.length > 0) {
+      observables.push(super.query({ ...request, targets: remaining }));
+    }
+    return merge(...observables);
+  }
+
   applyTemplateVariables(query: SnellerQuery, scopedVars: ScopedVars): Record<string, any> {
     console.log(query.sql)
     return {
       ...query,
-      sql: getTemplateSrv().replace(query.sql, scopedVars),
+      sql: getTemplateSrv().replace(keepConditionalAllVariables(query.sql), scopedVars),
+      variables: variableStates(scopedVars),
+      adhocFilters: adhocFilters(this.name),
+    };
+  }
+
+  /**
+   * Returns the ad hoc filter keys, which are the columns of all tables of the default database
+   */
+  async getTagKeys(): Promise<MetricFindValue[]> {
+    const keys: string[] = await this.getResource(`keys/${encodeURIComponent(this.defaultDatabase ?? '')}`);
+    return keys.map((key) => ({ text: key }));
+  }
+}
+
+/**
+ * Returns a hash of the given string, which identifies the stream channel of a query.
+ */
+function hash(value: string): string {
+  let h = 0;
+  for (let i = 0; i < value.length; i++) {
+    h = (Math.imul(31, h) + value.charCodeAt(i)) | 0;
+  }
+  return (h >>> 0).toString(16);
+}
+
+/**
+ * Returns the ad hoc filters of the dashboard that apply to the data source with the given name.
+ */
+function adhocFilters(datasourceName: string): SnellerAdhocFilter[] {
+  const filters: any[] = (getTemplateSrv() as any).getAdhocFilters?.(datasourceName) ?? [];
+  return filters.map((f) => ({ key: f.key, operator: f.operator, value: String(f.value) }));
+}
+
+/**
+ * Replaces the variable argument of `$__conditionalAll(expr, $var)` macros with the bare variable
+ * name, so that the backend can look up the variable state after interpolation.
+ */
+function keepConditionalAllVariables(sql?: string): string | undefined {
+  return sql?.replace(/(\$__conditionalAll\([\s\S]*?,\s*)\$\{?(\w+)\}?(\s*\))/g, '$1$2$3');
+}
+
+/**
+ * Returns the current state of all dashboard template variables. If the `All` option is selected,
+ * the values contain the custom all value or all options of the variable.
+ */
+function variableStates(scopedVars: ScopedVars): Record<string, SnellerVariable> {
+  const result: Record<string, SnellerVariable> = {};
+  for (const variable of getTemplateSrv().getVariables() as any[]) {
+    const value = scopedVars[variable.name]?.value ?? variable.current?.value;
+    let values: string[] = (Array.isArray(value) ? value : [value]).filter((v) => v !== undefined).map(String);
+    const all = values.includes('$__all');
+    if (all) {
+      values = variable.allValue ? [variable.allValue] : (variable.options ?? []).map((o: any) => String(o.value));
+    }
+    result[variable.name] = {
+      all: all,
+      values: values.filter((v) => v !== '$__all'),
     };
   }
+  return result;
 }
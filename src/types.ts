@@ -3,6 +3,63 @@ import { DataQuery, DataSourceJsonData } from '@grafana/data';
 export interface SnellerQuery extends DataQuery {
   database?: string;
   sql?: string;
+  columnOrder?: string[];
+  boolColumns?: string[];
+  units?: Record<string, SnellerFieldUnit>;
+  flattenTopLevel?: boolean;
+  flattenObjects?: boolean;
+  groupBy?: string[];
+  aggregations?: Record<string, 'sum' | 'avg' | 'min' | 'max' | 'count'>;
+  format?: 'table' | 'raw' | 'logs';
+  statsFrame?: boolean;
+  integralFloats?: boolean;
+  variables?: Record<string, SnellerVariable>;
+  pinTypes?: boolean;
+  noRetry?: boolean;
+  maxStringLength?: number;
+  fullStrings?: boolean;
+  messageField?: string;
+  logLabels?: boolean;
+  since?: string;
+  unpivot?: string;
+  unpivotKey?: string;
+  unpivotValue?: string;
+  timeAsEpoch?: boolean;
+  safeIntegers?: boolean;
+  jsonFormat?: 'compact' | 'indented';
+  extract?: Record<string, string>;
+  partialColumns?: boolean;
+  panelType?: string;
+  timeFieldName?: string;
+  counterColumns?: string[];
+  dropEmptyColumns?: boolean;
+  decimalStrings?: boolean;
+  adhocFilters?: SnellerAdhocFilter[];
+  stream?: boolean;
+}
+
+/**
+ * Dashboard ad hoc filter, which is applied to all queries by the backend
+ */
+export interface SnellerAdhocFilter {
+  key: string;
+  operator: '=' | '!=' | '=~' | '!~';
+  value: string;
+}
+
+/**
+ * State of a dashboard template variable, which is required by some backend macros
+ */
+export interface SnellerVariable {
+  all: boolean;
+  values: string[];
+}
+
+export interface SnellerFieldUnit {
+  unit?: string;
+  scale?: number;
+  displayName?: string;
+  decimals?: number;
 }
 
 export const DEFAULT_QUERY: Partial<SnellerQuery> = {
@@ -15,6 +72,41 @@ export const DEFAULT_QUERY: Partial<SnellerQuery> = {
 export interface SnellerDataSourceOptions extends DataSourceJsonData {
   region?: string;
   endpoint?: string;
+  symbolTableCache?: boolean;
+  queryMethod?: 'GET' | 'POST';
+  queryPath?: string;
+  queryParam?: string;
+  maxScanBytes?: number;
+  authScheme?: 'bearer' | 'basic' | 'custom';
+  authHeader?: string;
+  defaultDatabase?: string;
+  timeout?: number;
+  maxRetries?: number;
+  cacheTTL?: number;
+  maxCacheEntries?: number;
+  maxRows?: number;
+  pathPrefix?: string;
+  maxConcurrentQueries?: number;
+  queryTemplates?: Record<string, SnellerQueryTemplate>;
+  defaultLimits?: Record<string, number>;
+}
+
+/**
+ * Column returned by the `columns/{database}/{table}` resource, if `fieldTypes` is set
+ */
+export interface SnellerColumnInfo {
+  name: string;
+  fieldType: string;
+  type: string;
+  nullable: boolean;
+}
+
+/**
+ * Named query that can be executed using the `templates/{name}` resource
+ */
+export interface SnellerQueryTemplate {
+  database?: string;
+  sql: string;
 }
 
 /**
@@ -22,4 +114,6 @@ export interface SnellerDataSourceOptions extends DataSourceJsonData {
  */
 export interface SnellerSecureJsonData {
   token?: string;
+  username?: string;
+  password?: string;
 }